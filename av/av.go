@@ -122,6 +122,7 @@ var (
 	PCM_ALAW  = MakeAudioCodecType(avCodecTypeMagic + 3)
 	SPEEX = MakeAudioCodecType(avCodecTypeMagic + 4)
 	NELLYMOSER = MakeAudioCodecType(avCodecTypeMagic + 5)
+	H265 = MakeVideoCodecType(avCodecTypeMagic + 2)
 )
 
 const codecTypeAudioBit = 0x1
@@ -131,6 +132,8 @@ func (self CodecType) String() string {
 	switch self {
 	case H264:
 		return "H264"
+	case H265:
+		return "H265"
 	case AAC:
 		return "AAC"
 	case PCM_MULAW:
@@ -233,6 +236,8 @@ type Packet struct {
 	CompositionTime time.Duration // packet presentation time minus decode time for H264 B-Frame
 	Time time.Duration // packet decode time
 	Data            []byte // packet data
+	IsScriptData    bool // Data is script data like onMetaData or onCuePoint, AMF0 encoded as an FLV script tag body; Idx is unused
+	NewCodecData    CodecData // set on the first packet of stream Idx after its codec data changed mid-stream, e.g. a new resolution; flv, ts, rtmp and TS segment hls muxers and pubsub.Queue switch to it before writing the packet, the dash muxer at the next keyframe, others ignore it
 }
 
 // Raw audio frame.
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"bytes"
 	"github.com/nareix/joy4/av"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sync"
+	"time"
 )
 
 type HandlerDemuxer struct {
@@ -66,14 +69,22 @@ type RegisterHandler struct {
 	ServerDemuxer func(string)(bool,av.DemuxCloser,error)
 	ServerMuxer func(string)(bool,av.MuxCloser,error)
 	CodecTypes []av.CodecType
+	// the Handlers it was added to, e.g. for its HTTP options
+	Handlers *Handlers
 }
 
 type Handlers struct {
 	handlers []RegisterHandler
+	// used for http:// and https:// urls, also by handlers reading them
+	HTTP HTTPOptions
+
+	lock sync.Mutex
+	client *http.Client
+	clienttimeout time.Duration
 }
 
 func (self *Handlers) Add(fn func(*RegisterHandler)) {
-	handler := &RegisterHandler{}
+	handler := &RegisterHandler{Handlers: self}
 	fn(handler)
 	self.handlers = append(self.handlers, *handler)
 }
@@ -88,6 +99,9 @@ func (self *Handlers) openUrl(u *url.URL, uri string) (r io.ReadCloser, err erro
 				}
 			}
 		}
+		if isHTTPScheme(u.Scheme) {
+			return self.openHTTP(uri)
+		}
 		err = fmt.Errorf("avutil: openUrl %s failed", uri)
 	} else {
 		r, err = os.Open(uri)
@@ -96,6 +110,9 @@ func (self *Handlers) openUrl(u *url.URL, uri string) (r io.ReadCloser, err erro
 }
 
 func (self *Handlers) createUrl(u *url.URL, uri string) (w io.WriteCloser, err error) {
+	if u != nil && isHTTPScheme(u.Scheme) {
+		return self.createHTTP(uri)
+	}
 	w, err = os.Create(uri)
 	return
 }
@@ -165,8 +182,14 @@ func (self *Handlers) Open(uri string) (demuxer av.DemuxCloser, err error) {
 					if r, err = self.openUrl(u, uri); err != nil {
 						return
 					}
+					_demuxer := handler.ReaderDemuxer(r)
+					if _demuxer == nil {
+						r.Close()
+						err = fmt.Errorf("avutil: open %s failed: %s input is not seekable", uri, ext)
+						return
+					}
 					demuxer = &HandlerDemuxer{
-						Demuxer: handler.ReaderDemuxer(r),
+						Demuxer: _demuxer,
 						r: r,
 					}
 					return
@@ -194,8 +217,14 @@ func (self *Handlers) Open(uri string) (demuxer av.DemuxCloser, err error) {
 			} else {
 				_r = io.MultiReader(bytes.NewReader(probebuf[:]), r)
 			}
+			_demuxer := handler.ReaderDemuxer(_r)
+			if _demuxer == nil {
+				r.Close()
+				err = fmt.Errorf("avutil: open %s failed: input is not seekable", uri)
+				return
+			}
 			demuxer = &HandlerDemuxer{
-				Demuxer: handler.ReaderDemuxer(_r),
+				Demuxer: _demuxer,
 				r: r,
 			}
 			return
@@ -252,8 +281,14 @@ func (self *Handlers) FindCreate(uri string) (handler RegisterHandler, muxer av.
 				if w, err = self.createUrl(u, uri); err != nil {
 					return
 				}
+				_muxer := handler.WriterMuxer(w)
+				if _muxer == nil {
+					w.Close()
+					err = fmt.Errorf("avutil: create muxer %s failed: %s output is not seekable", uri, ext)
+					return
+				}
 				muxer = &HandlerMuxer{
-					Muxer: handler.WriterMuxer(w),
+					Muxer: _muxer,
 					w: w,
 				}
 				return
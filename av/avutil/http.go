@@ -0,0 +1,293 @@
+package avutil
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPOptions configures the built-in http:// and https:// input and
+// output of Handlers.
+type HTTPOptions struct {
+	// Extra request headers, e.g. Authorization.
+	Header http.Header
+	// Used for all requests if set, Timeout is then ignored.
+	Client *http.Client
+	// Limits connecting and waiting for the response headers, 0 means no
+	// limit. Reading and writing the body are not limited, as it may be a
+	// live stream.
+	Timeout time.Duration
+	// Method of output requests, PUT by default.
+	Method string
+}
+
+// NewClient returns Client if set, http.DefaultClient if there is no
+// Timeout, or else a new client limited by Timeout.
+func (self HTTPOptions) NewClient() *http.Client {
+	if self.Client != nil {
+		return self.Client
+	}
+	timeout := self.Timeout
+	if timeout == 0 {
+		return http.DefaultClient
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			Dial:                  dialer.Dial,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}
+
+func (self *Handlers) httpClient() *http.Client {
+	if self.HTTP.Client != nil || self.HTTP.Timeout == 0 {
+		return self.HTTP.NewClient()
+	}
+
+	// reused to keep connections alive
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.client == nil || self.clienttimeout != self.HTTP.Timeout {
+		self.client = self.HTTP.NewClient()
+		self.clienttimeout = self.HTTP.Timeout
+	}
+	return self.client
+}
+
+func (self *Handlers) newHTTPRequest(method string, uri string, body io.Reader) (req *http.Request, err error) {
+	if req, err = http.NewRequest(method, uri, body); err != nil {
+		return
+	}
+	for k, v := range self.HTTP.Header {
+		req.Header[k] = v
+	}
+	return
+}
+
+func isHTTPScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// seeks shorter than this are served from the data already read or read
+// on, instead of making a new request
+const httpSeekWindow = 64 * 1024
+
+// httpReader reads an URL, seeking with Range requests. Servers without
+// range support are read again from the start on long backward seeks.
+type httpReader struct {
+	handlers *Handlers
+	uri      string
+	body     io.ReadCloser
+	bodypos  int64 // position of body
+	pos      int64
+	size     int64 // -1 if unknown
+	// the last bytes read from body, for short backward seeks
+	back []byte
+}
+
+func (self *httpReader) request(pos int64) (err error) {
+	var req *http.Request
+	if req, err = self.handlers.newHTTPRequest("GET", self.uri, nil); err != nil {
+		return
+	}
+	if pos > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", pos))
+	}
+	var resp *http.Response
+	if resp, err = self.handlers.httpClient().Do(req); err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		self.size = resp.ContentLength
+		if pos > 0 {
+			if _, err = io.CopyN(ioutil.Discard, resp.Body, pos); err != nil {
+				resp.Body.Close()
+				return
+			}
+		}
+		self.body = resp.Body
+
+	case http.StatusPartialContent:
+		// Content-Range: bytes 100-199/1000
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				self.size = size
+			}
+		}
+		self.body = resp.Body
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		self.body = ioutil.NopCloser(strings.NewReader(""))
+
+	default:
+		resp.Body.Close()
+		err = fmt.Errorf("avutil: GET %s: %s", self.uri, resp.Status)
+		return
+	}
+	self.bodypos = pos
+	self.pos = pos
+	self.back = nil
+	return
+}
+
+func (self *httpReader) Read(b []byte) (n int, err error) {
+	if self.body == nil {
+		if err = self.request(self.pos); err != nil {
+			return
+		}
+	}
+	if self.pos < self.bodypos {
+		n = copy(b, self.back[len(self.back)-int(self.bodypos-self.pos):])
+		self.pos += int64(n)
+		return
+	}
+	n, err = self.body.Read(b)
+	self.bodypos += int64(n)
+	self.pos = self.bodypos
+	self.back = append(self.back, b[:n]...)
+	if len(self.back) > 2*httpSeekWindow {
+		self.back = append(self.back[:0], self.back[len(self.back)-httpSeekWindow:]...)
+	}
+	return
+}
+
+func (self *httpReader) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case 0:
+		pos = offset
+	case 1:
+		pos = self.pos + offset
+	case 2:
+		if self.size < 0 {
+			err = fmt.Errorf("avutil: seek from end of %s with unknown size", self.uri)
+			return
+		}
+		pos = self.size + offset
+	default:
+		err = fmt.Errorf("avutil: invalid whence %d", whence)
+		return
+	}
+	if pos < 0 {
+		err = fmt.Errorf("avutil: negative seek position %d", pos)
+		return
+	}
+
+	switch {
+	case self.body != nil && pos <= self.bodypos && self.bodypos-pos <= int64(len(self.back)):
+		self.pos = pos
+
+	case self.body != nil && pos > self.bodypos && pos-self.bodypos <= httpSeekWindow:
+		self.pos = self.bodypos
+		if _, err = io.CopyN(ioutil.Discard, self, pos-self.bodypos); err == io.EOF {
+			err = nil
+		}
+
+	default:
+		// the next Read requests from the new position
+		if self.body != nil {
+			self.body.Close()
+			self.body = nil
+		}
+		self.back = nil
+		self.pos = pos
+	}
+	return
+}
+
+func (self *httpReader) Close() (err error) {
+	if self.body != nil {
+		err = self.body.Close()
+		self.body = nil
+	}
+	return
+}
+
+func (self *Handlers) openHTTP(uri string) (r io.ReadCloser, err error) {
+	hr := &httpReader{
+		handlers: self,
+		uri:      uri,
+		size:     -1,
+	}
+	if err = hr.request(0); err != nil {
+		return
+	}
+	r = hr
+	return
+}
+
+// httpWriter streams writes as a chunked request body.
+type httpWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (self *httpWriter) Write(b []byte) (n int, err error) {
+	if n, err = self.pw.Write(b); err != nil {
+		select {
+		case <-self.done:
+			if self.err != nil {
+				err = self.err
+			}
+		default:
+		}
+	}
+	return
+}
+
+// Close ends the request body and waits for the response.
+func (self *httpWriter) Close() (err error) {
+	self.pw.Close()
+	<-self.done
+	return self.err
+}
+
+func (self *Handlers) createHTTP(uri string) (w io.WriteCloser, err error) {
+	method := self.HTTP.Method
+	if method == "" {
+		method = "PUT"
+	}
+	pr, pw := io.Pipe()
+	var req *http.Request
+	if req, err = self.newHTTPRequest(method, uri, pr); err != nil {
+		return
+	}
+	req.ContentLength = -1
+
+	hw := &httpWriter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	client := self.httpClient()
+	go func() {
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("avutil: %s %s: %s", method, uri, resp.Status)
+			}
+		}
+		hw.err = err
+		// fails pending and later writes
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		pr.CloseWithError(err)
+		close(hw.done)
+	}()
+	w = hw
+	return
+}
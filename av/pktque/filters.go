@@ -125,6 +125,10 @@ func (self *AVSync) ModifyPacket(pkt *av.Packet, streams []av.CodecData, videoid
 		}
 	}
 
+	if pkt.IsScriptData {
+		return
+	}
+
 	start, end, correctable, correcttime := self.check(int(pkt.Idx))
 	if pkt.Time >= start && pkt.Time < end {
 		self.time[pkt.Idx] = pkt.Time
@@ -176,7 +180,7 @@ type Walltime struct {
 }
 
 func (self *Walltime) ModifyPacket(pkt *av.Packet, streams []av.CodecData, videoidx int, audioidx int) (drop bool, err error) {
-	if pkt.Idx == 0 {
+	if pkt.Idx == 0 && !pkt.IsScriptData {
 		if self.firsttime.IsZero() {
 			self.firsttime = time.Now()
 		}
@@ -2,10 +2,11 @@
 package pubsub
 
 import (
+	"fmt"
 	"github.com/nareix/joy4/av"
-	"github.com/nareix/joy4/av/pktque"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,28 +20,107 @@ import (
 // oldest          latest
 //
 
+// Returned by QueueCursor.ReadPacket when the cursor lags with the
+// Disconnect policy.
+var ErrSlowSubscriber = fmt.Errorf("pubsub: subscriber too slow")
+
+// What a QueueCursor does when it lags, i.e. when packets it has not read
+// yet were dropped from the buffer or it is more than MaxLag behind.
+type LagPolicy int
+
+const (
+	// continue at the oldest buffered packet
+	SkipToOldest LagPolicy = iota
+	// continue at the latest buffered keyframe
+	SkipToLatestKeyFrame
+	// go from keyframe to keyframe until reaching the latest GOP
+	DropNonKeyFrames
+	// fail with ErrSlowSubscriber
+	Disconnect
+)
+
 // One publisher and multiple subscribers thread-safe packet buffer queue.
+//
+// The buffered packets are kept in an append-only slice of whole GOPs. After
+// every write the queue publishes an immutable snapshot of it, and cursors
+// read snapshots without taking any lock. Dropping old GOPs reslices instead
+// of modifying the packets, so a snapshot stays valid for as long as a
+// cursor holds it.
 type Queue struct {
-	buf                      *pktque.Buf
-	head, tail               int
-	lock                     *sync.RWMutex
-	cond                     *sync.Cond
-	curgopcount, maxgopcount int
-	streams                  []av.CodecData
-	videoidx                 int
-	closed                   bool
+	lock  sync.Mutex
+	state atomic.Value // *queueState
+
+	pkts        []av.Packet
+	head        int64
+	keyframes   []int64
+	maxgopcount int
+	size        int
+	maxsize     int
+	streams     []av.CodecData
+	gens        []int64
+	gen         int64
+	videoidx    int
+	closed      bool
+}
+
+type queueState struct {
+	pkts    []av.Packet
+	head    int64 // position of pkts[0], positions are never reused
+	streams []av.CodecData
+	// changed whenever the codec data of a stream changes
+	gens     []int64
+	videoidx int
+	closed   bool
+	// closed once a newer state is published
+	next chan struct{}
+}
+
+func (self *queueState) tail() int64 {
+	return self.head + int64(len(self.pkts))
 }
 
 func NewQueue() *Queue {
 	q := &Queue{}
-	q.buf = pktque.NewBuf()
 	q.maxgopcount = 2
-	q.lock = &sync.RWMutex{}
-	q.cond = sync.NewCond(q.lock.RLocker())
 	q.videoidx = -1
+	q.state.Store(&queueState{videoidx: -1, next: make(chan struct{})})
 	return q
 }
 
+func (self *Queue) load() *queueState {
+	return self.state.Load().(*queueState)
+}
+
+// publish must be called with lock held.
+func (self *Queue) publish() {
+	old := self.load()
+	self.state.Store(&queueState{
+		pkts:     self.pkts,
+		head:     self.head,
+		streams:  self.streams,
+		gens:     self.gens,
+		videoidx: self.videoidx,
+		closed:   self.closed,
+		next:     make(chan struct{}),
+	})
+	close(old.next)
+}
+
+// drop discards the n oldest packets.
+func (self *Queue) drop(n int) {
+	for _, pkt := range self.pkts[:n] {
+		self.size -= len(pkt.Data)
+	}
+	self.pkts = self.pkts[n:]
+	self.head += int64(n)
+	i := 0
+	for i < len(self.keyframes) && self.keyframes[i] < self.head {
+		i++
+	}
+	self.keyframes = self.keyframes[i:]
+}
+
+// Set the number of GOPs kept in the buffer, 2 by default.
 func (self *Queue) SetMaxGopCount(n int) {
 	self.lock.Lock()
 	self.maxgopcount = n
@@ -48,16 +128,48 @@ func (self *Queue) SetMaxGopCount(n int) {
 	return
 }
 
+// Limit the total packet data size in the buffer, 0 means no limit. Whole
+// GOPs are dropped to stay below it, but the latest GOP is always kept.
+func (self *Queue) SetMaxBufferSize(n int) {
+	self.lock.Lock()
+	self.maxsize = n
+	self.lock.Unlock()
+	return
+}
+
+// trim drops the oldest packets while the buffer is over maxsize.
+func (self *Queue) trim() {
+	for self.maxsize > 0 && self.size > self.maxsize && len(self.pkts) > 1 {
+		switch {
+		case len(self.keyframes) == 0:
+			// audio only, or no keyframe yet
+			self.drop(1)
+		case self.keyframes[0] > self.head:
+			self.drop(int(self.keyframes[0] - self.head))
+		case len(self.keyframes) > 1:
+			self.drop(int(self.keyframes[1] - self.head))
+		default:
+			return
+		}
+	}
+}
+
 func (self *Queue) WriteHeader(streams []av.CodecData) error {
 	self.lock.Lock()
 
 	self.streams = streams
+	self.gens = make([]int64, len(streams))
+	for i := range self.gens {
+		self.gen++
+		self.gens[i] = self.gen
+	}
+	self.videoidx = -1
 	for i, stream := range streams {
 		if stream.Type().IsVideo() {
 			self.videoidx = i
 		}
 	}
-	self.cond.Broadcast()
+	self.publish()
 
 	self.lock.Unlock()
 
@@ -73,43 +185,69 @@ func (self *Queue) Close() (err error) {
 	self.lock.Lock()
 
 	self.closed = true
-	self.cond.Broadcast()
+	self.publish()
 
 	self.lock.Unlock()
 	return
 }
 
 // Put packet into buffer, old packets will be discared.
+//
+// A packet carrying NewCodecData also discards all packets before it, so
+// that new cursors get the new streams from Streams() and never read
+// packets encoded with the old codec data.
 func (self *Queue) WritePacket(pkt av.Packet) (err error) {
 	self.lock.Lock()
 
-	self.buf.Push(pkt)
-	if pkt.Idx == int8(self.videoidx) && pkt.IsKeyFrame {
-		self.curgopcount++
+	if pkt.NewCodecData != nil && !pkt.IsScriptData && int(pkt.Idx) < len(self.streams) {
+		streams := append([]av.CodecData{}, self.streams...)
+		streams[pkt.Idx] = pkt.NewCodecData
+		self.streams = streams
+		gens := append([]int64{}, self.gens...)
+		self.gen++
+		gens[pkt.Idx] = self.gen
+		self.gens = gens
+		self.drop(len(self.pkts))
 	}
 
-	for self.curgopcount >= self.maxgopcount && self.buf.Count > 1 {
-		pkt := self.buf.Pop()
-		if pkt.Idx == int8(self.videoidx) && pkt.IsKeyFrame {
-			self.curgopcount--
+	pos := self.head + int64(len(self.pkts))
+	self.pkts = append(self.pkts, pkt)
+	self.size += len(pkt.Data)
+	if int(pkt.Idx) == self.videoidx && pkt.IsKeyFrame && !pkt.IsScriptData {
+		self.keyframes = append(self.keyframes, pos)
+		maxgopcount := self.maxgopcount
+		if maxgopcount < 1 {
+			maxgopcount = 1
 		}
-		if self.curgopcount < self.maxgopcount {
-			break
+		if n := len(self.keyframes) - maxgopcount; n > 0 {
+			self.drop(int(self.keyframes[n] - self.head))
 		}
 	}
-	//println("shrink", self.curgopcount, self.maxgopcount, self.buf.Head, self.buf.Tail, "count", self.buf.Count, "size", self.buf.Size)
-
-	self.cond.Broadcast()
+	self.trim()
+	self.publish()
 
 	self.lock.Unlock()
 	return
 }
 
 type QueueCursor struct {
-	que    *Queue
-	pos    pktque.BufPos
+	// SkipToOldest by default
+	LagPolicy LagPolicy
+	// the cursor also lags when the packet it would read next is more than
+	// MaxLag older than the latest one, 0 disables the check. Should be
+	// longer than a GOP.
+	MaxLag time.Duration
+	// called from ReadPacket with the number of packets the cursor skipped
+	// because it lagged
+	OnLag func(skipped int)
+
+	que *Queue
+	// codec data versions of the streams the reader knows
+	gens   []int64
+	pos    int64
 	gotpos bool
-	init   func(buf *pktque.Buf, videoidx int) pktque.BufPos
+	init   func(state *queueState) int64
+	err    error
 }
 
 func (self *Queue) newCursor() *QueueCursor {
@@ -121,8 +259,8 @@ func (self *Queue) newCursor() *QueueCursor {
 // Create cursor position at latest packet.
 func (self *Queue) Latest() *QueueCursor {
 	cursor := self.newCursor()
-	cursor.init = func(buf *pktque.Buf, videoidx int) pktque.BufPos {
-		return buf.Tail
+	cursor.init = func(state *queueState) int64 {
+		return state.tail()
 	}
 	return cursor
 }
@@ -130,8 +268,8 @@ func (self *Queue) Latest() *QueueCursor {
 // Create cursor position at oldest buffered packet.
 func (self *Queue) Oldest() *QueueCursor {
 	cursor := self.newCursor()
-	cursor.init = func(buf *pktque.Buf, videoidx int) pktque.BufPos {
-		return buf.Head
+	cursor.init = func(state *queueState) int64 {
+		return state.head
 	}
 	return cursor
 }
@@ -139,12 +277,12 @@ func (self *Queue) Oldest() *QueueCursor {
 // Create cursor position at specific time in buffered packets.
 func (self *Queue) DelayedTime(dur time.Duration) *QueueCursor {
 	cursor := self.newCursor()
-	cursor.init = func(buf *pktque.Buf, videoidx int) pktque.BufPos {
-		i := buf.Tail - 1
-		if buf.IsValidPos(i) {
-			end := buf.Get(i)
-			for buf.IsValidPos(i) {
-				if end.Time-buf.Get(i).Time > dur {
+	cursor.init = func(state *queueState) int64 {
+		i := state.tail() - 1
+		if i >= state.head {
+			end := state.pkts[i-state.head]
+			for i >= state.head {
+				if end.Time-state.pkts[i-state.head].Time > dur {
 					break
 				}
 				i--
@@ -158,12 +296,12 @@ func (self *Queue) DelayedTime(dur time.Duration) *QueueCursor {
 // Create cursor position at specific delayed GOP count in buffered packets.
 func (self *Queue) DelayedGopCount(n int) *QueueCursor {
 	cursor := self.newCursor()
-	cursor.init = func(buf *pktque.Buf, videoidx int) pktque.BufPos {
-		i := buf.Tail - 1
-		if videoidx != -1 {
-			for gop := 0; buf.IsValidPos(i) && gop < n; i-- {
-				pkt := buf.Get(i)
-				if pkt.Idx == int8(self.videoidx) && pkt.IsKeyFrame {
+	cursor.init = func(state *queueState) int64 {
+		i := state.tail() - 1
+		if state.videoidx != -1 {
+			for gop := 0; i >= state.head && gop < n; i-- {
+				pkt := state.pkts[i-state.head]
+				if pkt.Idx == int8(state.videoidx) && pkt.IsKeyFrame {
 					gop++
 				}
 			}
@@ -174,44 +312,136 @@ func (self *Queue) DelayedGopCount(n int) *QueueCursor {
 }
 
 func (self *QueueCursor) Streams() (streams []av.CodecData, err error) {
-	self.que.cond.L.Lock()
-	for self.que.streams == nil && !self.que.closed {
-		self.que.cond.Wait()
+	state := self.que.load()
+	for state.streams == nil && !state.closed {
+		<-state.next
+		state = self.que.load()
 	}
-	if self.que.streams != nil {
-		streams = self.que.streams
+	if state.streams != nil {
+		streams = state.streams
+		self.gens = state.gens
 	} else {
 		err = io.EOF
 	}
-	self.que.cond.L.Unlock()
 	return
 }
 
+func isKeyFrame(pkt av.Packet, videoidx int) bool {
+	if pkt.IsScriptData {
+		return false
+	}
+	return videoidx == -1 || (int(pkt.Idx) == videoidx && pkt.IsKeyFrame)
+}
+
+func (self *QueueCursor) lagging(state *queueState) bool {
+	if self.pos < state.head {
+		return true
+	}
+	if self.MaxLag > 0 && self.pos < state.tail() {
+		latest := state.pkts[len(state.pkts)-1]
+		return latest.Time-state.pkts[self.pos-state.head].Time > self.MaxLag
+	}
+	return false
+}
+
+// handleLag moves the cursor forward according to LagPolicy.
+func (self *QueueCursor) handleLag(state *queueState) (err error) {
+	if self.LagPolicy == Disconnect {
+		self.err = ErrSlowSubscriber
+		return self.err
+	}
+
+	pos := self.pos
+	if pos < state.head {
+		pos = state.head
+	}
+	switch self.LagPolicy {
+	case SkipToLatestKeyFrame:
+		for i := state.tail() - 1; i > pos; i-- {
+			if isKeyFrame(state.pkts[i-state.head], state.videoidx) {
+				pos = i
+				break
+			}
+		}
+	case DropNonKeyFrames:
+		for i := pos; i < state.tail(); i++ {
+			if isKeyFrame(state.pkts[i-state.head], state.videoidx) {
+				pos = i
+				break
+			}
+		}
+	}
+
+	if skipped := int(pos - self.pos); skipped > 0 {
+		self.pos = pos
+		if self.OnLag != nil {
+			self.OnLag(skipped)
+		}
+	}
+	return
+}
+
+// checkCodecData sets NewCodecData on pkt if the reader has not been told
+// about the codec data of its stream yet, e.g. the packet carrying the
+// change was skipped or dropped before the cursor got to it, and clears it
+// if the reader already knows it. All buffered
+// packets use the latest codec data, as a change drops the packets before
+// it.
+func (self *QueueCursor) checkCodecData(state *queueState, pkt *av.Packet) {
+	if len(self.gens) != len(state.gens) {
+		self.gens = state.gens
+		return
+	}
+	i := int(pkt.Idx)
+	if pkt.IsScriptData || i >= len(state.gens) {
+		return
+	}
+	if self.gens[i] == state.gens[i] {
+		// e.g. a new cursor got it from Streams()
+		pkt.NewCodecData = nil
+		return
+	}
+	if pkt.NewCodecData == nil {
+		pkt.NewCodecData = state.streams[i]
+	}
+	gens := append([]int64{}, self.gens...)
+	gens[i] = state.gens[i]
+	self.gens = gens
+}
+
 // ReadPacket will not consume packets in Queue, it's just a cursor.
 func (self *QueueCursor) ReadPacket() (pkt av.Packet, err error) {
-	self.que.cond.L.Lock()
-	buf := self.que.buf
+	if self.err != nil {
+		err = self.err
+		return
+	}
+	state := self.que.load()
 	if !self.gotpos {
-		self.pos = self.init(buf, self.que.videoidx)
+		if self.pos = self.init(state); self.pos < state.head {
+			self.pos = state.head
+		}
 		self.gotpos = true
 	}
 	for {
-		if self.pos.LT(buf.Head) {
-			self.pos = buf.Head
-		} else if self.pos.GT(buf.Tail) {
-			self.pos = buf.Tail
+		if self.pos > state.tail() {
+			self.pos = state.tail()
 		}
-		if buf.IsValidPos(self.pos) {
-			pkt = buf.Get(self.pos)
+		if self.lagging(state) {
+			if err = self.handleLag(state); err != nil {
+				return
+			}
+		}
+		if self.pos < state.tail() {
+			pkt = state.pkts[self.pos-state.head]
 			self.pos++
-			break
+			self.checkCodecData(state, &pkt)
+			return
 		}
-		if self.que.closed {
+		if state.closed {
 			err = io.EOF
-			break
+			return
 		}
-		self.que.cond.Wait()
+		<-state.next
+		state = self.que.load()
 	}
-	self.que.cond.L.Unlock()
-	return
 }
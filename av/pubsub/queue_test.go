@@ -0,0 +1,306 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/fake"
+)
+
+// benchmarkQueue writes b.N packets, 25 fps with a keyframe every 50, while
+// subscribers read them through their own cursors. All GOPs are kept so no
+// subscriber skips packets, ns/op is the time to deliver a packet to all of
+// them.
+func benchmarkQueue(b *testing.B, subscribers int) {
+	que := NewQueue()
+	que.SetMaxGopCount(b.N/50 + 1)
+	que.WriteHeader([]av.CodecData{
+		fake.CodecData{CodecType_: av.H264},
+		fake.CodecData{CodecType_: av.AAC, SampleRate_: 44100, SampleFormat_: av.FLTP, ChannelLayout_: av.CH_STEREO},
+	})
+
+	var reads int64
+	var wg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		cursor := que.Oldest()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := int64(0)
+			for {
+				if _, err := cursor.ReadPacket(); err != nil {
+					break
+				}
+				n++
+			}
+			atomic.AddInt64(&reads, n)
+		}()
+	}
+
+	data := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		que.WritePacket(av.Packet{
+			Idx:        0,
+			IsKeyFrame: i%50 == 0,
+			Time:       time.Duration(i) * time.Second / 25,
+			Data:       data,
+		})
+	}
+	que.Close()
+	wg.Wait()
+	b.StopTimer()
+
+	if reads != int64(b.N)*int64(subscribers) {
+		b.Fatalf("read %d packets, want %d", reads, int64(b.N)*int64(subscribers))
+	}
+}
+
+func BenchmarkQueue1(b *testing.B) {
+	benchmarkQueue(b, 1)
+}
+
+func BenchmarkQueue100(b *testing.B) {
+	benchmarkQueue(b, 100)
+}
+
+func BenchmarkQueue1000(b *testing.B) {
+	benchmarkQueue(b, 1000)
+}
+
+var (
+	testVideo  = fake.CodecData{CodecType_: av.H264}
+	testVideo2 = fake.CodecData{CodecType_: av.H265}
+	testAudio  = fake.CodecData{CodecType_: av.AAC, SampleRate_: 44100, SampleFormat_: av.FLTP, ChannelLayout_: av.CH_STEREO}
+	testAudio2 = fake.CodecData{CodecType_: av.AAC, SampleRate_: 48000, SampleFormat_: av.FLTP, ChannelLayout_: av.CH_STEREO}
+)
+
+func newTestQueue() *Queue {
+	que := NewQueue()
+	que.WriteHeader([]av.CodecData{testVideo, testAudio})
+	return que
+}
+
+// writeVideo writes video packets n to n+count-1, 100ms apart with a
+// keyframe every 5 and 100 bytes each.
+func writeVideo(que *Queue, n int, count int) {
+	for i := n; i < n+count; i++ {
+		que.WritePacket(av.Packet{
+			Idx:        0,
+			IsKeyFrame: i%5 == 0,
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			Data:       make([]byte, 100),
+		})
+	}
+}
+
+func packetNum(pkt av.Packet) int {
+	return int(pkt.Time / (100 * time.Millisecond))
+}
+
+func readNums(t *testing.T, cursor *QueueCursor, count int) (nums []int) {
+	for i := 0; i < count; i++ {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nums = append(nums, packetNum(pkt))
+	}
+	return
+}
+
+func checkNums(t *testing.T, got []int, want ...int) {
+	if len(got) != len(want) {
+		t.Fatalf("read %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("read %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLagPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy  LagPolicy
+		next    int
+		skipped int
+	}{
+		{SkipToOldest, 40, 39},
+		{SkipToLatestKeyFrame, 45, 44},
+	} {
+		que := newTestQueue()
+		writeVideo(que, 0, 5)
+		cursor := que.Oldest()
+		cursor.LagPolicy = test.policy
+		skipped := 0
+		cursor.OnLag = func(n int) { skipped += n }
+		checkNums(t, readNums(t, cursor, 1), 0)
+
+		// only the GOPs starting at 40 and 45 are kept
+		writeVideo(que, 5, 45)
+		checkNums(t, readNums(t, cursor, 2), test.next, test.next+1)
+		if skipped != test.skipped {
+			t.Fatalf("policy=%d skipped=%d, want %d", test.policy, skipped, test.skipped)
+		}
+	}
+}
+
+func TestDropNonKeyFrames(t *testing.T) {
+	que := newTestQueue()
+	que.SetMaxGopCount(100)
+	writeVideo(que, 0, 50)
+	cursor := que.Oldest()
+	cursor.LagPolicy = DropNonKeyFrames
+	cursor.MaxLag = time.Second
+
+	// keyframes only until within 1s of packet 49
+	checkNums(t, readNums(t, cursor, 17),
+		0, 5, 10, 15, 20, 25, 30, 35, 40, 41, 42, 43, 44, 45, 46, 47, 48)
+}
+
+func TestMaxLag(t *testing.T) {
+	que := newTestQueue()
+	que.SetMaxGopCount(100)
+	writeVideo(que, 0, 50)
+
+	cursor := que.Oldest()
+	cursor.LagPolicy = SkipToLatestKeyFrame
+	cursor.MaxLag = time.Second
+	checkNums(t, readNums(t, cursor, 2), 45, 46)
+
+	// not lagging without MaxLag, all GOPs are buffered
+	cursor = que.Oldest()
+	cursor.LagPolicy = SkipToLatestKeyFrame
+	checkNums(t, readNums(t, cursor, 2), 0, 1)
+}
+
+func TestDisconnect(t *testing.T) {
+	que := newTestQueue()
+	writeVideo(que, 0, 5)
+	cursor := que.Oldest()
+	cursor.LagPolicy = Disconnect
+	checkNums(t, readNums(t, cursor, 1), 0)
+
+	writeVideo(que, 5, 45)
+	for i := 0; i < 2; i++ {
+		if _, err := cursor.ReadPacket(); err != ErrSlowSubscriber {
+			t.Fatalf("err=%v", err)
+		}
+	}
+}
+
+func TestSetMaxBufferSize(t *testing.T) {
+	que := newTestQueue()
+	que.SetMaxGopCount(100)
+	que.SetMaxBufferSize(1000)
+	writeVideo(que, 0, 50)
+	// two GOPs of 500 bytes
+	checkNums(t, readNums(t, que.Oldest(), 1), 40)
+
+	// the latest GOP is kept even if over the limit
+	que.SetMaxBufferSize(300)
+	writeVideo(que, 50, 3)
+	checkNums(t, readNums(t, que.Oldest(), 1), 50)
+}
+
+func TestCodecDataChange(t *testing.T) {
+	que := newTestQueue()
+	que.SetMaxGopCount(100)
+	writeVideo(que, 0, 5)
+	cursor := que.Oldest()
+	streams, _ := cursor.Streams()
+	if streams[0] != testVideo {
+		t.Fatalf("streams=%v", streams)
+	}
+	readNums(t, cursor, 5)
+
+	que.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: 500 * time.Millisecond, NewCodecData: testVideo2})
+	writeVideo(que, 6, 4)
+	pkt, _ := cursor.ReadPacket()
+	if pkt.NewCodecData != testVideo2 {
+		t.Fatalf("NewCodecData=%v", pkt.NewCodecData)
+	}
+	// signaled once
+	pkt, _ = cursor.ReadPacket()
+	if pkt.NewCodecData != nil {
+		t.Fatalf("NewCodecData=%v", pkt.NewCodecData)
+	}
+
+	// new cursors get the new streams and no NewCodecData
+	cursor = que.Oldest()
+	if streams, _ = cursor.Streams(); streams[0] != testVideo2 {
+		t.Fatalf("streams=%v", streams)
+	}
+	if pkt, _ = cursor.ReadPacket(); pkt.NewCodecData != nil {
+		t.Fatalf("NewCodecData=%v", pkt.NewCodecData)
+	}
+}
+
+// A cursor that skips past the packet carrying NewCodecData still gets it,
+// on the next packet of the changed stream.
+func TestCodecDataChangeSkipped(t *testing.T) {
+	for _, policy := range []LagPolicy{SkipToOldest, SkipToLatestKeyFrame} {
+		que := newTestQueue()
+		que.SetMaxGopCount(100)
+		writeVideo(que, 0, 5)
+		cursor := que.Oldest()
+		cursor.LagPolicy = policy
+		cursor.MaxLag = time.Second
+		cursor.Streams()
+		readNums(t, cursor, 1)
+
+		que.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: 500 * time.Millisecond, NewCodecData: testVideo2})
+		if policy == SkipToOldest {
+			// drops the GOP carrying the change
+			que.SetMaxGopCount(2)
+		}
+		writeVideo(que, 6, 44)
+
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packetNum(pkt) == 5 {
+			t.Fatalf("policy=%d did not skip", policy)
+		}
+		if pkt.NewCodecData != testVideo2 {
+			t.Fatalf("policy=%d packet#%d NewCodecData=%v", policy, packetNum(pkt), pkt.NewCodecData)
+		}
+	}
+}
+
+func TestAudioCodecDataChangeSkipped(t *testing.T) {
+	que := newTestQueue()
+	que.SetMaxGopCount(100)
+	writeVideo(que, 0, 5)
+	cursor := que.Oldest()
+	cursor.LagPolicy = DropNonKeyFrames
+	cursor.MaxLag = time.Second
+	cursor.Streams()
+	readNums(t, cursor, 1)
+
+	que.WritePacket(av.Packet{Idx: 1, Time: 500 * time.Millisecond, NewCodecData: testAudio2})
+	writeVideo(que, 5, 20)
+	que.WritePacket(av.Packet{Idx: 1, Time: 2500 * time.Millisecond})
+
+	// skips the change to keyframe 5
+	var got av.CodecData
+	for i := 0; i < 20; i++ {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Idx == 1 {
+			got = pkt.NewCodecData
+			break
+		}
+	}
+	if got != testAudio2 {
+		t.Fatalf("NewCodecData=%v", got)
+	}
+}
@@ -112,6 +112,10 @@ func (self *tStream) audioDecodeAndEncode(inpkt av.Packet) (outpkts []av.Packet,
 // In audio transcoding one Packet may transcode into many Packets
 // packet time will be adjusted automatically.
 func (self *Transcoder) Do(pkt av.Packet) (out []av.Packet, err error) {
+	if pkt.IsScriptData {
+		out = append(out, pkt)
+		return
+	}
 	stream := self.streams[pkt.Idx]
 	if stream.aenc != nil && stream.adec != nil {
 		if out, err = stream.audioDecodeAndEncode(pkt); err != nil {
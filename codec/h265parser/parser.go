@@ -0,0 +1,490 @@
+// Package h265parser parses HEVC parameter sets and HEVCDecoderConfigurationRecord.
+package h265parser
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/utils/bits"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	NALU_TRAIL_N    = 0
+	NALU_BLA_W_LP   = 16
+	NALU_IDR_W_RADL = 19
+	NALU_IDR_N_LP   = 20
+	NALU_CRA        = 21
+	NALU_VPS        = 32
+	NALU_SPS        = 33
+	NALU_PPS        = 34
+	NALU_AUD        = 35
+	NALU_SEI_PREFIX = 39
+	NALU_SEI_SUFFIX = 40
+)
+
+// Annex B and length prefixed framing is the same as H.264.
+const (
+	NALU_RAW    = h264parser.NALU_RAW
+	NALU_AVCC   = h264parser.NALU_AVCC
+	NALU_ANNEXB = h264parser.NALU_ANNEXB
+)
+
+var StartCodeBytes = []byte{0, 0, 1}
+var AUDBytes = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50, 0, 0, 0, 1} // AUD
+
+func NALUType(b []byte) int {
+	return int(b[0]>>1) & 0x3f
+}
+
+// IsDataNALU reports whether b is a VCL NAL unit.
+func IsDataNALU(b []byte) bool {
+	return NALUType(b) < 32
+}
+
+// IsKeyFrameNALU reports whether b is an IRAP (BLA, IDR or CRA) picture.
+func IsKeyFrameNALU(b []byte) bool {
+	typ := NALUType(b)
+	return typ >= NALU_BLA_W_LP && typ <= 23
+}
+
+func SplitNALUs(b []byte) (nalus [][]byte, typ int) {
+	return h264parser.SplitNALUs(b)
+}
+
+func CheckNALUsType(b []byte) (typ int) {
+	_, typ = SplitNALUs(b)
+	return
+}
+
+// RBSP strips the emulation prevention bytes (00 00 03) from a NAL unit.
+func RBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+type ProfileTierLevel struct {
+	GeneralProfileSpace              uint8
+	GeneralTierFlag                  uint8
+	GeneralProfileIdc                uint8
+	GeneralProfileCompatibilityFlags uint32
+	GeneralConstraintIndicatorFlags  uint64
+	GeneralLevelIdc                  uint8
+}
+
+type SPSInfo struct {
+	ProfileTierLevel
+
+	MaxSubLayersMinus1   uint
+	TemporalIdNested     uint
+	ChromaFormatIdc      uint
+	BitDepthLumaMinus8   uint
+	BitDepthChromaMinus8 uint
+
+	PicWidthInLumaSamples  uint
+	PicHeightInLumaSamples uint
+
+	CropLeft   uint
+	CropRight  uint
+	CropTop    uint
+	CropBottom uint
+
+	Width  uint
+	Height uint
+}
+
+func parseProfileTierLevel(r *bits.GolombBitReader, maxSubLayersMinus1 uint) (self ProfileTierLevel, err error) {
+	var u uint
+	if u, err = r.ReadBits(2); err != nil {
+		return
+	}
+	self.GeneralProfileSpace = uint8(u)
+	if u, err = r.ReadBit(); err != nil {
+		return
+	}
+	self.GeneralTierFlag = uint8(u)
+	if u, err = r.ReadBits(5); err != nil {
+		return
+	}
+	self.GeneralProfileIdc = uint8(u)
+	if u, err = r.ReadBits(32); err != nil {
+		return
+	}
+	self.GeneralProfileCompatibilityFlags = uint32(u)
+	// progressive_source_flag ... general_inbld_flag, reserved
+	var hi, lo uint
+	if hi, err = r.ReadBits(16); err != nil {
+		return
+	}
+	if lo, err = r.ReadBits(32); err != nil {
+		return
+	}
+	self.GeneralConstraintIndicatorFlags = uint64(hi)<<32 | uint64(lo)
+	if u, err = r.ReadBits(8); err != nil {
+		return
+	}
+	self.GeneralLevelIdc = uint8(u)
+
+	var profilePresent, levelPresent [8]uint
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+		if levelPresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			// reserved_zero_2bits
+			if _, err = r.ReadBits(2); err != nil {
+				return
+			}
+		}
+	}
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] != 0 {
+			// sub_layer profile_space ... sub_layer_inbld_flag
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if _, err = r.ReadBits(24); err != nil {
+				return
+			}
+		}
+		if levelPresent[i] != 0 {
+			if _, err = r.ReadBits(8); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func ParseSPS(data []byte) (self SPSInfo, err error) {
+	if len(data) < 2 {
+		err = fmt.Errorf("h265parser: SPS too short")
+		return
+	}
+	// skip nal_unit_header
+	r := &bits.GolombBitReader{R: bytes.NewReader(RBSP(data[2:]))}
+
+	// sps_video_parameter_set_id
+	if _, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if self.MaxSubLayersMinus1, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if self.TemporalIdNested, err = r.ReadBit(); err != nil {
+		return
+	}
+	if self.ProfileTierLevel, err = parseProfileTierLevel(r, self.MaxSubLayersMinus1); err != nil {
+		return
+	}
+
+	// sps_seq_parameter_set_id
+	if _, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.ChromaFormatIdc, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.ChromaFormatIdc == 3 {
+		// separate_colour_plane_flag
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if self.PicWidthInLumaSamples, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.PicHeightInLumaSamples, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+
+	var conformance_window_flag uint
+	if conformance_window_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if conformance_window_flag != 0 {
+		if self.CropLeft, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if self.CropRight, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if self.CropTop, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if self.CropBottom, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+	}
+
+	if self.BitDepthLumaMinus8, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.BitDepthChromaMinus8, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+
+	subWidthC, subHeightC := uint(1), uint(1)
+	switch self.ChromaFormatIdc {
+	case 1:
+		subWidthC, subHeightC = 2, 2
+	case 2:
+		subWidthC = 2
+	}
+	self.Width = self.PicWidthInLumaSamples - subWidthC*(self.CropLeft+self.CropRight)
+	self.Height = self.PicHeightInLumaSamples - subHeightC*(self.CropTop+self.CropBottom)
+
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo HEVCDecoderConfRecord
+	SPSInfo    SPSInfo
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.H265
+}
+
+func (self CodecData) HEVCDecoderConfRecordBytes() []byte {
+	return self.Record
+}
+
+func (self CodecData) VPS() []byte {
+	return self.RecordInfo.VPS[0]
+}
+
+func (self CodecData) SPS() []byte {
+	return self.RecordInfo.SPS[0]
+}
+
+func (self CodecData) PPS() []byte {
+	return self.RecordInfo.PPS[0]
+}
+
+func (self CodecData) Width() int {
+	return int(self.SPSInfo.Width)
+}
+
+func (self CodecData) Height() int {
+	return int(self.SPSInfo.Height)
+}
+
+func (self CodecData) ProfileIdc() int {
+	return int(self.SPSInfo.GeneralProfileIdc)
+}
+
+func (self CodecData) LevelIdc() int {
+	return int(self.SPSInfo.GeneralLevelIdc)
+}
+
+func NewCodecDataFromHEVCDecoderConfRecord(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+	if len(self.RecordInfo.VPS) == 0 {
+		err = fmt.Errorf("h265parser: no VPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if len(self.RecordInfo.SPS) == 0 {
+		err = fmt.Errorf("h265parser: no SPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if len(self.RecordInfo.PPS) == 0 {
+		err = fmt.Errorf("h265parser: no PPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if self.SPSInfo, err = ParseSPS(self.RecordInfo.SPS[0]); err != nil {
+		err = fmt.Errorf("h265parser: parse SPS failed(%s)", err)
+		return
+	}
+	return
+}
+
+func NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps []byte) (self CodecData, err error) {
+	if self.SPSInfo, err = ParseSPS(sps); err != nil {
+		return
+	}
+
+	info := self.SPSInfo
+	recordinfo := HEVCDecoderConfRecord{}
+	recordinfo.ProfileTierLevel = info.ProfileTierLevel
+	recordinfo.ChromaFormat = uint8(info.ChromaFormatIdc)
+	recordinfo.BitDepthLumaMinus8 = uint8(info.BitDepthLumaMinus8)
+	recordinfo.BitDepthChromaMinus8 = uint8(info.BitDepthChromaMinus8)
+	recordinfo.NumTemporalLayers = uint8(info.MaxSubLayersMinus1 + 1)
+	recordinfo.TemporalIdNested = uint8(info.TemporalIdNested)
+	recordinfo.LengthSizeMinusOne = 3
+	recordinfo.VPS = [][]byte{vps}
+	recordinfo.SPS = [][]byte{sps}
+	recordinfo.PPS = [][]byte{pps}
+
+	buf := make([]byte, recordinfo.Len())
+	recordinfo.Marshal(buf)
+
+	self.RecordInfo = recordinfo
+	self.Record = buf
+	return
+}
+
+type HEVCDecoderConfRecord struct {
+	ProfileTierLevel
+	MinSpatialSegmentationIdc uint16
+	ParallelismType           uint8
+	ChromaFormat              uint8
+	BitDepthLumaMinus8        uint8
+	BitDepthChromaMinus8      uint8
+	AvgFrameRate              uint16
+	ConstantFrameRate         uint8
+	NumTemporalLayers         uint8
+	TemporalIdNested          uint8
+	LengthSizeMinusOne        uint8
+	VPS                       [][]byte
+	SPS                       [][]byte
+	PPS                       [][]byte
+}
+
+var ErrDecconfInvalid = fmt.Errorf("h265parser: HEVCDecoderConfRecord invalid")
+
+const hevcDecoderConfRecordHeaderLength = 23
+
+func (self *HEVCDecoderConfRecord) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < hevcDecoderConfRecordHeaderLength {
+		err = ErrDecconfInvalid
+		return
+	}
+
+	self.GeneralProfileSpace = b[1] >> 6
+	self.GeneralTierFlag = (b[1] >> 5) & 0x1
+	self.GeneralProfileIdc = b[1] & 0x1f
+	self.GeneralProfileCompatibilityFlags = pio.U32BE(b[2:])
+	self.GeneralConstraintIndicatorFlags = uint64(pio.U32BE(b[6:]))<<16 | uint64(pio.U16BE(b[10:]))
+	self.GeneralLevelIdc = b[12]
+	self.MinSpatialSegmentationIdc = pio.U16BE(b[13:]) & 0xfff
+	self.ParallelismType = b[15] & 0x3
+	self.ChromaFormat = b[16] & 0x3
+	self.BitDepthLumaMinus8 = b[17] & 0x7
+	self.BitDepthChromaMinus8 = b[18] & 0x7
+	self.AvgFrameRate = pio.U16BE(b[19:])
+	self.ConstantFrameRate = b[21] >> 6
+	self.NumTemporalLayers = (b[21] >> 3) & 0x7
+	self.TemporalIdNested = (b[21] >> 2) & 0x1
+	self.LengthSizeMinusOne = b[21] & 0x3
+	numOfArrays := int(b[22])
+	n += hevcDecoderConfRecordHeaderLength
+
+	for i := 0; i < numOfArrays; i++ {
+		if len(b) < n+3 {
+			err = ErrDecconfInvalid
+			return
+		}
+		naluType := int(b[n] & 0x3f)
+		numNalus := int(pio.U16BE(b[n+1:]))
+		n += 3
+
+		for j := 0; j < numNalus; j++ {
+			if len(b) < n+2 {
+				err = ErrDecconfInvalid
+				return
+			}
+			nalulen := int(pio.U16BE(b[n:]))
+			n += 2
+			if len(b) < n+nalulen {
+				err = ErrDecconfInvalid
+				return
+			}
+			nalu := b[n : n+nalulen]
+			n += nalulen
+
+			switch naluType {
+			case NALU_VPS:
+				self.VPS = append(self.VPS, nalu)
+			case NALU_SPS:
+				self.SPS = append(self.SPS, nalu)
+			case NALU_PPS:
+				self.PPS = append(self.PPS, nalu)
+			}
+		}
+	}
+
+	return
+}
+
+func (self HEVCDecoderConfRecord) Len() (n int) {
+	n = hevcDecoderConfRecordHeaderLength
+	for _, array := range [][][]byte{self.VPS, self.SPS, self.PPS} {
+		if len(array) == 0 {
+			continue
+		}
+		n += 3
+		for _, nalu := range array {
+			n += 2 + len(nalu)
+		}
+	}
+	return
+}
+
+func (self HEVCDecoderConfRecord) Marshal(b []byte) (n int) {
+	b[0] = 1
+	b[1] = self.GeneralProfileSpace<<6 | self.GeneralTierFlag<<5 | self.GeneralProfileIdc
+	pio.PutU32BE(b[2:], self.GeneralProfileCompatibilityFlags)
+	pio.PutU32BE(b[6:], uint32(self.GeneralConstraintIndicatorFlags>>16))
+	pio.PutU16BE(b[10:], uint16(self.GeneralConstraintIndicatorFlags))
+	b[12] = self.GeneralLevelIdc
+	pio.PutU16BE(b[13:], 0xf000|self.MinSpatialSegmentationIdc)
+	b[15] = 0xfc | self.ParallelismType
+	b[16] = 0xfc | self.ChromaFormat
+	b[17] = 0xf8 | self.BitDepthLumaMinus8
+	b[18] = 0xf8 | self.BitDepthChromaMinus8
+	pio.PutU16BE(b[19:], self.AvgFrameRate)
+	b[21] = self.ConstantFrameRate<<6 | self.NumTemporalLayers<<3 | self.TemporalIdNested<<2 | self.LengthSizeMinusOne
+	n += 22
+
+	numOfArraysPos := n
+	n++
+	numOfArrays := 0
+	for i, array := range [][][]byte{self.VPS, self.SPS, self.PPS} {
+		if len(array) == 0 {
+			continue
+		}
+		numOfArrays++
+		// array_completeness = 1
+		b[n] = 0x80 | uint8(NALU_VPS+i)
+		pio.PutU16BE(b[n+1:], uint16(len(array)))
+		n += 3
+		for _, nalu := range array {
+			pio.PutU16BE(b[n:], uint16(len(nalu)))
+			n += 2
+			copy(b[n:], nalu)
+			n += len(nalu)
+		}
+	}
+	b[numOfArraysPos] = uint8(numOfArrays)
+
+	return
+}
@@ -0,0 +1,45 @@
+package h265parser
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCodecData(t *testing.T) {
+	vps, _ := hex.DecodeString("40010c01ffff016000000300900000030000030078959809")
+	sps, _ := hex.DecodeString("420101016000000300900000030000030078a003c08010e58d96574324c05a140e0420")
+	pps, _ := hex.DecodeString("4401c172b46240")
+
+	codec, err := NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.Width() != 1920 || codec.Height() != 1080 {
+		t.Fatalf("size=%dx%d", codec.Width(), codec.Height())
+	}
+	if codec.ProfileIdc() != 1 {
+		t.Fatalf("profile=%d", codec.ProfileIdc())
+	}
+
+	codec2, err := NewCodecDataFromHEVCDecoderConfRecord(codec.Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec2.Width() != 1920 || codec2.LevelIdc() != codec.LevelIdc() {
+		t.Fatalf("record roundtrip mismatch")
+	}
+	if hex.EncodeToString(codec2.PPS()) != hex.EncodeToString(pps) {
+		t.Fatalf("pps mismatch")
+	}
+}
+
+func TestSplitNALUs(t *testing.T) {
+	frame, _ := hex.DecodeString("0000000140010c01000000014201010000012601af")
+	nalus, typ := SplitNALUs(frame)
+	if typ != NALU_ANNEXB || len(nalus) != 3 {
+		t.Fatalf("typ=%d n=%d", typ, len(nalus))
+	}
+	if NALUType(nalus[0]) != NALU_VPS || !IsKeyFrameNALU(nalus[2]) {
+		t.Fatalf("nalu type mismatch")
+	}
+}
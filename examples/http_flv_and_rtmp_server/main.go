@@ -1,111 +1,63 @@
 package main
 
 import (
-	"fmt"
-	"io"
 	"net/http"
-	"sync"
+	"strings"
+	"time"
 
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/avutil"
 	"github.com/nareix/joy4/av/pubsub"
 	"github.com/nareix/joy4/format"
-	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/hls"
+	"github.com/nareix/joy4/format/router"
 	"github.com/nareix/joy4/format/rtmp"
+	"github.com/nareix/joy4/format/rtsp"
 )
 
 func init() {
 	format.RegisterAll()
 }
 
-type writeFlusher struct {
-	httpflusher http.Flusher
-	io.Writer
-}
-
-func (self writeFlusher) Flush() error {
-	self.httpflusher.Flush()
-	return nil
-}
-
 func main() {
 	server := &rtmp.Server{}
-
-	l := &sync.RWMutex{}
-	type Channel struct {
-		// One publisher and multiple subscribers thread-safe packet buffer queue.
-		que *pubsub.Queue
-	}
-	channels := map[string]*Channel{}
-	fmt.Println(channels)
-	for k, v := range channels {
-		fmt.Println(k, v)
+	r := router.New()
+	// a viewer on a slow link jumps ahead instead of playing stale video
+	r.LagPolicy = pubsub.SkipToLatestKeyFrame
+	r.MaxLag = time.Second * 10
+
+	r.OnPublish = func(stream *router.Stream, src av.Demuxer) {
+		hlsmuxer := hls.NewMuxer()
+		go avutil.CopyFile(hlsmuxer, stream.Queue.Oldest())
+		stream.Data = hlsmuxer
 	}
 
-	server.HandlePlay = func(conn *rtmp.Conn) {
-		l.RLock()
-		ch := channels[conn.URL.Path]
-		l.RUnlock()
-		fmt.Printf("ch : %v", ch)
-		// for k, v := range ch {
-		// 	fmt.Println(k, v)
-		// 	}
+	server.HandlePlay = r.HandlePlay
+	server.HandlePublish = r.HandlePublish
 
-		if ch != nil {
-			cursor := ch.que.Latest()
-			avutil.CopyFile(conn, cursor)
-		}
+	rtspserver := &rtsp.Server{}
+	rtspserver.HandlePlay = func(conn *rtsp.Conn) {
+		r.Play(conn.URL.Path, conn)
 	}
 
-	server.HandlePublish = func(conn *rtmp.Conn) {
-		streams, _ := conn.Streams()
-
-		l.Lock()
-		ch := channels[conn.URL.Path]
-		fmt.Println("HandlePublish :", ch)
-		if ch == nil {
-			ch = &Channel{}
-			ch.que = pubsub.NewQueue()
-			ch.que.WriteHeader(streams)
-			channels[conn.URL.Path] = ch
-		} else {
-			ch = nil
+	http.HandleFunc("/hls/", func(w http.ResponseWriter, req *http.Request) {
+		// /hls/movie/index.m3u8 -> channel /movie
+		p := strings.TrimPrefix(req.URL.Path, "/hls")
+		if i := strings.LastIndex(p, "/"); i > 0 {
+			p = p[:i]
 		}
-		l.Unlock()
-		if ch == nil {
-			return
-		}
-
-		avutil.CopyPackets(ch.que, conn)
-
-		l.Lock()
-		delete(channels, conn.URL.Path)
-		l.Unlock()
-		ch.que.Close()
-	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		l.RLock()
-		ch := channels[r.URL.Path]
-		l.RUnlock()
-
-		if ch != nil {
-			w.Header().Set("Content-Type", "video/x-flv")
-			w.Header().Set("Transfer-Encoding", "chunked")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.WriteHeader(200)
-			flusher := w.(http.Flusher)
-			flusher.Flush()
-
-			muxer := flv.NewMuxerWriteFlusher(writeFlusher{httpflusher: flusher, Writer: w})
-			cursor := ch.que.Latest()
-
-			avutil.CopyFile(muxer, cursor)
+		if stream := r.Get(p); stream != nil {
+			stream.Data.(*hls.Muxer).ServeHTTP(w, req)
 		} else {
-			http.NotFound(w, r)
+			http.NotFound(w, req)
 		}
 	})
 
+	http.Handle("/", r)
+
 	go http.ListenAndServe(":8089", nil)
+	go rtspserver.ListenAndServe()
 
 	server.ListenAndServe()
 
@@ -113,4 +65,7 @@ func main() {
 	// ffmpeg -f avfoundation -i "0:0" .... -f flv rtmp://localhost/screen
 	// ffplay http://localhost:8089/movie
 	// ffplay http://localhost:8089/screen
+	// flv.js: ws://localhost:8089/movie.flv
+	// ffplay http://localhost:8089/hls/movie/index.m3u8
+	// ffplay rtsp://localhost/movie
 }
@@ -2,14 +2,13 @@ package main
 
 import (
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/avutil"
 	"github.com/nareix/joy4/av/pktque"
-	"github.com/nareix/joy4/av/pubsub"
 	"github.com/nareix/joy4/format"
+	"github.com/nareix/joy4/format/router"
 	"github.com/nareix/joy4/format/rtmp"
 )
 
@@ -75,94 +74,71 @@ func (self *FrameDropper) ModifyPacket(pkt *av.Packet, streams []av.CodecData, v
 
 func main() {
 	server := &rtmp.Server{}
-
-	l := &sync.RWMutex{}
-	type Channel struct {
-		que *pubsub.Queue
+	r := router.New()
+
+	r.OnPublish = func(stream *router.Stream, src av.Demuxer) {
+		conn := src.(*rtmp.Conn)
+		if q := conn.URL.Query().Get("cachegop"); q != "" {
+			var n int
+			fmt.Sscanf(q, "%d", &n)
+			stream.Queue.SetMaxGopCount(n)
+		}
 	}
-	channels := map[string]*Channel{}
 
 	server.HandlePlay = func(conn *rtmp.Conn) {
-		l.RLock()
-		ch := channels[conn.URL.Path]
-		l.RUnlock()
+		stream, err := r.Subscribe(conn.URL.Path)
+		if err != nil {
+			return
+		}
+		defer r.Unsubscribe(stream)
+
+		cursor := stream.Queue.Latest()
+		query := conn.URL.Query()
+
+		if q := query.Get("delaygop"); q != "" {
+			n := 0
+			fmt.Sscanf(q, "%d", &n)
+			cursor = stream.Queue.DelayedGopCount(n)
+		} else if q := query.Get("delaytime"); q != "" {
+			dur, _ := time.ParseDuration(q)
+			cursor = stream.Queue.DelayedTime(dur)
+		}
 
-		if ch != nil {
-			cursor := ch.que.Latest()
-			query := conn.URL.Query()
+		filters := pktque.Filters{}
 
-			if q := query.Get("delaygop"); q != "" {
-				n := 0
-				fmt.Sscanf(q, "%d", &n)
-				cursor = ch.que.DelayedGopCount(n)
-			} else if q := query.Get("delaytime"); q != "" {
-				dur, _ := time.ParseDuration(q)
-				cursor = ch.que.DelayedTime(dur)
-			}
-
-			filters := pktque.Filters{}
+		if q := query.Get("waitkey"); q != "" {
+			filters = append(filters, &pktque.WaitKeyFrame{})
+		}
 
-			if q := query.Get("waitkey"); q != "" {
-				filters = append(filters, &pktque.WaitKeyFrame{})
-			}
+		filters = append(filters, &pktque.FixTime{StartFromZero: true, MakeIncrement: true})
 
-			filters = append(filters, &pktque.FixTime{StartFromZero: true, MakeIncrement: true})
+		if q := query.Get("framedrop"); q != "" {
+			n := 0
+			fmt.Sscanf(q, "%d", &n)
+			filters = append(filters, &FrameDropper{Interval: n})
+		}
 
-			if q := query.Get("framedrop"); q != "" {
+		if q := query.Get("delayskip"); q != "" {
+			dur, _ := time.ParseDuration(q)
+			skipper := &FrameDropper{DelaySkip: dur}
+			if q := query.Get("skipinterval"); q != "" {
 				n := 0
 				fmt.Sscanf(q, "%d", &n)
-				filters = append(filters, &FrameDropper{Interval: n})
+				skipper.SkipInterval = n
 			}
-
-			if q := query.Get("delayskip"); q != "" {
-				dur, _ := time.ParseDuration(q)
-				skipper := &FrameDropper{DelaySkip: dur}
-				if q := query.Get("skipinterval"); q != "" {
-					n := 0
-					fmt.Sscanf(q, "%d", &n)
-					skipper.SkipInterval = n
-				}
-				filters = append(filters, skipper)
-			}
-
-			demuxer := &pktque.FilterDemuxer{
-				Filter:  filters,
-				Demuxer: cursor,
-			}
-
-			avutil.CopyFile(conn, demuxer)
+			filters = append(filters, skipper)
 		}
-	}
 
-	server.HandlePublish = func(conn *rtmp.Conn) {
-		l.Lock()
-		ch := channels[conn.URL.Path]
-		if ch == nil {
-			ch = &Channel{}
-			ch.que = pubsub.NewQueue()
-			query := conn.URL.Query()
-			if q := query.Get("cachegop"); q != "" {
-				var n int
-				fmt.Sscanf(q, "%d", &n)
-				ch.que.SetMaxGopCount(n)
-			}
-			channels[conn.URL.Path] = ch
-		} else {
-			ch = nil
-		}
-		l.Unlock()
-		if ch == nil {
-			return
+		demuxer := &pktque.FilterDemuxer{
+			Filter:  filters,
+			Demuxer: cursor,
 		}
 
-		avutil.CopyFile(ch.que, conn)
-
-		l.Lock()
-		delete(channels, conn.URL.Path)
-		l.Unlock()
-		ch.que.Close()
+		avutil.CopyFile(conn, demuxer)
 	}
 
+	server.HandlePublish = r.HandlePublish
+
 	server.ListenAndServe()
 
 	// ffmpeg -re -i movie.flv -c copy -f flv rtmp://localhost/movie
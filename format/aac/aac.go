@@ -37,6 +37,9 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 }
 
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if pkt.IsScriptData {
+		return
+	}
 	aacparser.FillADTSHeader(self.adtshdr, self.config, 1024, len(pkt.Data))
 	if _, err = self.w.Write(self.adtshdr); err != nil {
 		return
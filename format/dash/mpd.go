@@ -0,0 +1,203 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
+)
+
+// Codecs returns the RFC 6381 codecs parameter of a stream, as used in
+// MPD and HLS manifests.
+func Codecs(stream av.CodecData) string {
+	switch codec := stream.(type) {
+	case h264parser.CodecData:
+		sps := codec.SPS()
+		if len(sps) < 4 {
+			return "avc1"
+		}
+		return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+
+	case h265parser.CodecData:
+		ptl := codec.RecordInfo.ProfileTierLevel
+		var compat uint32
+		for i := uint(0); i < 32; i++ {
+			if ptl.GeneralProfileCompatibilityFlags&(1<<i) != 0 {
+				compat |= 1 << (31 - i)
+			}
+		}
+		tier := "L"
+		if ptl.GeneralTierFlag != 0 {
+			tier = "H"
+		}
+		s := fmt.Sprintf("hvc1.%s%d.%x.%s%d", []string{"", "A", "B", "C"}[ptl.GeneralProfileSpace&3],
+			ptl.GeneralProfileIdc, compat, tier, ptl.GeneralLevelIdc)
+		// constraint flags bytes, trailing zero bytes omitted
+		var flags []string
+		for i := uint(0); i < 6; i++ {
+			flags = append(flags, fmt.Sprintf("%X", byte(ptl.GeneralConstraintIndicatorFlags>>(40-8*i))))
+		}
+		for len(flags) > 0 && flags[len(flags)-1] == "0" {
+			flags = flags[:len(flags)-1]
+		}
+		if len(flags) > 0 {
+			s += "." + strings.Join(flags, ".")
+		}
+		return s
+
+	case aacparser.CodecData:
+		return fmt.Sprintf("mp4a.40.%d", codec.Config.ObjectType)
+	}
+	return ""
+}
+
+func formatDuration(dur time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", dur.Seconds())
+}
+
+func (self *Muxer) window(track *track) []*Segment {
+	segs := track.segs
+	if n := len(segs) - self.WindowSize; n > 0 {
+		segs = segs[n:]
+	}
+	return segs
+}
+
+func periodSegments(segs []*Segment, id int) (out []*Segment) {
+	for _, seg := range segs {
+		if seg.Period == id {
+			out = append(out, seg)
+		}
+	}
+	return
+}
+
+func (self *Muxer) writeRepresentation(b *bytes.Buffer, p *period, i int, segs []*Segment) {
+	codec := p.codecs[i]
+	timescale := codecTimescale(codec)
+
+	var size, dur int64
+	for _, seg := range segs {
+		size += int64(len(seg.Data))
+		dur += seg.Duration
+	}
+	bandwidth := int64(1)
+	if dur > 0 {
+		bandwidth = size * 8 * timescale / dur
+	}
+
+	if codec.Type().IsVideo() {
+		video := codec.(av.VideoCodecData)
+		fmt.Fprintf(b, "    <AdaptationSet id=\"%d\" contentType=\"video\" mimeType=\"video/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n", i)
+		fmt.Fprintf(b, "      <Representation id=\"%d\" codecs=\"%s\" bandwidth=\"%d\" width=\"%d\" height=\"%d\">\n",
+			i, Codecs(codec), bandwidth, video.Width(), video.Height())
+	} else {
+		audio := codec.(av.AudioCodecData)
+		fmt.Fprintf(b, "    <AdaptationSet id=\"%d\" contentType=\"audio\" mimeType=\"audio/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n", i)
+		fmt.Fprintf(b, "      <Representation id=\"%d\" codecs=\"%s\" bandwidth=\"%d\" audioSamplingRate=\"%d\">\n",
+			i, Codecs(codec), bandwidth, audio.SampleRate())
+		fmt.Fprintf(b, "        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>\n",
+			audio.ChannelLayout().Count())
+	}
+
+	// segment times count from the first packet, not from the period start
+	offset := ""
+	if p.start > 0 {
+		offset = fmt.Sprintf(" presentationTimeOffset=\"%d\"", timeToTs(p.start, timescale))
+	}
+	if self.NumberOnly {
+		fmt.Fprintf(b, "        <SegmentTemplate timescale=\"%d\"%s duration=\"%d\" startNumber=\"%d\" initialization=\"$RepresentationID$/init-%d.mp4\" media=\"$RepresentationID$/$Number$.m4s\"/>\n",
+			timescale, offset, timeToTs(self.TargetDuration, timescale), p.numbers[i], p.id)
+	} else {
+		fmt.Fprintf(b, "        <SegmentTemplate timescale=\"%d\"%s startNumber=\"%d\" initialization=\"$RepresentationID$/init-%d.mp4\" media=\"$RepresentationID$/$Number$.m4s\">\n",
+			timescale, offset, segs[0].Number, p.id)
+		fmt.Fprintf(b, "          <SegmentTimeline>\n")
+		for _, seg := range segs {
+			fmt.Fprintf(b, "            <S t=\"%d\" d=\"%d\"/>\n", seg.Start, seg.Duration)
+		}
+		fmt.Fprintf(b, "          </SegmentTimeline>\n")
+		fmt.Fprintf(b, "        </SegmentTemplate>\n")
+	}
+
+	fmt.Fprintf(b, "      </Representation>\n")
+	fmt.Fprintf(b, "    </AdaptationSet>\n")
+}
+
+// MPD returns the current manifest, or nil if no segment is ready yet.
+// Once WriteTrailer was called it no longer asks players to reload it.
+// Each codec data change starts a new Period.
+func (self *Muxer) MPD() []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	ready := false
+	var depth time.Duration
+	for i, track := range self.tracks {
+		segs := self.window(track)
+		if len(segs) > 0 {
+			ready = true
+		}
+		var d time.Duration
+		for _, seg := range segs {
+			timescale := track.timescale
+			if p := self.findPeriod(seg.Period); p != nil {
+				timescale = codecTimescale(p.codecs[i])
+			}
+			d += time.Duration(seg.Duration) * time.Second / time.Duration(timescale)
+		}
+		if d > depth {
+			depth = d
+		}
+	}
+	if !ready {
+		return nil
+	}
+
+	target := self.TargetDuration
+	if self.maxduration > target {
+		target = self.maxduration
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	fmt.Fprintf(b, "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\"")
+	fmt.Fprintf(b, " availabilityStartTime=\"%s\"", self.availstart.UTC().Format(time.RFC3339))
+	fmt.Fprintf(b, " publishTime=\"%s\"", time.Now().UTC().Format(time.RFC3339))
+	if !self.closed {
+		fmt.Fprintf(b, " minimumUpdatePeriod=\"%s\"", formatDuration(self.TargetDuration))
+	}
+	fmt.Fprintf(b, " minBufferTime=\"%s\"", formatDuration(self.TargetDuration))
+	fmt.Fprintf(b, " timeShiftBufferDepth=\"%s\"", formatDuration(depth))
+	fmt.Fprintf(b, " suggestedPresentationDelay=\"%s\"", formatDuration(self.TargetDuration*3))
+	fmt.Fprintf(b, " maxSegmentDuration=\"%s\">\n", formatDuration(target))
+
+	for _, p := range self.periods {
+		var tracksegs [][]*Segment
+		listed := false
+		for _, track := range self.tracks {
+			segs := periodSegments(self.window(track), p.id)
+			if len(segs) > 0 {
+				listed = true
+			}
+			tracksegs = append(tracksegs, segs)
+		}
+		if !listed {
+			continue
+		}
+		fmt.Fprintf(b, "  <Period id=\"%d\" start=\"%s\">\n", p.id, formatDuration(p.start))
+		for i, segs := range tracksegs {
+			if len(segs) > 0 {
+				self.writeRepresentation(b, p, i, segs)
+			}
+		}
+		fmt.Fprintf(b, "  </Period>\n")
+	}
+
+	fmt.Fprintf(b, "</MPD>\n")
+	return b.Bytes()
+}
@@ -0,0 +1,441 @@
+// Package dash implements a live MPEG-DASH packager and server.
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/mp4"
+)
+
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC}
+
+// Segment is one fMP4 media segment (styp+moof+mdat) of a track. Start and
+// Duration are in the timescale of the track.
+type Segment struct {
+	Number   int
+	Start    int64
+	Duration int64
+	Data     []byte
+	// id of the period, whose init segment it needs
+	Period int
+}
+
+func (self *Segment) Name() string {
+	return fmt.Sprintf("%d.m4s", self.Number)
+}
+
+type track struct {
+	codec     av.CodecData
+	timescale int64
+	muxer     *mp4.FragMuxer
+	buf       *bytes.Buffer
+	init      []byte
+	segs      []*Segment
+	number    int
+
+	// codec data that takes effect at the next period
+	newcodec av.CodecData
+
+	gotpkt  bool
+	first   time.Duration
+	last    time.Duration
+	lastdur time.Duration
+}
+
+// period is a range of segments that share their init segments.
+type period struct {
+	id int
+	// since the first packet
+	start  time.Duration
+	codecs []av.CodecData
+	inits  [][]byte
+	// number of the first segment of each track
+	numbers []int
+}
+
+// Muxer packages each stream as its own representation: an init segment
+// and fMP4 media segments cut at the same video keyframes for all tracks.
+// It keeps a sliding window of the most recent segments and generates a
+// dynamic MPD for them.
+//
+// Muxer is an av.Muxer, so the usual way to feed it is
+// avutil.CopyFile(muxer, que.Oldest()). A Packet.NewCodecData starts a new
+// period with new init segments at the next video keyframe, the packets of
+// the stream until then are dropped.
+type Muxer struct {
+	// Segments are cut at the first keyframe after TargetDuration.
+	TargetDuration time.Duration
+	// Number of segments listed in the MPD.
+	WindowSize int
+	// Address segments with SegmentTemplate@duration and $Number$ only,
+	// instead of a SegmentTimeline. Players then compute segment numbers
+	// from the wall clock, which is only accurate with a fixed GOP length.
+	NumberOnly bool
+
+	lock   *sync.RWMutex
+	closed bool
+
+	tracks   []*track
+	videoidx int
+	periods  []*period
+
+	started     bool
+	starttime   time.Duration
+	segstart    time.Duration
+	availstart  time.Time
+	maxduration time.Duration
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{
+		TargetDuration: time.Second * 4,
+		WindowSize:     6,
+		lock:           &sync.RWMutex{},
+	}
+}
+
+func timeToTs(tm time.Duration, timescale int64) int64 {
+	return int64(tm * time.Duration(timescale) / time.Second)
+}
+
+func checkCodecType(stream av.CodecData) (err error) {
+	for _, typ := range CodecTypes {
+		if stream.Type() == typ {
+			return
+		}
+	}
+	err = fmt.Errorf("dash: codec type=%s is not supported", stream.Type())
+	return
+}
+
+func codecTimescale(stream av.CodecData) int64 {
+	if stream.Type().IsAudio() {
+		return int64(stream.(av.AudioCodecData).SampleRate())
+	}
+	return 90000
+}
+
+// setCodec starts a new FragMuxer for the track and makes its init segment.
+func (self *track) setCodec(stream av.CodecData) (err error) {
+	buf := &bytes.Buffer{}
+	muxer := mp4.NewFragMuxer(buf)
+	// fragments are only cut by FlushFragment
+	muxer.FragmentDuration = time.Duration(math.MaxInt64)
+	muxer.KeepTime = true
+	muxer.SegmentType = true
+	if err = muxer.WriteHeader([]av.CodecData{stream}); err != nil {
+		return
+	}
+	self.codec = stream
+	self.timescale = codecTimescale(stream)
+	self.init = buf.Bytes()
+	self.buf = &bytes.Buffer{}
+	self.muxer = muxer
+	self.muxer.SetWriter(self.buf)
+	return
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	var tracks []*track
+	self.videoidx = -1
+	for i, stream := range streams {
+		if err = checkCodecType(stream); err != nil {
+			return
+		}
+		track := &track{}
+		if stream.Type().IsVideo() && self.videoidx == -1 {
+			self.videoidx = i
+		}
+		if err = track.setCodec(stream); err != nil {
+			return
+		}
+		tracks = append(tracks, track)
+	}
+	self.lock.Lock()
+	self.tracks = tracks
+	self.periods = nil
+	self.addPeriod(0)
+	self.closed = false
+	self.lock.Unlock()
+	self.started = false
+	return
+}
+
+// addPeriod records the current init segments of all tracks as a new period.
+func (self *Muxer) addPeriod(start time.Duration) {
+	p := &period{start: start}
+	if n := len(self.periods); n > 0 {
+		p.id = self.periods[n-1].id + 1
+	}
+	for _, track := range self.tracks {
+		p.codecs = append(p.codecs, track.codec)
+		p.inits = append(p.inits, track.init)
+		p.numbers = append(p.numbers, track.number+1)
+	}
+	self.periods = append(self.periods, p)
+}
+
+// startPeriod ends the segments of all tracks, and starts the tracks with
+// new codec data over.
+func (self *Muxer) startPeriod(start time.Duration) (err error) {
+	if err = self.flushSegments(false); err != nil {
+		return
+	}
+	for _, track := range self.tracks {
+		if track.newcodec == nil {
+			continue
+		}
+		self.lock.Lock()
+		err = track.setCodec(track.newcodec)
+		self.lock.Unlock()
+		if err != nil {
+			return
+		}
+		track.newcodec = nil
+		track.gotpkt = false
+	}
+	self.lock.Lock()
+	self.addPeriod(start)
+	self.lock.Unlock()
+	return
+}
+
+func (self *Muxer) changePending() bool {
+	for _, track := range self.tracks {
+		if track.newcodec != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// flushSegments ends the current segment of every track. Each FragMuxer
+// keeps the last packet written, so a segment runs from the first sample
+// of the track up to that packet.
+func (self *Muxer) flushSegments(trailer bool) (err error) {
+	var segdur time.Duration
+	self.lock.RLock()
+	curperiod := self.periods[len(self.periods)-1].id
+	self.lock.RUnlock()
+	for _, track := range self.tracks {
+		if !track.gotpkt {
+			continue
+		}
+		end := track.last
+		// the muxer of a track with new codec data is not used any more
+		if trailer || track.newcodec != nil {
+			if err = track.muxer.WriteTrailer(); err != nil {
+				return
+			}
+			end += track.lastdur
+		} else {
+			if err = track.muxer.FlushFragment(); err != nil {
+				return
+			}
+		}
+		if end <= track.first || track.buf.Len() == 0 {
+			continue
+		}
+
+		start := timeToTs(track.first, track.timescale)
+		seg := &Segment{
+			Number:   track.number + 1,
+			Start:    start,
+			Duration: timeToTs(end, track.timescale) - start,
+			Data:     track.buf.Bytes(),
+			Period:   curperiod,
+		}
+		if dur := end - track.first; dur > segdur {
+			segdur = dur
+		}
+		track.first = end
+		track.buf = &bytes.Buffer{}
+		track.muxer.SetWriter(track.buf)
+
+		self.lock.Lock()
+		track.number++
+		track.segs = append(track.segs, seg)
+		// keep a few segments past the window for clients still fetching them
+		if n := len(track.segs) - self.WindowSize - 2; n > 0 {
+			track.segs = track.segs[n:]
+		}
+		self.lock.Unlock()
+	}
+
+	self.lock.Lock()
+	if segdur > self.maxduration {
+		self.maxduration = segdur
+	}
+	self.prunePeriods()
+	self.lock.Unlock()
+	return
+}
+
+// prunePeriods drops the periods before the oldest segment kept.
+func (self *Muxer) prunePeriods() {
+	oldest := self.periods[len(self.periods)-1].id
+	for _, track := range self.tracks {
+		if len(track.segs) > 0 && track.segs[0].Period < oldest {
+			oldest = track.segs[0].Period
+		}
+	}
+	for self.periods[0].id < oldest {
+		self.periods = self.periods[1:]
+	}
+}
+
+func (self *track) writePacket(pkt av.Packet) (err error) {
+	if self.gotpkt && pkt.Time < self.last {
+		err = fmt.Errorf("dash: stream#%d time=%v < lasttime=%v", pkt.Idx, pkt.Time, self.last)
+		return
+	}
+	pkt.Idx = 0
+	pkt.NewCodecData = nil
+	// written first, so the sample before the keyframe gets its duration
+	// and goes into the segment that ends here
+	if err = self.muxer.WritePacket(pkt); err != nil {
+		return
+	}
+	if !self.gotpkt {
+		self.first = pkt.Time
+		self.gotpkt = true
+	} else {
+		self.lastdur = pkt.Time - self.last
+	}
+	self.last = pkt.Time
+	return
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if pkt.IsScriptData {
+		return
+	}
+	if int(pkt.Idx) >= len(self.tracks) {
+		err = fmt.Errorf("dash: stream#%d not found", pkt.Idx)
+		return
+	}
+	track := self.tracks[pkt.Idx]
+	if pkt.NewCodecData != nil {
+		if err = checkCodecType(pkt.NewCodecData); err != nil {
+			return
+		}
+		if pkt.NewCodecData.Type().IsAudio() != track.codec.Type().IsAudio() {
+			err = fmt.Errorf("dash: stream#%d can not change from %s to %s", pkt.Idx, track.codec.Type(), pkt.NewCodecData.Type())
+			return
+		}
+		track.newcodec = pkt.NewCodecData
+	}
+	iskey := pkt.IsKeyFrame && int(pkt.Idx) == self.videoidx
+	// audio only streams can be cut anywhere
+	cutable := iskey || self.videoidx == -1
+
+	if !self.started {
+		if !cutable {
+			return
+		}
+		self.starttime = pkt.Time
+		self.segstart = pkt.Time
+		self.lock.Lock()
+		self.availstart = time.Now()
+		self.lock.Unlock()
+		self.started = true
+	}
+	// packets of other tracks from before the first keyframe
+	if pkt.Time < self.starttime {
+		return
+	}
+
+	tpkt := pkt
+	tpkt.Time = pkt.Time - self.starttime
+	changing := track.newcodec != nil
+	if changing && !cutable {
+		return
+	}
+	if !changing {
+		if err = track.writePacket(tpkt); err != nil {
+			return
+		}
+	}
+
+	if cutable && self.changePending() {
+		if err = self.startPeriod(tpkt.Time); err != nil {
+			return
+		}
+		if changing {
+			if err = track.writePacket(tpkt); err != nil {
+				return
+			}
+		}
+		self.segstart = pkt.Time
+	} else if cutable && pkt.Time-self.segstart >= self.TargetDuration {
+		if err = self.flushSegments(false); err != nil {
+			return
+		}
+		self.segstart = pkt.Time
+	}
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	if self.started {
+		if err = self.flushSegments(true); err != nil {
+			return
+		}
+		self.started = false
+	}
+	self.lock.Lock()
+	self.closed = true
+	self.lock.Unlock()
+	return
+}
+
+// Init returns the current init segment of track idx.
+func (self *Muxer) Init(idx int) []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if idx < 0 || idx >= len(self.tracks) {
+		return nil
+	}
+	return self.tracks[idx].init
+}
+
+func (self *Muxer) findPeriod(id int) *period {
+	for _, p := range self.periods {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// PeriodInit returns the init segment of track idx in a period still
+// listed in the MPD.
+func (self *Muxer) PeriodInit(id int, idx int) []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	p := self.findPeriod(id)
+	if p == nil || idx < 0 || idx >= len(p.inits) {
+		return nil
+	}
+	return p.inits[idx]
+}
+
+// Segment returns a segment of track idx still inside the sliding window.
+func (self *Muxer) Segment(idx int, number int) (seg *Segment) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if idx < 0 || idx >= len(self.tracks) {
+		return
+	}
+	for _, s := range self.tracks[idx].segs {
+		if s.Number == number {
+			return s
+		}
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package dash
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ServeHTTP serves the MPD for any path ending in .mpd, and init and media
+// segments as <track>/init-<period>.mp4 and <track>/<number>.m4s relative
+// to it, so the muxer can be mounted under any prefix. <track>/init.mp4 is
+// the current init segment.
+func (self *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dir, name := path.Split(r.URL.Path)
+	idx, err := strconv.Atoi(path.Base(dir))
+	if err != nil {
+		idx = -1
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".mpd"):
+		b := self.MPD()
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(b)
+
+	case name == "init.mp4" || strings.HasPrefix(name, "init-") && strings.HasSuffix(name, ".mp4"):
+		var b []byte
+		if name == "init.mp4" {
+			b = self.Init(idx)
+		} else if id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "init-"), ".mp4")); err == nil {
+			b = self.PeriodInit(id, idx)
+		}
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(b)
+
+	case strings.HasSuffix(name, ".m4s"):
+		number, err := strconv.Atoi(strings.TrimSuffix(name, ".m4s"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		seg := self.Segment(idx, number)
+		if seg == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Header().Set("Content-Length", strconv.Itoa(len(seg.Data)))
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(seg.Data)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
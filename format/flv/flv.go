@@ -2,6 +2,7 @@ package flv
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/nareix/joy4/utils/bits/pio"
 	"github.com/nareix/joy4/av"
@@ -10,8 +11,11 @@ import (
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/fake"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"github.com/nareix/joy4/format/flv/flvio"
 	"io"
+	"net/url"
+	"path"
 )
 
 var MaxProbePacketCount = 20
@@ -28,6 +32,9 @@ func NewMetadataByStreams(streams []av.CodecData) (metadata flvio.AMFMap, err er
 			case av.H264:
 				metadata["videocodecid"] = flvio.VIDEO_H264
 
+			case av.H265:
+				metadata["videocodecid"] = flvio.FOURCC_HEVC
+
 			default:
 				err = fmt.Errorf("flv: metadata: unsupported video codecType=%v", stream.Type())
 				return
@@ -66,6 +73,7 @@ type Prober struct {
 	PushedCount                    int
 	Streams                        []av.CodecData
 	CachedPkts                     []av.Packet
+	changed                        []bool
 }
 
 func (self *Prober) CacheTag(_tag flvio.Tag, timestamp int32) {
@@ -74,6 +82,11 @@ func (self *Prober) CacheTag(_tag flvio.Tag, timestamp int32) {
 }
 
 func (self *Prober) PushTag(tag flvio.Tag, timestamp int32) (err error) {
+	if tag.Type == flvio.TAG_SCRIPTDATA {
+		self.CacheTag(tag, timestamp)
+		return
+	}
+
 	self.PushedCount++
 
 	if self.PushedCount > MaxProbePacketCount {
@@ -83,6 +96,30 @@ func (self *Prober) PushTag(tag flvio.Tag, timestamp int32) (err error) {
 
 	switch tag.Type {
 	case flvio.TAG_VIDEO:
+		if tag.IsExHeader {
+			if tag.FourCC != flvio.FOURCC_HEVC {
+				err = fmt.Errorf("flv: video fourcc=%x not supported", tag.FourCC)
+				return
+			}
+			switch tag.PacketType {
+			case flvio.PKTTYPE_SEQUENCE_START:
+				if !self.GotVideo {
+					var stream h265parser.CodecData
+					if stream, err = h265parser.NewCodecDataFromHEVCDecoderConfRecord(tag.Data); err != nil {
+						err = fmt.Errorf("flv: h265 seqhdr invalid")
+						return
+					}
+					self.VideoStreamIdx = len(self.Streams)
+					self.Streams = append(self.Streams, stream)
+					self.GotVideo = true
+				}
+
+			case flvio.PKTTYPE_CODED_FRAMES, flvio.PKTTYPE_CODED_FRAMESX:
+				self.CacheTag(tag, timestamp)
+			}
+			break
+		}
+
 		switch tag.AVCPacketType {
 		case flvio.AVC_SEQHDR:
 			if !self.GotVideo {
@@ -162,11 +199,71 @@ func (self *Prober) Probed() (ok bool) {
 	return
 }
 
+func codecDataBytes(stream av.CodecData) []byte {
+	switch stream := stream.(type) {
+	case h264parser.CodecData:
+		return stream.AVCDecoderConfRecordBytes()
+	case h265parser.CodecData:
+		return stream.HEVCDecoderConfRecordBytes()
+	case aacparser.CodecData:
+		return stream.MPEG4AudioConfigBytes()
+	}
+	return nil
+}
+
+// setCodecData handles a sequence header received after probing. Streams is
+// replaced, not modified, and the next packet of the stream carries the new
+// codec data in NewCodecData.
+func (self *Prober) setCodecData(idx int, stream av.CodecData) {
+	if idx >= len(self.Streams) {
+		return
+	}
+	if bytes.Equal(codecDataBytes(self.Streams[idx]), codecDataBytes(stream)) {
+		return
+	}
+	streams := append([]av.CodecData{}, self.Streams...)
+	streams[idx] = stream
+	self.Streams = streams
+	if self.changed == nil {
+		self.changed = make([]bool, len(streams))
+	}
+	self.changed[idx] = true
+}
+
 func (self *Prober) TagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet, ok bool) {
 	switch tag.Type {
+	case flvio.TAG_SCRIPTDATA:
+		ok = true
+		pkt.IsScriptData = true
+		pkt.Data = tag.Data
+
 	case flvio.TAG_VIDEO:
 		pkt.Idx = int8(self.VideoStreamIdx)
+		if tag.IsExHeader {
+			switch tag.PacketType {
+			case flvio.PKTTYPE_SEQUENCE_START:
+				if self.GotVideo && tag.FourCC == flvio.FOURCC_HEVC {
+					if stream, err := h265parser.NewCodecDataFromHEVCDecoderConfRecord(tag.Data); err == nil {
+						self.setCodecData(self.VideoStreamIdx, stream)
+					}
+				}
+
+			case flvio.PKTTYPE_CODED_FRAMES, flvio.PKTTYPE_CODED_FRAMESX:
+				ok = true
+				pkt.Data = tag.Data
+				pkt.CompositionTime = flvio.TsToTime(tag.CompositionTime)
+				pkt.IsKeyFrame = tag.FrameType == flvio.FRAME_KEY
+			}
+			break
+		}
 		switch tag.AVCPacketType {
+		case flvio.AVC_SEQHDR:
+			if self.GotVideo {
+				if stream, err := h264parser.NewCodecDataFromAVCDecoderConfRecord(tag.Data); err == nil {
+					self.setCodecData(self.VideoStreamIdx, stream)
+				}
+			}
+
 		case flvio.AVC_NALU:
 			ok = true
 			pkt.Data = tag.Data
@@ -179,6 +276,13 @@ func (self *Prober) TagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet,
 		switch tag.SoundFormat {
 		case flvio.SOUND_AAC:
 			switch tag.AACPacketType {
+			case flvio.AAC_SEQHDR:
+				if self.GotAudio {
+					if stream, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(tag.Data); err == nil {
+						self.setCodecData(self.AudioStreamIdx, stream)
+					}
+				}
+
 			case flvio.AAC_RAW:
 				ok = true
 				pkt.Data = tag.Data
@@ -194,6 +298,11 @@ func (self *Prober) TagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet,
 		}
 	}
 
+	if ok && !pkt.IsScriptData && int(pkt.Idx) < len(self.changed) && self.changed[pkt.Idx] {
+		self.changed[pkt.Idx] = false
+		pkt.NewCodecData = self.Streams[pkt.Idx]
+	}
+
 	pkt.Time = flvio.TsToTime(timestamp)
 	return
 }
@@ -222,6 +331,19 @@ func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
 		ok = true
 		_tag = tag
 
+	case av.H265:
+		h265 := stream.(h265parser.CodecData)
+		tag := flvio.Tag{
+			Type:       flvio.TAG_VIDEO,
+			IsExHeader: true,
+			PacketType: flvio.PKTTYPE_SEQUENCE_START,
+			FourCC:     flvio.FOURCC_HEVC,
+			Data:       h265.HEVCDecoderConfRecordBytes(),
+			FrameType:  flvio.FRAME_KEY,
+		}
+		ok = true
+		_tag = tag
+
 	case av.NELLYMOSER:
 	case av.SPEEX:
 
@@ -256,7 +378,31 @@ func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
 	return
 }
 
+// ChangeCodecData returns a copy of streams with stream idx replaced and the
+// sequence header tag to send before the packet carrying the change.
+func ChangeCodecData(streams []av.CodecData, idx int, stream av.CodecData) (newstreams []av.CodecData, tag flvio.Tag, ok bool, err error) {
+	if idx >= len(streams) {
+		err = fmt.Errorf("flv: codec data change of invalid stream idx=%d", idx)
+		return
+	}
+	if tag, ok, err = CodecDataToTag(stream); err != nil {
+		return
+	}
+	newstreams = append([]av.CodecData{}, streams...)
+	newstreams[idx] = stream
+	return
+}
+
 func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp int32) {
+	if pkt.IsScriptData {
+		tag = flvio.Tag{
+			Type: flvio.TAG_SCRIPTDATA,
+			Data: pkt.Data,
+		}
+		timestamp = flvio.TimeToTs(pkt.Time)
+		return
+	}
+
 	switch stream.Type() {
 	case av.H264:
 		tag = flvio.Tag{
@@ -272,6 +418,21 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 			tag.FrameType = flvio.FRAME_INTER
 		}
 
+	case av.H265:
+		tag = flvio.Tag{
+			Type:            flvio.TAG_VIDEO,
+			IsExHeader:      true,
+			PacketType:      flvio.PKTTYPE_CODED_FRAMES,
+			FourCC:          flvio.FOURCC_HEVC,
+			Data:            pkt.Data,
+			CompositionTime: flvio.TimeToTs(pkt.CompositionTime),
+		}
+		if pkt.IsKeyFrame {
+			tag.FrameType = flvio.FRAME_KEY
+		} else {
+			tag.FrameType = flvio.FRAME_INTER
+		}
+
 	case av.AAC:
 		tag = flvio.Tag{
 			Type:          flvio.TAG_AUDIO,
@@ -335,7 +496,7 @@ func NewMuxer(w io.Writer) *Muxer {
 	return NewMuxerWriteFlusher(bufio.NewWriterSize(w, pio.RecommendBufioSize))
 }
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC, av.SPEEX}
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC, av.SPEEX}
 
 func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	var flags uint8
@@ -370,7 +531,25 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 }
 
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
-	stream := self.streams[pkt.Idx]
+	if pkt.NewCodecData != nil && !pkt.IsScriptData {
+		var streams []av.CodecData
+		var tag flvio.Tag
+		var ok bool
+		if streams, tag, ok, err = ChangeCodecData(self.streams, int(pkt.Idx), pkt.NewCodecData); err != nil {
+			return
+		}
+		self.streams = streams
+		if ok {
+			if err = flvio.WriteTag(self.bufw, tag, flvio.TimeToTs(pkt.Time), self.b); err != nil {
+				return
+			}
+		}
+	}
+
+	var stream av.CodecData
+	if !pkt.IsScriptData {
+		stream = self.streams[pkt.Idx]
+	}
 	tag, timestamp := PacketToTag(pkt, stream)
 
 	if err = flvio.WriteTag(self.bufw, tag, timestamp, self.b); err != nil {
@@ -387,6 +566,10 @@ func (self *Muxer) WriteTrailer() (err error) {
 }
 
 type Demuxer struct {
+	// return script data tags (onMetaData, onCuePoint, ...) from ReadPacket
+	// as packets with IsScriptData set
+	ReadScriptData bool
+
 	prober *Prober
 	bufr   *bufio.Reader
 	b      []byte
@@ -431,6 +614,9 @@ func (self *Demuxer) prepare() (err error) {
 				if tag, timestamp, err = flvio.ReadTag(self.bufr, self.b); err != nil {
 					return
 				}
+				if tag.Type == flvio.TAG_SCRIPTDATA && !self.ReadScriptData {
+					continue
+				}
 				if err = self.prober.PushTag(tag, timestamp); err != nil {
 					return
 				}
@@ -465,6 +651,9 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 		if tag, timestamp, err = flvio.ReadTag(self.bufr, self.b); err != nil {
 			return
 		}
+		if tag.Type == flvio.TAG_SCRIPTDATA && !self.ReadScriptData {
+			continue
+		}
 
 		var ok bool
 		if pkt, ok = self.prober.TagToPacket(tag, timestamp); ok {
@@ -482,6 +671,25 @@ func Handler(h *avutil.RegisterHandler) {
 
 	h.Ext = ".flv"
 
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		u, _ := url.Parse(uri)
+		if u == nil || path.Ext(u.Path) != ".flv" {
+			return
+		}
+		switch u.Scheme {
+		case "http", "https", "ws", "wss":
+		default:
+			return
+		}
+		ok = true
+		handlers := h.Handlers
+		if handlers == nil {
+			handlers = avutil.DefaultHandlers
+		}
+		demuxer, err = DialHTTP(uri, handlers.HTTP)
+		return
+	}
+
 	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
 		return NewDemuxer(r)
 	}
@@ -458,6 +458,14 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 		val = string(b[n:n+length])
 		n += length
 
+	case avmplusobjectmarker:
+		var size int
+		if val, size, err = parseAMF3Val(b[n:], offset+n); err != nil {
+			err = amf0ParseErr(fmt.Sprintf("avmplusobject(%s)", err), offset+n, nil)
+			return
+		}
+		n += size
+
 	default:
 		err = amf0ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, err)
 		return
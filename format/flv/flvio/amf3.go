@@ -0,0 +1,818 @@
+package flvio
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+type AMF3ParseError struct {
+	Offset  int
+	Message string
+	Next    *AMF3ParseError
+}
+
+func (self *AMF3ParseError) Error() string {
+	s := []string{}
+	for p := self; p != nil; p = p.Next {
+		s = append(s, fmt.Sprintf("%s:%d", p.Message, p.Offset))
+	}
+	return "amf3 parse error: " + strings.Join(s, ",")
+}
+
+func amf3ParseErr(message string, offset int, err error) error {
+	next, _ := err.(*AMF3ParseError)
+	return &AMF3ParseError{
+		Offset:  offset,
+		Message: message,
+		Next:    next,
+	}
+}
+
+const (
+	amf3IntMin = -1 << 28
+	amf3IntMax = 1<<28 - 1
+)
+
+func lenAMF3U29(u uint32) int {
+	switch {
+	case u < 0x80:
+		return 1
+	case u < 0x4000:
+		return 2
+	case u < 0x200000:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func fillAMF3U29(b []byte, u uint32) int {
+	u &= 0x1fffffff
+	switch {
+	case u < 0x80:
+		b[0] = byte(u)
+		return 1
+	case u < 0x4000:
+		b[0] = byte(u>>7) | 0x80
+		b[1] = byte(u) & 0x7f
+		return 2
+	case u < 0x200000:
+		b[0] = byte(u>>14) | 0x80
+		b[1] = byte(u>>7) | 0x80
+		b[2] = byte(u) & 0x7f
+		return 3
+	default:
+		b[0] = byte(u>>22) | 0x80
+		b[1] = byte(u>>15) | 0x80
+		b[2] = byte(u>>8) | 0x80
+		b[3] = byte(u)
+		return 4
+	}
+}
+
+func lenAMF3String(s string) int {
+	return lenAMF3U29(uint32(len(s))<<1|1) + len(s)
+}
+
+// fillAMF3String writes a string without marker, always inline.
+func fillAMF3String(b []byte, s string) (n int) {
+	n += fillAMF3U29(b[n:], uint32(len(s))<<1|1)
+	n += copy(b[n:], s)
+	return
+}
+
+func amf3Int(i int64) bool {
+	return i >= amf3IntMin && i <= amf3IntMax
+}
+
+// LenAMF3Val returns the size FillAMF3Val writes. Integers out of the 29 bit
+// range are written as doubles, references are never used.
+func LenAMF3Val(_val interface{}) (n int) {
+	switch val := _val.(type) {
+	case int8:
+		n += lenAMF3Int(int64(val))
+	case int16:
+		n += lenAMF3Int(int64(val))
+	case int32:
+		n += lenAMF3Int(int64(val))
+	case int64:
+		n += lenAMF3Int(val)
+	case int:
+		n += lenAMF3Int(int64(val))
+	case uint8:
+		n += lenAMF3Int(int64(val))
+	case uint16:
+		n += lenAMF3Int(int64(val))
+	case uint32:
+		n += lenAMF3Int(int64(val))
+	case uint64:
+		if val <= amf3IntMax {
+			n += lenAMF3Int(int64(val))
+		} else {
+			n += 9
+		}
+	case uint:
+		n += LenAMF3Val(uint64(val))
+	case float32:
+		n += 9
+	case float64:
+		n += 9
+
+	case string:
+		n += 1 + lenAMF3String(val)
+
+	case []byte:
+		n += 1 + lenAMF3U29(uint32(len(val))<<1|1) + len(val)
+
+	case AMFMap:
+		n += 2 + 1
+		for k, v := range val {
+			if len(k) > 0 {
+				n += lenAMF3String(k)
+				n += LenAMF3Val(v)
+			}
+		}
+		n++
+
+	case AMFECMAArray:
+		n += 2
+		for k, v := range val {
+			if len(k) > 0 {
+				n += lenAMF3String(k)
+				n += LenAMF3Val(v)
+			}
+		}
+		n++
+
+	case AMFArray:
+		n += 1 + lenAMF3U29(uint32(len(val))<<1|1) + 1
+		for _, v := range val {
+			n += LenAMF3Val(v)
+		}
+
+	case []int32:
+		n += 1 + lenAMF3U29(uint32(len(val))<<1|1) + 1 + len(val)*4
+	case []uint32:
+		n += 1 + lenAMF3U29(uint32(len(val))<<1|1) + 1 + len(val)*4
+	case []float64:
+		n += 1 + lenAMF3U29(uint32(len(val))<<1|1) + 1 + len(val)*8
+
+	case time.Time:
+		n += 1 + 1 + 8
+
+	case bool:
+		n++
+
+	case nil:
+		n++
+	}
+
+	return
+}
+
+func lenAMF3Int(i int64) int {
+	if amf3Int(i) {
+		return 1 + lenAMF3U29(uint32(i)&0x1fffffff)
+	}
+	return 9
+}
+
+func fillAMF3Int(b []byte, i int64) (n int) {
+	if amf3Int(i) {
+		b[n] = amf3integermarker
+		n++
+		n += fillAMF3U29(b[n:], uint32(i)&0x1fffffff)
+	} else {
+		n += fillAMF3Double(b[n:], float64(i))
+	}
+	return
+}
+
+func fillAMF3Double(b []byte, f float64) (n int) {
+	b[n] = amf3doublemarker
+	n++
+	n += fillBEFloat64(b[n:], f)
+	return
+}
+
+func FillAMF3Val(b []byte, _val interface{}) (n int) {
+	switch val := _val.(type) {
+	case int8:
+		n += fillAMF3Int(b[n:], int64(val))
+	case int16:
+		n += fillAMF3Int(b[n:], int64(val))
+	case int32:
+		n += fillAMF3Int(b[n:], int64(val))
+	case int64:
+		n += fillAMF3Int(b[n:], val)
+	case int:
+		n += fillAMF3Int(b[n:], int64(val))
+	case uint8:
+		n += fillAMF3Int(b[n:], int64(val))
+	case uint16:
+		n += fillAMF3Int(b[n:], int64(val))
+	case uint32:
+		n += fillAMF3Int(b[n:], int64(val))
+	case uint64:
+		if val <= amf3IntMax {
+			n += fillAMF3Int(b[n:], int64(val))
+		} else {
+			n += fillAMF3Double(b[n:], float64(val))
+		}
+	case uint:
+		n += FillAMF3Val(b[n:], uint64(val))
+	case float32:
+		n += fillAMF3Double(b[n:], float64(val))
+	case float64:
+		n += fillAMF3Double(b[n:], val)
+
+	case string:
+		b[n] = amf3stringmarker
+		n++
+		n += fillAMF3String(b[n:], val)
+
+	case []byte:
+		b[n] = amf3bytearraymarker
+		n++
+		n += fillAMF3U29(b[n:], uint32(len(val))<<1|1)
+		n += copy(b[n:], val)
+
+	case AMFMap:
+		// anonymous dynamic object with inline traits and no sealed members
+		b[n] = amf3objectmarker
+		n++
+		b[n] = 0x0b
+		n++
+		n += fillAMF3String(b[n:], "")
+		for k, v := range val {
+			if len(k) > 0 {
+				n += fillAMF3String(b[n:], k)
+				n += FillAMF3Val(b[n:], v)
+			}
+		}
+		n += fillAMF3String(b[n:], "")
+
+	case AMFECMAArray:
+		// associative part only
+		b[n] = amf3arraymarker
+		n++
+		n += fillAMF3U29(b[n:], 0<<1|1)
+		for k, v := range val {
+			if len(k) > 0 {
+				n += fillAMF3String(b[n:], k)
+				n += FillAMF3Val(b[n:], v)
+			}
+		}
+		n += fillAMF3String(b[n:], "")
+
+	case AMFArray:
+		b[n] = amf3arraymarker
+		n++
+		n += fillAMF3U29(b[n:], uint32(len(val))<<1|1)
+		n += fillAMF3String(b[n:], "")
+		for _, v := range val {
+			n += FillAMF3Val(b[n:], v)
+		}
+
+	case []int32:
+		b[n] = amf3vectorintmarker
+		n++
+		n += fillAMF3U29(b[n:], uint32(len(val))<<1|1)
+		b[n] = 0
+		n++
+		for _, v := range val {
+			pio.PutU32BE(b[n:], uint32(v))
+			n += 4
+		}
+
+	case []uint32:
+		b[n] = amf3vectoruintmarker
+		n++
+		n += fillAMF3U29(b[n:], uint32(len(val))<<1|1)
+		b[n] = 0
+		n++
+		for _, v := range val {
+			pio.PutU32BE(b[n:], v)
+			n += 4
+		}
+
+	case []float64:
+		b[n] = amf3vectordoublemarker
+		n++
+		n += fillAMF3U29(b[n:], uint32(len(val))<<1|1)
+		b[n] = 0
+		n++
+		for _, v := range val {
+			n += fillBEFloat64(b[n:], v)
+		}
+
+	case time.Time:
+		b[n] = amf3datemarker
+		n++
+		n += fillAMF3U29(b[n:], 1)
+		n += fillBEFloat64(b[n:], float64(val.UnixNano()/1000000))
+
+	case bool:
+		if val {
+			b[n] = amf3truemarker
+		} else {
+			b[n] = amf3falsemarker
+		}
+		n++
+
+	case nil:
+		b[n] = amf3nullmarker
+		n++
+	}
+
+	return
+}
+
+type amf3Traits struct {
+	classname      string
+	sealed         []string
+	dynamic        bool
+	externalizable bool
+}
+
+// amf3Parser holds the string, object and traits reference tables, which
+// live as long as one AMF3 value sequence.
+type amf3Parser struct {
+	b      []byte
+	offset int
+	strs   []string
+	objs   []interface{}
+	traits []*amf3Traits
+}
+
+// ParseAMF3Val parses one AMF3 value. Integers are returned as float64 like
+// AMF0 numbers, objects as AMFMap, dense arrays as AMFArray and arrays with
+// associative members as AMFECMAArray, the dense members keyed by index.
+// ByteArray is returned as []byte, XML as string and vectors as []int32,
+// []uint32, []float64 or AMFArray.
+func ParseAMF3Val(b []byte) (val interface{}, n int, err error) {
+	return parseAMF3Val(b, 0)
+}
+
+func parseAMF3Val(b []byte, offset int) (val interface{}, n int, err error) {
+	p := &amf3Parser{b: b, offset: offset}
+	return p.parseVal(0)
+}
+
+func (self *amf3Parser) err(message string, n int, err error) error {
+	return amf3ParseErr(message, self.offset+n, err)
+}
+
+func (self *amf3Parser) parseU29(n int) (u uint32, _n int, err error) {
+	b := self.b
+	for i := 0; i < 4; i++ {
+		if len(b) < n+1 {
+			err = self.err("u29", n, nil)
+			return
+		}
+		c := b[n]
+		n++
+		if i == 3 {
+			u = u<<8 | uint32(c)
+			break
+		}
+		u = u<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	_n = n
+	return
+}
+
+func (self *amf3Parser) parseString(n int) (s string, _n int, err error) {
+	var next int
+	var u uint32
+	if u, next, err = self.parseU29(n); err != nil {
+		err = self.err("string.length", n, err)
+		return
+	}
+	n = next
+	if u&1 == 0 {
+		ref := int(u >> 1)
+		if ref >= len(self.strs) {
+			err = self.err(fmt.Sprintf("string.ref=%d", ref), n, nil)
+			return
+		}
+		s = self.strs[ref]
+		_n = n
+		return
+	}
+	length := int(u >> 1)
+	if len(self.b) < n+length {
+		err = self.err("string.body", n, nil)
+		return
+	}
+	s = string(self.b[n : n+length])
+	n += length
+	if length > 0 {
+		self.strs = append(self.strs, s)
+	}
+	_n = n
+	return
+}
+
+// parseRef reads the U29 header shared by complex types. ok is false when
+// the value is a reference to the object table.
+func (self *amf3Parser) parseRef(n int, name string) (val interface{}, u uint32, ok bool, _n int, err error) {
+	var next int
+	if u, next, err = self.parseU29(n); err != nil {
+		err = self.err(name+".header", n, err)
+		return
+	}
+	n = next
+	if u&1 == 0 {
+		ref := int(u >> 1)
+		if ref >= len(self.objs) {
+			err = self.err(fmt.Sprintf("%s.ref=%d", name, ref), n, nil)
+			return
+		}
+		val = self.objs[ref]
+		_n = n
+		return
+	}
+	u >>= 1
+	ok = true
+	_n = n
+	return
+}
+
+func (self *amf3Parser) parseTraits(u uint32, n int) (traits *amf3Traits, _n int, err error) {
+	var next int
+	if u&1 == 0 {
+		ref := int(u >> 1)
+		if ref >= len(self.traits) {
+			err = self.err(fmt.Sprintf("object.traits.ref=%d", ref), n, nil)
+			return
+		}
+		traits = self.traits[ref]
+		_n = n
+		return
+	}
+	traits = &amf3Traits{
+		externalizable: u&2 != 0,
+		dynamic:        u&4 != 0,
+	}
+	count := int(u >> 3)
+	if traits.classname, next, err = self.parseString(n); err != nil {
+		err = self.err("object.classname", n, err)
+		return
+	}
+	n = next
+	for i := 0; i < count; i++ {
+		var name string
+		if name, next, err = self.parseString(n); err != nil {
+			err = self.err("object.sealed", n, err)
+			return
+		}
+		n = next
+		traits.sealed = append(traits.sealed, name)
+	}
+	self.traits = append(self.traits, traits)
+	_n = n
+	return
+}
+
+func (self *amf3Parser) parseObject(n int) (val interface{}, _n int, err error) {
+	var next int
+	var u uint32
+	var ok bool
+	if val, u, ok, next, err = self.parseRef(n, "object"); err != nil || !ok {
+		_n = next
+		return
+	}
+	n = next
+	var traits *amf3Traits
+	if traits, next, err = self.parseTraits(u, n); err != nil {
+		return
+	}
+	n = next
+
+	if traits.externalizable {
+		switch traits.classname {
+		case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+			// serialized as the wrapped value
+			idx := len(self.objs)
+			self.objs = append(self.objs, nil)
+			if val, next, err = self.parseVal(n); err != nil {
+				err = self.err("object.externalizable", n, err)
+				return
+			}
+			n = next
+			self.objs[idx] = val
+			_n = n
+			return
+		}
+		err = self.err(fmt.Sprintf("object.externalizable=%s", traits.classname), n, nil)
+		return
+	}
+
+	obj := AMFMap{}
+	self.objs = append(self.objs, obj)
+	for _, key := range traits.sealed {
+		var oval interface{}
+		if oval, next, err = self.parseVal(n); err != nil {
+			err = self.err("object.val", n, err)
+			return
+		}
+		n = next
+		obj[key] = oval
+	}
+	if traits.dynamic {
+		for {
+			var key string
+			if key, next, err = self.parseString(n); err != nil {
+				err = self.err("object.key", n, err)
+				return
+			}
+			n = next
+			if key == "" {
+				break
+			}
+			var oval interface{}
+			if oval, next, err = self.parseVal(n); err != nil {
+				err = self.err("object.val", n, err)
+				return
+			}
+			n = next
+			obj[key] = oval
+		}
+	}
+	val = obj
+	_n = n
+	return
+}
+
+func (self *amf3Parser) parseArray(n int) (val interface{}, _n int, err error) {
+	var next int
+	var u uint32
+	var ok bool
+	if val, u, ok, next, err = self.parseRef(n, "array"); err != nil || !ok {
+		_n = next
+		return
+	}
+	n = next
+	count := int(u)
+
+	idx := len(self.objs)
+	self.objs = append(self.objs, nil)
+
+	var assoc AMFECMAArray
+	for {
+		var key string
+		if key, next, err = self.parseString(n); err != nil {
+			err = self.err("array.key", n, err)
+			return
+		}
+		n = next
+		if key == "" {
+			break
+		}
+		if assoc == nil {
+			assoc = AMFECMAArray{}
+			self.objs[idx] = assoc
+		}
+		var oval interface{}
+		if oval, next, err = self.parseVal(n); err != nil {
+			err = self.err("array.val", n, err)
+			return
+		}
+		n = next
+		assoc[key] = oval
+	}
+
+	if len(self.b) < n+count {
+		err = self.err("array.count", n, nil)
+		return
+	}
+	dense := make(AMFArray, count)
+	if assoc == nil {
+		self.objs[idx] = dense
+	}
+	for i := 0; i < count; i++ {
+		if dense[i], next, err = self.parseVal(n); err != nil {
+			err = self.err("array.val", n, err)
+			return
+		}
+		n = next
+	}
+
+	if assoc != nil {
+		for i, v := range dense {
+			assoc[fmt.Sprint(i)] = v
+		}
+		val = assoc
+	} else {
+		val = dense
+	}
+	_n = n
+	return
+}
+
+func (self *amf3Parser) parseVector(marker uint8, n int) (val interface{}, _n int, err error) {
+	var next int
+	var u uint32
+	var ok bool
+	if val, u, ok, next, err = self.parseRef(n, "vector"); err != nil || !ok {
+		_n = next
+		return
+	}
+	n = next
+	count := int(u)
+	// fixed-length flag
+	if len(self.b) < n+1 {
+		err = self.err("vector.fixed", n, nil)
+		return
+	}
+	n++
+
+	b := self.b
+	switch marker {
+	case amf3vectorintmarker:
+		if len(b) < n+count*4 {
+			err = self.err("vector.int", n, nil)
+			return
+		}
+		vec := make([]int32, count)
+		for i := range vec {
+			vec[i] = int32(pio.U32BE(b[n:]))
+			n += 4
+		}
+		val = vec
+
+	case amf3vectoruintmarker:
+		if len(b) < n+count*4 {
+			err = self.err("vector.uint", n, nil)
+			return
+		}
+		vec := make([]uint32, count)
+		for i := range vec {
+			vec[i] = pio.U32BE(b[n:])
+			n += 4
+		}
+		val = vec
+
+	case amf3vectordoublemarker:
+		if len(b) < n+count*8 {
+			err = self.err("vector.double", n, nil)
+			return
+		}
+		vec := make([]float64, count)
+		for i := range vec {
+			vec[i] = parseBEFloat64(b[n:])
+			n += 8
+		}
+		val = vec
+
+	case amf3vectorobjectmarker:
+		if _, next, err = self.parseString(n); err != nil {
+			err = self.err("vector.typename", n, err)
+			return
+		}
+		n = next
+		if len(b) < n+count {
+			err = self.err("vector.count", n, nil)
+			return
+		}
+		vec := make(AMFArray, count)
+		idx := len(self.objs)
+		self.objs = append(self.objs, vec)
+		for i := range vec {
+			if vec[i], next, err = self.parseVal(n); err != nil {
+				err = self.err("vector.val", n, err)
+				return
+			}
+			n = next
+		}
+		self.objs[idx] = vec
+		val = vec
+		_n = n
+		return
+	}
+
+	self.objs = append(self.objs, val)
+	_n = n
+	return
+}
+
+func (self *amf3Parser) parseVal(n int) (val interface{}, _n int, err error) {
+	var next int
+	b := self.b
+	if len(b) < n+1 {
+		err = self.err("marker", n, nil)
+		return
+	}
+	marker := b[n]
+	n++
+
+	switch marker {
+	case amf3undefinedmarker, amf3nullmarker:
+
+	case amf3falsemarker:
+		val = false
+
+	case amf3truemarker:
+		val = true
+
+	case amf3integermarker:
+		var u uint32
+		if u, next, err = self.parseU29(n); err != nil {
+			err = self.err("integer", n, err)
+			return
+		}
+		n = next
+		i := int32(u)
+		if u&0x10000000 != 0 {
+			i -= 1 << 29
+		}
+		val = float64(i)
+
+	case amf3doublemarker:
+		if len(b) < n+8 {
+			err = self.err("double", n, nil)
+			return
+		}
+		val = parseBEFloat64(b[n:])
+		n += 8
+
+	case amf3stringmarker:
+		if val, next, err = self.parseString(n); err != nil {
+			return
+		}
+		n = next
+
+	case amf3xmldocmarker, amf3xmlmarker, amf3bytearraymarker:
+		var u uint32
+		var ok bool
+		if val, u, ok, next, err = self.parseRef(n, "bytes"); err != nil {
+			return
+		}
+		n = next
+		if ok {
+			length := int(u)
+			if len(b) < n+length {
+				err = self.err("bytes.body", n, nil)
+				return
+			}
+			if marker == amf3bytearraymarker {
+				buf := make([]byte, length)
+				copy(buf, b[n:n+length])
+				val = buf
+			} else {
+				val = string(b[n : n+length])
+			}
+			n += length
+			self.objs = append(self.objs, val)
+		}
+
+	case amf3datemarker:
+		var ok bool
+		if val, _, ok, next, err = self.parseRef(n, "date"); err != nil {
+			return
+		}
+		n = next
+		if ok {
+			if len(b) < n+8 {
+				err = self.err("date", n, nil)
+				return
+			}
+			ts := parseBEFloat64(b[n:])
+			n += 8
+			val = time.Unix(int64(ts/1000), (int64(ts)%1000)*1000000)
+			self.objs = append(self.objs, val)
+		}
+
+	case amf3arraymarker:
+		if val, next, err = self.parseArray(n); err != nil {
+			return
+		}
+		n = next
+
+	case amf3objectmarker:
+		if val, next, err = self.parseObject(n); err != nil {
+			return
+		}
+		n = next
+
+	case amf3vectorintmarker, amf3vectoruintmarker, amf3vectordoublemarker, amf3vectorobjectmarker:
+		if val, next, err = self.parseVector(marker, n); err != nil {
+			return
+		}
+		n = next
+
+	default:
+		err = self.err(fmt.Sprintf("invalidmarker=%d", marker), n, nil)
+		return
+	}
+
+	_n = n
+	return
+}
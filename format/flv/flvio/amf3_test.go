@@ -0,0 +1,179 @@
+package flvio
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAMF3U29(t *testing.T) {
+	for _, c := range []struct {
+		u   uint32
+		hex string
+	}{
+		{0, "00"},
+		{0x7f, "7f"},
+		{0x80, "8100"},
+		{0x3fff, "ff7f"},
+		{0x4000, "818000"},
+		{0x1fffff, "ffff7f"},
+		{0x200000, "80c08000"},
+		{0x1fffffff, "ffffffff"},
+	} {
+		b := make([]byte, 4)
+		n := fillAMF3U29(b, c.u)
+		if n != lenAMF3U29(c.u) || hex.EncodeToString(b[:n]) != c.hex {
+			t.Fatalf("u29 %#x: got %x, want %s", c.u, b[:n], c.hex)
+		}
+		p := &amf3Parser{b: b[:n]}
+		u, pn, err := p.parseU29(0)
+		if err != nil || u != c.u || pn != n {
+			t.Fatalf("u29 %s: parsed %#x n=%d err=%v", c.hex, u, pn, err)
+		}
+	}
+}
+
+func TestAMF3KnownBytes(t *testing.T) {
+	for _, c := range []struct {
+		val  interface{}
+		hex  string
+		want interface{}
+	}{
+		{nil, "01", nil},
+		{false, "02", false},
+		{true, "03", true},
+		{1, "0401", float64(1)},
+		{-1, "04ffffffff", float64(-1)},
+		{amf3IntMax, "04bfffffff", float64(amf3IntMax)},
+		{amf3IntMin, "04c0808000", float64(amf3IntMin)},
+		{amf3IntMax + 1, "0541b0000000000000", float64(amf3IntMax + 1)},
+		{1.5, "053ff8000000000000", 1.5},
+		{"ab", "06056162", "ab"},
+		{"", "0601", ""},
+		{[]byte{1, 2}, "0c050102", []byte{1, 2}},
+		{AMFArray{1}, "0903010401", AMFArray{float64(1)}},
+		{AMFMap{"a": 1}, "0a0b0103610401" + "01", AMFMap{"a": float64(1)}},
+		{AMFECMAArray{"a": "b"}, "09010361060362" + "01", AMFECMAArray{"a": "b"}},
+		{[]int32{-1}, "0d0300ffffffff", []int32{-1}},
+		{[]uint32{1}, "0e030000000001", []uint32{1}},
+		{[]float64{2}, "0f03004000000000000000", []float64{2}},
+	} {
+		b := make([]byte, LenAMF3Val(c.val))
+		n := FillAMF3Val(b, c.val)
+		if n != len(b) || hex.EncodeToString(b) != c.hex {
+			t.Fatalf("%#v: got %x, want %s", c.val, b[:n], c.hex)
+		}
+		val, pn, err := ParseAMF3Val(b)
+		if err != nil || pn != n || !reflect.DeepEqual(val, c.want) {
+			t.Fatalf("%s: parsed %#v n=%d err=%v", c.hex, val, pn, err)
+		}
+	}
+}
+
+func TestAMF3RoundTrip(t *testing.T) {
+	date := time.Unix(1500000000, 123000000)
+	obj := AMFMap{
+		"name":  "stream",
+		"width": 1280,
+		"rate":  29.97,
+		"live":  true,
+		"tags":  AMFArray{"a", "b", nil},
+		"meta": AMFMap{
+			"bytes":  []byte{0xde, 0xad},
+			"ints":   []int32{1, -2},
+			"extra":  AMFECMAArray{"x": 1, "y": "z"},
+			"bigint": int64(1) << 40,
+		},
+		"date": date,
+	}
+	b := make([]byte, LenAMF3Val(obj))
+	n := FillAMF3Val(b, obj)
+	if n != len(b) {
+		t.Fatalf("filled %d bytes, len %d", n, len(b))
+	}
+	val, pn, err := ParseAMF3Val(b)
+	if err != nil || pn != n {
+		t.Fatalf("parsed n=%d err=%v", pn, err)
+	}
+
+	got := val.(AMFMap)
+	if d, ok := got["date"].(time.Time); !ok || !d.Equal(date) {
+		t.Fatalf("date=%v", got["date"])
+	}
+	delete(got, "date")
+	want := AMFMap{
+		"name":  "stream",
+		"width": float64(1280),
+		"rate":  29.97,
+		"live":  true,
+		"tags":  AMFArray{"a", "b", nil},
+		"meta": AMFMap{
+			"bytes":  []byte{0xde, 0xad},
+			"ints":   []int32{1, -2},
+			"extra":  AMFECMAArray{"x": float64(1), "y": "z"},
+			"bigint": float64(int64(1) << 40),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v", got)
+	}
+}
+
+func TestAMF3References(t *testing.T) {
+	b, _ := hex.DecodeString(
+		// dense array of 3
+		"090701" +
+			// sealed object of class "C" with member "name" = "x"
+			"0a13" + "0343" + "096e616d65" + "060378" +
+			// same traits, "name" = string reference 2 ("x")
+			"0a01" + "0604" +
+			// object reference 1, the first object
+			"0a02")
+	val, n, err := ParseAMF3Val(b)
+	if err != nil || n != len(b) {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	arr := val.(AMFArray)
+	want := AMFMap{"name": "x"}
+	if len(arr) != 3 || !reflect.DeepEqual(arr[0], want) || !reflect.DeepEqual(arr[1], want) {
+		t.Fatalf("got %#v", arr)
+	}
+	if reflect.ValueOf(arr[2]).Pointer() != reflect.ValueOf(arr[0]).Pointer() {
+		t.Fatalf("object reference is not the first object")
+	}
+}
+
+func TestAMF3ParseError(t *testing.T) {
+	for _, c := range []struct {
+		hex string
+		err string
+	}{
+		{"", "marker:0"},
+		{"060561", "string.body:2"},
+		{"0604", "string.ref=2:2"},
+		{"0480", "integer:1,u29:2"},
+		{"05000000", "double:1"},
+		{"0a02", "object.ref=1:2"},
+		{"0a05", "object.traits.ref=1:2"},
+		{"0a130343036106", "object.val:6,string.length:7,u29:7"},
+		{"0a0b01036104", "object.val:5,integer:6,u29:6"},
+		{"09050104", "array.count:3"},
+		{"0d0500ffffffff", "vector.int:3"},
+		{"0a07" + "0343", "object.externalizable=C:4"},
+		{"15", "invalidmarker=21:1"},
+	} {
+		b, _ := hex.DecodeString(c.hex)
+		_, _, err := ParseAMF3Val(b)
+		if err == nil || err.Error() != "amf3 parse error: "+c.err {
+			t.Fatalf("%s: err=%v, want %s", c.hex, err, c.err)
+		}
+	}
+
+	// offsets count from the start of the enclosing AMF0 data
+	b, _ := hex.DecodeString("110604")
+	_, _, err := ParseAMF0Val(b)
+	if err == nil || err.Error() != "amf0 parse error: avmplusobject(amf3 parse error: string.ref=2:3):1" {
+		t.Fatalf("err=%v", err)
+	}
+}
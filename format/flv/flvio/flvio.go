@@ -60,6 +60,22 @@ const (
 	VIDEO_H264 = 7
 )
 
+// Enhanced RTMP video packet types, valid when Tag.IsExHeader is set.
+const (
+	PKTTYPE_SEQUENCE_START         = 0
+	PKTTYPE_CODED_FRAMES           = 1
+	PKTTYPE_SEQUENCE_END           = 2
+	PKTTYPE_CODED_FRAMESX          = 3
+	PKTTYPE_METADATA               = 4
+	PKTTYPE_MPEG2TS_SEQUENCE_START = 5
+)
+
+const (
+	FOURCC_HEVC = 0x68766331 // hvc1
+	FOURCC_AV1  = 0x61763031 // av01
+	FOURCC_VP9  = 0x76703039 // vp09
+)
+
 type Tag struct {
 	Type uint8
 
@@ -147,6 +163,14 @@ type Tag struct {
 	*/
 	AVCPacketType uint8
 
+	/*
+		Enhanced RTMP: when IsExHeader is set, the low 4 bits of the first
+		byte are PacketType instead of CodecID, followed by a FourCC.
+	*/
+	IsExHeader bool
+	PacketType uint8
+	FourCC     uint32
+
 	CompositionTime int32
 
 	Data []byte
@@ -210,9 +234,31 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 		return
 	}
 	flags := b[n]
+	n++
+
+	if flags&0x80 != 0 {
+		self.IsExHeader = true
+		self.FrameType = (flags >> 4) & 0x7
+		self.PacketType = flags & 0xf
+		if len(b) < n+4 {
+			err = fmt.Errorf("videodata: parse invalid")
+			return
+		}
+		self.FourCC = pio.U32BE(b[n:])
+		n += 4
+		if self.FourCC == FOURCC_HEVC && self.PacketType == PKTTYPE_CODED_FRAMES {
+			if len(b) < n+3 {
+				err = fmt.Errorf("videodata: parse invalid")
+				return
+			}
+			self.CompositionTime = pio.I24BE(b[n:])
+			n += 3
+		}
+		return
+	}
+
 	self.FrameType = flags >> 4
 	self.CodecID = flags & 0xf
-	n++
 
 	if self.FrameType == FRAME_INTER || self.FrameType == FRAME_KEY {
 		if len(b) < n+4 {
@@ -230,6 +276,18 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 }
 
 func (self Tag) videoFillHeader(b []byte) (n int) {
+	if self.IsExHeader {
+		b[n] = 0x80 | self.FrameType<<4 | self.PacketType
+		n++
+		pio.PutU32BE(b[n:], self.FourCC)
+		n += 4
+		if self.FourCC == FOURCC_HEVC && self.PacketType == PKTTYPE_CODED_FRAMES {
+			pio.PutI24BE(b[n:], self.CompositionTime)
+			n += 3
+		}
+		return
+	}
+
 	flags := self.FrameType<<4 | self.CodecID
 	b[n] = flags
 	n++
@@ -0,0 +1,192 @@
+package flv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// HTTPHandler serves live streams as HTTP-FLV, and as WebSocket-FLV (e.g.
+// for flv.js) to WebSocket requests.
+type HTTPHandler struct {
+	// Returns the stream to send for a request, e.g. a cursor of a
+	// pubsub.Queue. A nil demuxer is responded with 404.
+	Source func(r *http.Request) av.Demuxer
+}
+
+func (self *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	src := self.Source(r)
+	if src == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ServeStream(w, r, src)
+}
+
+type readResult struct {
+	pkt av.Packet
+	err error
+}
+
+// ServeStream sends src as the response to r until src ends, writing fails
+// or the client disconnects. Each packet is flushed to the client as soon
+// as it is read. A disconnected client is noticed even while src has no
+// packets; reading src then stops at its next packet.
+func ServeStream(w http.ResponseWriter, r *http.Request, src av.Demuxer) (err error) {
+	var streams []av.CodecData
+	if streams, err = src.Streams(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var dst io.Writer
+	var flusher http.Flusher
+	var gone <-chan struct{}
+	if isWebSocket(r) {
+		var ws *wsConn
+		if ws, err = upgradeWebSocket(w, r); err != nil {
+			return
+		}
+		defer ws.Close()
+		dst = ws
+		closed := make(chan struct{})
+		gone = closed
+		go func() {
+			// clients only send control frames, reading fails once they leave
+			io.Copy(ioutil.Discard, ws)
+			close(closed)
+		}()
+	} else {
+		var ok bool
+		if flusher, ok = w.(http.Flusher); !ok {
+			err = fmt.Errorf("flv: streaming not supported")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "video/x-flv")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+		dst = w
+		gone = r.Context().Done()
+	}
+
+	bufw := bufio.NewWriterSize(dst, pio.RecommendBufioSize)
+	muxer := NewMuxerWriteFlusher(bufw)
+	flush := func() (err error) {
+		if err = bufw.Flush(); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return
+	}
+	if err = muxer.WriteHeader(streams); err != nil {
+		return
+	}
+	if err = flush(); err != nil {
+		return
+	}
+
+	pkts := make(chan readResult)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			pkt, err := src.ReadPacket()
+			select {
+			case pkts <- readResult{pkt, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case res := <-pkts:
+			if res.err != nil {
+				if res.err != io.EOF {
+					err = res.err
+				}
+				return
+			}
+			if err = muxer.WritePacket(res.pkt); err != nil {
+				return
+			}
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HTTPDemuxer reads a FLV stream from a HTTP-FLV or WebSocket-FLV server.
+type HTTPDemuxer struct {
+	*Demuxer
+	r io.ReadCloser
+}
+
+// DialHTTP opens an http://, https://, ws:// or wss:// URL with the request
+// headers, client and timeout of options. Websockets don't use the client,
+// Timeout limits their connecting and handshake.
+func DialHTTP(uri string, options avutil.HTTPOptions) (self *HTTPDemuxer, err error) {
+	var u *url.URL
+	if u, err = url.Parse(uri); err != nil {
+		return
+	}
+
+	var r io.ReadCloser
+	switch u.Scheme {
+	case "ws", "wss":
+		if r, err = dialWebSocket(u, options.Header, options.Timeout); err != nil {
+			return
+		}
+
+	case "http", "https":
+		var req *http.Request
+		if req, err = http.NewRequest("GET", uri, nil); err != nil {
+			return
+		}
+		for k, v := range options.Header {
+			req.Header[k] = v
+		}
+		var resp *http.Response
+		if resp, err = options.NewClient().Do(req); err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("flv: GET %s: %s", uri, resp.Status)
+			return
+		}
+		r = resp.Body
+
+	default:
+		err = fmt.Errorf("flv: unsupported scheme %s", u.Scheme)
+		return
+	}
+
+	self = &HTTPDemuxer{
+		Demuxer: NewDemuxer(r),
+		r:       r,
+	}
+	return
+}
+
+func (self *HTTPDemuxer) Close() error {
+	return self.r.Close()
+}
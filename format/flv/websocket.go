@@ -0,0 +1,320 @@
+package flv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 WebSocket, enough to carry an FLV byte stream in binary
+// messages.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsConn reads the payload of data messages as a byte stream and writes
+// each Write as a binary message. Pings are answered while reading.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// client frames are masked
+	client bool
+
+	wlock sync.Mutex
+
+	remain  int64 // unread payload of the current data frame
+	masked  bool
+	mask    [4]byte
+	maskpos int
+}
+
+func (self *wsConn) unmask(b []byte) {
+	if !self.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= self.mask[self.maskpos&3]
+		self.maskpos++
+	}
+}
+
+func (self *wsConn) readFrameHeader() (opcode byte, length int64, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(self.br, b[:2]); err != nil {
+		return
+	}
+	opcode = b[0] & 0xf
+	self.masked = b[1]&0x80 != 0
+	length = int64(b[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err = io.ReadFull(self.br, b[:2]); err != nil {
+			return
+		}
+		length = int64(b[0])<<8 | int64(b[1])
+	case 127:
+		if _, err = io.ReadFull(self.br, b[:8]); err != nil {
+			return
+		}
+		length = 0
+		for i := 0; i < 8; i++ {
+			length = length<<8 | int64(b[i])
+		}
+		if length < 0 {
+			err = fmt.Errorf("flv: websocket frame too long")
+			return
+		}
+	}
+	if self.masked {
+		if _, err = io.ReadFull(self.br, self.mask[:]); err != nil {
+			return
+		}
+		self.maskpos = 0
+	}
+	return
+}
+
+func (self *wsConn) Read(b []byte) (n int, err error) {
+	for self.remain == 0 {
+		var opcode byte
+		var length int64
+		if opcode, length, err = self.readFrameHeader(); err != nil {
+			return
+		}
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+			self.remain = length
+
+		case wsClose, wsPing, wsPong:
+			if length > 125 {
+				err = fmt.Errorf("flv: websocket control frame too long")
+				return
+			}
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(self.br, payload); err != nil {
+				return
+			}
+			self.unmask(payload)
+			switch opcode {
+			case wsPing:
+				if err = self.writeFrame(wsPong, payload); err != nil {
+					return
+				}
+			case wsClose:
+				self.writeFrame(wsClose, payload)
+				err = io.EOF
+				return
+			}
+
+		default:
+			err = fmt.Errorf("flv: websocket opcode=%d invalid", opcode)
+			return
+		}
+	}
+
+	if int64(len(b)) > self.remain {
+		b = b[:self.remain]
+	}
+	n, err = self.br.Read(b)
+	self.unmask(b[:n])
+	self.remain -= int64(n)
+	return
+}
+
+func (self *wsConn) writeFrame(opcode byte, payload []byte) (err error) {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	n := len(payload)
+	b := make([]byte, 0, 14+n)
+	b = append(b, 0x80|opcode)
+	var maskbit byte
+	if self.client {
+		maskbit = 0x80
+	}
+	switch {
+	case n < 126:
+		b = append(b, maskbit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskbit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, maskbit|127)
+		for i := 7; i >= 0; i-- {
+			b = append(b, byte(uint64(n)>>(uint(i)*8)))
+		}
+	}
+	if self.client {
+		var mask [4]byte
+		if _, err = rand.Read(mask[:]); err != nil {
+			return
+		}
+		b = append(b, mask[:]...)
+		for i, c := range payload {
+			b = append(b, c^mask[i&3])
+		}
+	} else {
+		b = append(b, payload...)
+	}
+	_, err = self.conn.Write(b)
+	return
+}
+
+func (self *wsConn) Write(b []byte) (n int, err error) {
+	if err = self.writeFrame(wsBinary, b); err != nil {
+		return
+	}
+	n = len(b)
+	return
+}
+
+func (self *wsConn) Close() (err error) {
+	// 1000 normal closure
+	self.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return self.conn.Close()
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (ws *wsConn, err error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		err = fmt.Errorf("flv: bad websocket handshake")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err = fmt.Errorf("flv: websocket not supported")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var conn net.Conn
+	var brw *bufio.ReadWriter
+	if conn, brw, err = hijacker.Hijack(); err != nil {
+		return
+	}
+	// server read and write timeouts do not apply to the stream
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(brw, "Upgrade: websocket\r\n")
+	fmt.Fprintf(brw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(brw, "Sec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err = brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	ws = &wsConn{
+		conn: conn,
+		br:   brw.Reader,
+	}
+	return
+}
+
+// dialWebSocket connects to u, timeout limits connecting and the handshake
+// if not 0.
+func dialWebSocket(u *url.URL, header http.Header, timeout time.Duration) (ws *wsConn, err error) {
+	host := u.Host
+	if _, _, e := net.SplitHostPort(host); e != nil {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if u.Scheme == "wss" {
+		hostname, _, _ := net.SplitHostPort(host)
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: hostname})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var keyb [16]byte
+	if _, err = rand.Read(keyb[:]); err != nil {
+		conn.Close()
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(keyb[:])
+
+	var req *http.Request
+	if req, err = http.NewRequest("GET", "http://"+u.Host+u.RequestURI(), nil); err != nil {
+		conn.Close()
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	var resp *http.Response
+	if resp, err = http.ReadResponse(br, req); err != nil {
+		conn.Close()
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		err = fmt.Errorf("flv: websocket handshake with %s failed: %s", u.Host, resp.Status)
+		return
+	}
+	// reading the stream is not limited
+	conn.SetDeadline(time.Time{})
+	ws = &wsConn{
+		conn:   conn,
+		br:     br,
+		client: true,
+	}
+	return
+}
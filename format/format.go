@@ -7,6 +7,7 @@ import (
 	"github.com/nareix/joy4/format/rtsp"
 	"github.com/nareix/joy4/format/flv"
 	"github.com/nareix/joy4/format/aac"
+	"github.com/nareix/joy4/format/hls"
 	"github.com/nareix/joy4/av/avutil"
 )
 
@@ -17,5 +18,6 @@ func RegisterAll() {
 	avutil.DefaultHandlers.Add(rtsp.Handler)
 	avutil.DefaultHandlers.Add(flv.Handler)
 	avutil.DefaultHandlers.Add(aac.Handler)
+	avutil.DefaultHandlers.Add(hls.Handler)
 }
 
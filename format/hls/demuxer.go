@@ -0,0 +1,444 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/nareix/joy4/format/ts"
+)
+
+// DefaultFetch gets uri with http.Get, statuses other than 200 are errors.
+func DefaultFetch(uri string) (body io.ReadCloser, err error) {
+	return fetchHTTP(http.DefaultClient, nil, uri)
+}
+
+// HTTPFetch returns a Fetch like DefaultFetch that uses the client, timeout
+// and headers of options.
+func HTTPFetch(options avutil.HTTPOptions) func(uri string) (body io.ReadCloser, err error) {
+	client := options.NewClient()
+	return func(uri string) (body io.ReadCloser, err error) {
+		return fetchHTTP(client, options.Header, uri)
+	}
+}
+
+func fetchHTTP(client *http.Client, header http.Header, uri string) (body io.ReadCloser, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest("GET", uri, nil); err != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	var resp *http.Response
+	if resp, err = client.Do(req); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("hls: GET %s: %s", uri, resp.Status)
+		return
+	}
+	body = resp.Body
+	return
+}
+
+// Demuxer reads a HLS stream from a master or media playlist URL.
+//
+// It follows live playlists until EXT-X-ENDLIST, and rebases timestamps at
+// discontinuities so packet times keep increasing and start at zero.
+// Codec changes between segments are signaled with Packet.NewCodecData.
+type Demuxer struct {
+	// Picks a variant of a master playlist, the highest bandwidth one by
+	// default.
+	SelectVariant func(variants []Variant) int
+	// Gets playlists and segments, DefaultFetch by default.
+	Fetch func(uri string) (body io.ReadCloser, err error)
+	// Live streams start this many segments before the end, 3 by default.
+	// Values below 1 start at the last segment.
+	LiveStartSegments int
+
+	uri      string
+	url      *url.URL
+	playlist *Playlist
+	nextseq  int
+
+	streams []av.CodecData
+	changed []bool
+	demuxer av.Demuxer
+	mapuri  string
+	mapdata []byte
+
+	resync   bool
+	offset   time.Duration
+	lasttime time.Duration
+	last     []time.Duration
+	lastdur  []time.Duration
+	gotpkt   []bool
+
+	lock    sync.Mutex
+	body    io.ReadCloser
+	closed  bool
+	closing chan struct{}
+}
+
+// NewDemuxer returns a demuxer for the playlist at uri, nothing is fetched
+// before the first Streams or ReadPacket call.
+func NewDemuxer(uri string) *Demuxer {
+	return &Demuxer{
+		uri:               uri,
+		LiveStartSegments: 3,
+		resync:            true,
+		closing:           make(chan struct{}),
+	}
+}
+
+func (self *Demuxer) fetch(uri string) (body io.ReadCloser, err error) {
+	if self.Fetch != nil {
+		return self.Fetch(uri)
+	}
+	return DefaultFetch(uri)
+}
+
+func (self *Demuxer) fetchAll(uri string) (data []byte, err error) {
+	var body io.ReadCloser
+	if body, err = self.fetch(uri); err != nil {
+		return
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func (self *Demuxer) resolve(uri string) (s string, err error) {
+	var ref *url.URL
+	if ref, err = url.Parse(uri); err != nil {
+		return
+	}
+	s = self.url.ResolveReference(ref).String()
+	return
+}
+
+func (self *Demuxer) selectVariant(variants []Variant) int {
+	if self.SelectVariant != nil {
+		return self.SelectVariant(variants)
+	}
+	best := 0
+	for i, variant := range variants {
+		if variant.Bandwidth > variants[best].Bandwidth {
+			best = i
+		}
+	}
+	return best
+}
+
+func (self *Demuxer) reload() (err error) {
+	var data []byte
+	if data, err = self.fetchAll(self.url.String()); err != nil {
+		return
+	}
+	var playlist *Playlist
+	if playlist, err = ParsePlaylist(data); err != nil {
+		return
+	}
+	if playlist.Master {
+		err = fmt.Errorf("hls: %s is not a media playlist", self.url)
+		return
+	}
+	self.playlist = playlist
+	return
+}
+
+func (self *Demuxer) load() (err error) {
+	if self.url, err = url.Parse(self.uri); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = self.fetchAll(self.uri); err != nil {
+		return
+	}
+	var playlist *Playlist
+	if playlist, err = ParsePlaylist(data); err != nil {
+		return
+	}
+
+	if playlist.Master {
+		if len(playlist.Variants) == 0 {
+			err = fmt.Errorf("hls: no variant in master playlist")
+			return
+		}
+		i := self.selectVariant(playlist.Variants)
+		if i < 0 || i >= len(playlist.Variants) {
+			err = fmt.Errorf("hls: variant#%d not found", i)
+			return
+		}
+		var uri string
+		if uri, err = self.resolve(playlist.Variants[i].URI); err != nil {
+			return
+		}
+		if self.url, err = url.Parse(uri); err != nil {
+			return
+		}
+		if err = self.reload(); err != nil {
+			return
+		}
+	} else {
+		self.playlist = playlist
+	}
+
+	segs := self.playlist.Segments
+	start := self.LiveStartSegments
+	if start < 1 {
+		start = 1
+	}
+	if len(segs) == 0 {
+		self.nextseq = self.playlist.MediaSequence
+	} else if self.playlist.EndList || len(segs) <= start {
+		self.nextseq = segs[0].Seq
+	} else {
+		self.nextseq = segs[len(segs)-start].Seq
+	}
+	return
+}
+
+// wait sleeps before the next playlist reload, returns false if the
+// demuxer was closed meanwhile.
+func (self *Demuxer) wait() bool {
+	dur := self.playlist.TargetDuration / 2
+	if dur <= 0 {
+		dur = time.Second
+	}
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-self.closing:
+		return false
+	}
+}
+
+func (self *Demuxer) nextSegment() (err error) {
+	for {
+		for _, seg := range self.playlist.Segments {
+			if seg.Seq < self.nextseq {
+				continue
+			}
+			// fell behind a live playlist
+			if seg.Seq > self.nextseq {
+				self.resync = true
+			}
+			self.nextseq = seg.Seq + 1
+			return self.openSegment(seg)
+		}
+		if self.playlist.EndList || !self.wait() {
+			err = io.EOF
+			return
+		}
+		if err = self.reload(); err != nil {
+			return
+		}
+	}
+}
+
+func (self *Demuxer) setBody(body io.ReadCloser) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.body != nil {
+		self.body.Close()
+	}
+	self.body = body
+	if self.closed {
+		err = io.EOF
+	}
+	return
+}
+
+func (self *Demuxer) openSegment(seg MediaSegment) (err error) {
+	var uri string
+	if uri, err = self.resolve(seg.URI); err != nil {
+		return
+	}
+
+	if seg.Map != "" {
+		if err = self.setBody(nil); err != nil {
+			return
+		}
+		if seg.Map != self.mapuri {
+			var mapuri string
+			if mapuri, err = self.resolve(seg.Map); err != nil {
+				return
+			}
+			if self.mapdata, err = self.fetchAll(mapuri); err != nil {
+				return
+			}
+			self.mapuri = seg.Map
+		}
+		var data []byte
+		if data, err = self.fetchAll(uri); err != nil {
+			return
+		}
+		b := append(append([]byte{}, self.mapdata...), data...)
+		self.demuxer = mp4.NewDemuxer(bytes.NewReader(b))
+	} else {
+		var body io.ReadCloser
+		if body, err = self.fetch(uri); err != nil {
+			return
+		}
+		if err = self.setBody(body); err != nil {
+			return
+		}
+		self.demuxer = ts.NewDemuxer(body)
+	}
+
+	var streams []av.CodecData
+	if streams, err = self.demuxer.Streams(); err != nil {
+		return
+	}
+	if self.streams == nil {
+		self.streams = streams
+		self.changed = make([]bool, len(streams))
+		self.last = make([]time.Duration, len(streams))
+		self.lastdur = make([]time.Duration, len(streams))
+		self.gotpkt = make([]bool, len(streams))
+	} else {
+		if len(streams) != len(self.streams) {
+			err = fmt.Errorf("hls: number of streams changed from %d to %d", len(self.streams), len(streams))
+			return
+		}
+		for i := range streams {
+			if !reflect.DeepEqual(streams[i], self.streams[i]) {
+				self.streams = append([]av.CodecData{}, self.streams...)
+				self.streams[i] = streams[i]
+				self.changed[i] = true
+			}
+		}
+	}
+
+	if seg.Discontinuity {
+		self.resync = true
+	}
+	return
+}
+
+func (self *Demuxer) probe() (err error) {
+	if self.streams != nil {
+		return
+	}
+	if self.playlist == nil {
+		if err = self.load(); err != nil {
+			return
+		}
+	}
+	return self.nextSegment()
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	streams = self.streams
+	return
+}
+
+// fixTime maps segment timestamps to the output timeline.
+func (self *Demuxer) fixTime(pkt *av.Packet) {
+	tm := pkt.Time + self.offset
+	// also catches timestamp jumps without EXT-X-DISCONTINUITY
+	maxjump := self.playlist.TargetDuration*2 + time.Second
+	if self.resync || tm+time.Second < self.lasttime || tm > self.lasttime+maxjump {
+		// continue right after the latest packet
+		var next time.Duration
+		for i := range self.last {
+			if self.gotpkt[i] && self.last[i]+self.lastdur[i] > next {
+				next = self.last[i] + self.lastdur[i]
+			}
+		}
+		self.offset = next - pkt.Time
+		tm = next
+		self.resync = false
+	}
+
+	i := pkt.Idx
+	if self.gotpkt[i] {
+		if tm < self.last[i] {
+			tm = self.last[i]
+		}
+		if tm > self.last[i] {
+			self.lastdur[i] = tm - self.last[i]
+		}
+	} else if tm < 0 {
+		tm = 0
+	}
+	self.gotpkt[i] = true
+	self.last[i] = tm
+	if tm > self.lasttime {
+		self.lasttime = tm
+	}
+	pkt.Time = tm
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for {
+		if pkt, err = self.demuxer.ReadPacket(); err == nil {
+			break
+		}
+		if err != io.EOF {
+			if self.isClosed() {
+				err = io.EOF
+			}
+			return
+		}
+		if err = self.nextSegment(); err != nil {
+			return
+		}
+	}
+	if int(pkt.Idx) >= len(self.streams) {
+		err = fmt.Errorf("hls: stream#%d not found", pkt.Idx)
+		return
+	}
+
+	self.fixTime(&pkt)
+	if pkt.NewCodecData != nil {
+		// changed within the segment
+		self.streams = append([]av.CodecData{}, self.streams...)
+		self.streams[pkt.Idx] = pkt.NewCodecData
+		self.changed[pkt.Idx] = false
+	} else if self.changed[pkt.Idx] {
+		pkt.NewCodecData = self.streams[pkt.Idx]
+		self.changed[pkt.Idx] = false
+	}
+	return
+}
+
+func (self *Demuxer) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
+}
+
+// Close stops reading, a blocked ReadPacket returns io.EOF.
+func (self *Demuxer) Close() (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
+	close(self.closing)
+	if self.body != nil {
+		err = self.body.Close()
+	}
+	return
+}
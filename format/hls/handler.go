@@ -0,0 +1,27 @@
+package hls
+
+import (
+	"net/url"
+	"path"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+)
+
+func Handler(h *avutil.RegisterHandler) {
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		u, _ := url.Parse(uri)
+		if u == nil || (u.Scheme != "http" && u.Scheme != "https") || path.Ext(u.Path) != ".m3u8" {
+			return
+		}
+		ok = true
+		handlers := h.Handlers
+		if handlers == nil {
+			handlers = avutil.DefaultHandlers
+		}
+		d := NewDemuxer(uri)
+		d.Fetch = HTTPFetch(handlers.HTTP)
+		demuxer = d
+		return
+	}
+}
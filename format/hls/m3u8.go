@@ -0,0 +1,170 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Variant is a stream of a master playlist.
+type Variant struct {
+	URI        string
+	Bandwidth  int
+	Resolution string
+	Codecs     string
+}
+
+// MediaSegment is a segment listed in a media playlist.
+type MediaSegment struct {
+	Seq      int
+	URI      string
+	Duration time.Duration
+	// timestamps and codecs may change from the previous segment
+	Discontinuity bool
+	// init section of fMP4 segments
+	Map string
+}
+
+// Playlist is a parsed master or media playlist. URIs are kept as written,
+// relative to the playlist.
+type Playlist struct {
+	// a master playlist only has Variants
+	Master   bool
+	Variants []Variant
+
+	TargetDuration time.Duration
+	MediaSequence  int
+	Segments       []MediaSegment
+	EndList        bool
+}
+
+// parseAttrs parses an attribute list like BANDWIDTH=1280000,CODECS="a,b".
+func parseAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+
+		var val string
+		quoted := strings.HasPrefix(s, "\"")
+		if quoted {
+			s = s[1:]
+			end := strings.IndexByte(s, '"')
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = s[:end], s[end:]
+		}
+		comma := strings.IndexByte(s, ',')
+		if comma < 0 {
+			comma = len(s)
+		}
+		if !quoted {
+			val = s[:comma]
+		}
+		attrs[key] = val
+		if comma < len(s) {
+			s = s[comma+1:]
+		} else {
+			s = ""
+		}
+	}
+	return attrs
+}
+
+func parseSeconds(s string) time.Duration {
+	f, _ := strconv.ParseFloat(s, 64)
+	return time.Duration(f * float64(time.Second))
+}
+
+// ParsePlaylist parses a m3u8 master or media playlist.
+func ParsePlaylist(data []byte) (playlist *Playlist, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		err = fmt.Errorf("hls: invalid playlist, no #EXTM3U")
+		return
+	}
+
+	playlist = &Playlist{}
+	var variant *Variant
+	seg := MediaSegment{}
+	gotinf := false
+	maptag := ""
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			if variant != nil {
+				variant.URI = line
+				playlist.Variants = append(playlist.Variants, *variant)
+				variant = nil
+			} else if gotinf {
+				seg.Seq = playlist.MediaSequence + len(playlist.Segments)
+				seg.URI = line
+				seg.Map = maptag
+				playlist.Segments = append(playlist.Segments, seg)
+				seg = MediaSegment{}
+				gotinf = false
+			}
+			continue
+		}
+
+		tag, value := line, ""
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			tag, value = line[:colon], line[colon+1:]
+		}
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			attrs := parseAttrs(value)
+			variant = &Variant{
+				Resolution: attrs["RESOLUTION"],
+				Codecs:     attrs["CODECS"],
+			}
+			variant.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+			playlist.Master = true
+
+		case "#EXT-X-TARGETDURATION":
+			playlist.TargetDuration = parseSeconds(value)
+
+		case "#EXT-X-MEDIA-SEQUENCE":
+			if playlist.MediaSequence, err = strconv.Atoi(value); err != nil {
+				err = fmt.Errorf("hls: invalid media sequence %q", value)
+				return
+			}
+
+		case "#EXTINF":
+			if comma := strings.IndexByte(value, ','); comma >= 0 {
+				value = value[:comma]
+			}
+			seg.Duration = parseSeconds(value)
+			gotinf = true
+
+		case "#EXT-X-DISCONTINUITY":
+			seg.Discontinuity = true
+
+		case "#EXT-X-MAP":
+			maptag = parseAttrs(value)["URI"]
+
+		case "#EXT-X-KEY":
+			if method := parseAttrs(value)["METHOD"]; method != "NONE" {
+				err = fmt.Errorf("hls: encryption method=%s is not supported", method)
+				return
+			}
+
+		case "#EXT-X-ENDLIST":
+			playlist.EndList = true
+		}
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,489 @@
+// Package hls implements a live HTTP Live Streaming segmenter and server.
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/nareix/joy4/format/ts"
+)
+
+var CodecTypes = ts.CodecTypes
+
+var errTooFar = fmt.Errorf("hls: requested segment is too far in the future")
+var errTimeout = fmt.Errorf("hls: timeout waiting for segment")
+
+type Segment struct {
+	Seq      int
+	Duration time.Duration
+	Data     []byte
+	// partial segments, only when Muxer.PartDuration is set. Data is the
+	// concatenation of their data.
+	Parts []*Part
+
+	ext string
+}
+
+func (self *Segment) Name() string {
+	return fmt.Sprintf("%d%s", self.Seq, self.ext)
+}
+
+// Part is a partial segment of Low-Latency HLS.
+type Part struct {
+	Seq      int
+	Index    int
+	Duration time.Duration
+	// contains a keyframe
+	Independent bool
+	Data        []byte
+
+	ext string
+}
+
+func (self *Part) Name() string {
+	return fmt.Sprintf("%d.%d%s", self.Seq, self.Index, self.ext)
+}
+
+// Muxer cuts MPEG-TS or fMP4 output into segments on keyframe boundaries
+// and keeps a sliding window of the most recent ones.
+//
+// With PartDuration set it also serves Low-Latency HLS: segments are made
+// of partial segments listed in the playlist as soon as they are cut, and
+// ServeHTTP supports blocking playlist reload and preload hints.
+//
+// Muxer is an av.Muxer, so the usual way to feed it is
+// avutil.CopyFile(muxer, que.Oldest()).
+type Muxer struct {
+	// Segments are cut at the first keyframe after TargetDuration.
+	TargetDuration time.Duration
+	// Number of segments listed in the playlist.
+	PlaylistSize int
+	// Partial segments are cut at the first packet after PartDuration,
+	// 0 disables Low-Latency HLS. Should be a multiple of the frame
+	// duration, e.g. 200ms at 25fps.
+	PartDuration time.Duration
+	// Write fMP4 segments with an init section instead of MPEG-TS. Codec
+	// data changes mid-stream are only handled for MPEG-TS.
+	Fragmented bool
+
+	lock   *sync.RWMutex
+	cond   *sync.Cond
+	closed bool
+
+	streams  []av.CodecData
+	videoidx int
+
+	segs            []*Segment
+	cur             *Segment
+	seq             int
+	maxduration     time.Duration
+	maxpartduration time.Duration
+	init            []byte
+
+	tsmux     *ts.Muxer
+	fragmux   *mp4.FragMuxer
+	buf       *bytes.Buffer
+	started   bool
+	segstart  time.Duration
+	lasttime  time.Duration
+	partstart time.Duration
+	partoff   int
+	partindep bool
+}
+
+func NewMuxer() *Muxer {
+	self := &Muxer{
+		TargetDuration: time.Second * 4,
+		PlaylistSize:   6,
+	}
+	self.lock = &sync.RWMutex{}
+	self.cond = sync.NewCond(self.lock.RLocker())
+	return self
+}
+
+func (self *Muxer) ext() string {
+	if self.Fragmented {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	codecTypes := CodecTypes
+	if self.Fragmented {
+		codecTypes = mp4.CodecTypes
+	}
+	for _, stream := range streams {
+		ok := false
+		for _, typ := range codecTypes {
+			if stream.Type() == typ {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			err = fmt.Errorf("hls: codec type=%s is not supported", stream.Type())
+			return
+		}
+	}
+
+	self.streams = streams
+	self.videoidx = -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			self.videoidx = i
+		}
+	}
+	self.buf = &bytes.Buffer{}
+	if self.Fragmented {
+		self.fragmux = mp4.NewFragMuxer(self.buf)
+		// fragments are only cut by FlushFragment
+		self.fragmux.FragmentDuration = time.Duration(math.MaxInt64)
+		if err = self.fragmux.WriteHeader(streams); err != nil {
+			return
+		}
+		self.lock.Lock()
+		self.init = self.buf.Bytes()
+		self.lock.Unlock()
+	} else {
+		self.tsmux = ts.NewMuxer(self.buf)
+	}
+	self.started = false
+	return
+}
+
+func (self *Muxer) newSegment(start time.Duration) (err error) {
+	self.buf = &bytes.Buffer{}
+	if self.Fragmented {
+		self.fragmux.SetWriter(self.buf)
+	} else {
+		self.tsmux.SetWriter(self.buf)
+		if err = self.tsmux.WriteHeader(self.streams); err != nil {
+			return
+		}
+	}
+	self.segstart = start
+	self.partstart = start
+	self.partoff = 0
+	self.partindep = false
+
+	self.lock.Lock()
+	self.cur = &Segment{Seq: self.seq, ext: self.ext()}
+	self.lock.Unlock()
+	return
+}
+
+// flushPart ends the current partial segment. Nothing is cut until the
+// part has some data.
+func (self *Muxer) flushPart(end time.Duration) (err error) {
+	if self.Fragmented {
+		if err = self.fragmux.FlushFragment(); err != nil {
+			return
+		}
+	}
+	if self.buf.Len() == self.partoff {
+		return
+	}
+
+	// later writes only append to buf, the part data stays untouched
+	part := &Part{
+		Seq:         self.cur.Seq,
+		Duration:    end - self.partstart,
+		Independent: self.partindep,
+		Data:        self.buf.Bytes()[self.partoff:],
+		ext:         self.ext(),
+	}
+	self.partoff = self.buf.Len()
+	self.partstart = end
+	self.partindep = false
+
+	self.lock.Lock()
+	part.Index = len(self.cur.Parts)
+	self.cur.Parts = append(self.cur.Parts, part)
+	if part.Duration > self.maxpartduration {
+		self.maxpartduration = part.Duration
+	}
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	return
+}
+
+func (self *Muxer) flushSegment(end time.Duration) (err error) {
+	if self.PartDuration > 0 {
+		if err = self.flushPart(end); err != nil {
+			return
+		}
+	} else if self.Fragmented {
+		if err = self.fragmux.FlushFragment(); err != nil {
+			return
+		}
+	}
+
+	self.lock.Lock()
+	seg := self.cur
+	seg.Duration = end - self.segstart
+	seg.Data = self.buf.Bytes()
+	self.cur = nil
+	self.seq++
+	self.segs = append(self.segs, seg)
+	// keep a few segments past the window for clients still fetching them
+	if n := len(self.segs) - self.PlaylistSize - 2; n > 0 {
+		self.segs = self.segs[n:]
+	}
+	if seg.Duration > self.maxduration {
+		self.maxduration = seg.Duration
+	}
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	return
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if pkt.IsScriptData {
+		return
+	}
+	if pkt.NewCodecData != nil {
+		// later segments start with the new codec data
+		streams := append([]av.CodecData{}, self.streams...)
+		streams[pkt.Idx] = pkt.NewCodecData
+		self.streams = streams
+	}
+	iskey := pkt.IsKeyFrame && int(pkt.Idx) == self.videoidx
+	// audio only streams can be cut anywhere
+	cutable := iskey || self.videoidx == -1
+
+	if !self.started {
+		if !cutable {
+			return
+		}
+		if err = self.newSegment(pkt.Time); err != nil {
+			return
+		}
+		self.started = true
+	}
+
+	// FragMuxer keeps the packet until the next one of its stream, so with
+	// fMP4 it is written before the cut and still starts the next part
+	if self.Fragmented {
+		if err = self.fragmux.WritePacket(pkt); err != nil {
+			return
+		}
+	}
+	if cutable && pkt.Time-self.segstart >= self.TargetDuration {
+		if err = self.flushSegment(pkt.Time); err != nil {
+			return
+		}
+		if err = self.newSegment(pkt.Time); err != nil {
+			return
+		}
+	} else if self.PartDuration > 0 && pkt.Time-self.partstart >= self.PartDuration {
+		if err = self.flushPart(pkt.Time); err != nil {
+			return
+		}
+	}
+	if !self.Fragmented {
+		if err = self.tsmux.WritePacket(pkt); err != nil {
+			return
+		}
+	}
+
+	if cutable {
+		self.partindep = true
+	}
+	self.lasttime = pkt.Time
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	if self.started {
+		if self.Fragmented {
+			err = self.fragmux.WriteTrailer()
+		} else {
+			err = self.tsmux.WriteTrailer()
+		}
+		if err != nil {
+			return
+		}
+		if err = self.flushSegment(self.lasttime); err != nil {
+			return
+		}
+		self.started = false
+	}
+	self.lock.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	return
+}
+
+// Init returns the fMP4 init section, or nil for MPEG-TS.
+func (self *Muxer) Init() []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.init
+}
+
+// Segment returns a segment still inside the sliding window.
+func (self *Muxer) Segment(seq int) (seg *Segment) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, s := range self.segs {
+		if s.Seq == seq {
+			return s
+		}
+	}
+	return
+}
+
+// Part returns a partial segment of a segment still inside the sliding
+// window or of the one being written.
+func (self *Muxer) Part(seq int, index int) *Part {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	segs := self.segs
+	if self.cur != nil {
+		segs = append(segs[:len(segs):len(segs)], self.cur)
+	}
+	for _, seg := range segs {
+		if seg.Seq == seq && index >= 0 && index < len(seg.Parts) {
+			return seg.Parts[index]
+		}
+	}
+	return nil
+}
+
+// hasPart must be called with lock held. A negative index asks for the
+// whole segment.
+func (self *Muxer) hasPart(seq int, index int) bool {
+	if seq < self.seq {
+		return true
+	}
+	return index >= 0 && self.cur != nil && self.cur.Seq == seq && index < len(self.cur.Parts)
+}
+
+// waitPart blocks until part index of segment seq is ready, for at most
+// three target durations.
+func (self *Muxer) waitPart(seq int, index int) (err error) {
+	self.lock.RLock()
+	timeout := time.Duration(self.targetDuration()) * time.Second * 3
+	toofar := seq > self.seq+2
+	self.lock.RUnlock()
+	if toofar {
+		err = errTooFar
+		return
+	}
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		self.lock.Lock()
+		expired = true
+		self.cond.Broadcast()
+		self.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for !self.hasPart(seq, index) && !self.closed {
+		if expired {
+			err = errTimeout
+			return
+		}
+		self.cond.Wait()
+	}
+	return
+}
+
+func (self *Muxer) targetDuration() int {
+	dur := self.TargetDuration
+	if self.maxduration > dur {
+		dur = self.maxduration
+	}
+	return int(math.Ceil(dur.Seconds()))
+}
+
+func (self *Muxer) partTarget() time.Duration {
+	dur := self.PartDuration
+	if self.maxpartduration > dur {
+		dur = self.maxpartduration
+	}
+	return dur
+}
+
+func writeParts(b *bytes.Buffer, parts []*Part) {
+	for _, part := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration.Seconds(), part.Name())
+		if part.Independent {
+			fmt.Fprintf(b, ",INDEPENDENT=YES")
+		}
+		fmt.Fprintf(b, "\n")
+	}
+}
+
+// Playlist returns the current media playlist, or nil if no segment is ready yet.
+func (self *Muxer) Playlist() []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	lowlatency := self.PartDuration > 0
+	cur := self.cur
+	if !lowlatency || (cur != nil && len(cur.Parts) == 0) {
+		cur = nil
+	}
+	if len(self.segs) == 0 && cur == nil {
+		return nil
+	}
+	segs := self.segs
+	if n := len(segs) - self.PlaylistSize; n > 0 {
+		segs = segs[n:]
+	}
+	seq := self.seq
+	if len(segs) > 0 {
+		seq = segs[0].Seq
+	}
+
+	version := 3
+	if self.Fragmented || lowlatency {
+		version = 6
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "#EXTM3U\n")
+	fmt.Fprintf(b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", self.targetDuration())
+	if lowlatency {
+		parttarget := self.partTarget()
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (parttarget * 3).Seconds())
+		fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", parttarget.Seconds())
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+	if self.Fragmented {
+		fmt.Fprintf(b, "#EXT-X-MAP:URI=\"init.mp4\"\n")
+	}
+	for _, seg := range segs {
+		// parts are only listed close to the live edge
+		if seg.Seq >= self.seq-2 {
+			writeParts(b, seg.Parts)
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", seg.Duration.Seconds())
+		fmt.Fprintf(b, "%s\n", seg.Name())
+	}
+	if cur != nil {
+		writeParts(b, cur.Parts)
+	}
+	if self.closed {
+		fmt.Fprintf(b, "#EXT-X-ENDLIST\n")
+	} else if lowlatency {
+		hint := &Part{Seq: self.seq, ext: self.ext()}
+		if self.cur != nil {
+			hint.Index = len(self.cur.Parts)
+		}
+		fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", hint.Name())
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,117 @@
+package hls
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parseName parses <seq><ext> and <seq>.<part><ext>, part is -1 for the
+// former.
+func parseName(name string, ext string) (seq int, part int, ok bool) {
+	if !strings.HasSuffix(name, ext) {
+		return
+	}
+	s := strings.Split(strings.TrimSuffix(name, ext), ".")
+	part = -1
+	var err error
+	switch len(s) {
+	case 2:
+		if part, err = strconv.Atoi(s[1]); err != nil {
+			return
+		}
+		fallthrough
+	case 1:
+		if seq, err = strconv.Atoi(s[0]); err != nil {
+			return
+		}
+		ok = true
+	}
+	return
+}
+
+// ServeHTTP serves the playlist for any path ending in .m3u8 and segments
+// as <seq>.ts relative to it, so the muxer can be mounted under any prefix.
+//
+// With PartDuration set, partial segments are served as <seq>.<part>.ts.
+// Playlist requests with _HLS_msn (and _HLS_part) wait until that segment
+// (or part) is ready, as do requests for the part in the preload hint.
+// fMP4 segments end in .m4s and the init section is init.mp4.
+func (self *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	contentType := "video/mp2t"
+	if self.Fragmented {
+		contentType = "video/mp4"
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".m3u8"):
+		query := r.URL.Query()
+		if msn := query.Get("_HLS_msn"); msn != "" && self.PartDuration > 0 {
+			seq, err := strconv.Atoi(msn)
+			part := -1
+			if err == nil && query.Get("_HLS_part") != "" {
+				part, err = strconv.Atoi(query.Get("_HLS_part"))
+			}
+			if err == nil {
+				err = self.waitPart(seq, part)
+			}
+			if err != nil {
+				status := http.StatusBadRequest
+				if err == errTimeout {
+					status = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+		b := self.Playlist()
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(b)
+
+	case name == "init.mp4":
+		b := self.Init()
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(b)
+
+	default:
+		seq, index, ok := parseName(name, self.ext())
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var data []byte
+		if index >= 0 {
+			part := self.Part(seq, index)
+			if part == nil && self.waitPart(seq, index) == nil {
+				part = self.Part(seq, index)
+			}
+			if part != nil {
+				data = part.Data
+			}
+		} else if seg := self.Segment(seq); seg != nil {
+			data = seg.Data
+		}
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(data)
+	}
+}
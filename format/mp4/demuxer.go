@@ -9,6 +9,7 @@ import (
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"github.com/nareix/joy4/format/mp4/mp4io"
 )
 
@@ -16,6 +17,11 @@ type Demuxer struct {
 	r         io.ReadSeeker
 	streams   []*Stream
 	movieAtom *mp4io.Movie
+
+	// samples live in moof atoms following moov
+	fragmented bool
+	fragPos    int64
+	fragEOF    bool
 }
 
 func NewDemuxer(r io.ReadSeeker) *Demuxer {
@@ -50,24 +56,27 @@ func (self *Demuxer) probe() (err error) {
 	}
 
 	var moov *mp4io.Movie
-	var atoms []mp4io.Atom
 
-	if atoms, err = mp4io.ReadFileAtoms(self.r); err != nil {
-		return
-	}
 	if _, err = self.r.Seek(0, 0); err != nil {
 		return
 	}
-
-	for _, atom := range atoms {
+	for moov == nil {
+		var atom mp4io.Atom
+		if atom, err = mp4io.ReadFileAtom(self.r); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("mp4: 'moov' atom not found")
+			}
+			return
+		}
 		if atom.Tag() == mp4io.MOOV {
 			moov = atom.(*mp4io.Movie)
 		}
 	}
-
-	if moov == nil {
-		err = fmt.Errorf("mp4: 'moov' atom not found")
-		return
+	if moov.MovieExtend != nil {
+		self.fragmented = true
+		if self.fragPos, err = self.r.Seek(0, 1); err != nil {
+			return
+		}
 	}
 
 	self.streams = []*Stream{}
@@ -80,16 +89,31 @@ func (self *Demuxer) probe() (err error) {
 		if atrack.Media != nil && atrack.Media.Info != nil && atrack.Media.Info.Sample != nil {
 			stream.sample = atrack.Media.Info.Sample
 			stream.timeScale = int64(atrack.Media.Header.TimeScale)
+		} else if self.fragmented && atrack.Media != nil && atrack.Media.Header != nil {
+			stream.timeScale = int64(atrack.Media.Header.TimeScale)
 		} else {
 			err = fmt.Errorf("mp4: sample table not found")
 			return
 		}
 
+		if moov.MovieExtend != nil && atrack.Header != nil {
+			for _, trex := range moov.MovieExtend.Tracks {
+				if trex.TrackId == uint32(atrack.Header.TrackId) {
+					stream.trex = trex
+				}
+			}
+		}
+
 		if avc1 := atrack.GetAVC1Conf(); avc1 != nil {
 			if stream.CodecData, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(avc1.Data); err != nil {
 				return
 			}
 			self.streams = append(self.streams, stream)
+		} else if hvc1 := atrack.GetHVC1Conf(); hvc1 != nil {
+			if stream.CodecData, err = h265parser.NewCodecDataFromHEVCDecoderConfRecord(hvc1.Data); err != nil {
+				return
+			}
+			self.streams = append(self.streams, stream)
 		} else if esds := atrack.GetElemStreamDesc(); esds != nil {
 			if stream.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(esds.DecConfig); err != nil {
 				return
@@ -102,6 +126,182 @@ func (self *Demuxer) probe() (err error) {
 	return
 }
 
+// readFragment parses the next moof and appends its samples to the streams.
+func (self *Demuxer) readFragment() (err error) {
+	if _, err = self.r.Seek(self.fragPos, 0); err != nil {
+		return
+	}
+	var atom mp4io.Atom
+	if atom, err = mp4io.ReadFileAtom(self.r); err != nil {
+		if err == io.EOF {
+			self.fragEOF = true
+			err = nil
+		}
+		return
+	}
+	if self.fragPos, err = self.r.Seek(0, 1); err != nil {
+		return
+	}
+
+	moof, ok := atom.(*mp4io.MovieFrag)
+	if !ok {
+		return
+	}
+	moofOffset, _ := moof.Pos()
+	dataEnd := int64(moofOffset)
+
+	for _, traf := range moof.Tracks {
+		if traf.Header == nil || traf.Run == nil {
+			continue
+		}
+		tfhd := traf.Header
+
+		var stream *Stream
+		for _, s := range self.streams {
+			if s.trackAtom.Header != nil && uint32(s.trackAtom.Header.TrackId) == tfhd.TrackId {
+				stream = s
+			}
+		}
+		if stream == nil {
+			continue
+		}
+
+		base := dataEnd
+		if tfhd.Flags&mp4io.TFHD_BASE_DATA_OFFSET != 0 {
+			base = int64(tfhd.BaseDataOffset)
+		} else if tfhd.Flags&mp4io.TFHD_DEFAULT_BASE_IS_MOOF != 0 {
+			base = int64(moofOffset)
+		}
+		if traf.DecodeTime != nil {
+			stream.fragDts = int64(traf.DecodeTime.Time)
+		}
+		dataEnd = stream.addFragSamples(tfhd, traf.Run, base)
+	}
+	return
+}
+
+func (self *Stream) addFragSamples(tfhd *mp4io.TrackFragHeader, trun *mp4io.TrackFragRun, base int64) (offset int64) {
+	var defaultDuration, defaultSize, defaultFlags uint32
+	if self.trex != nil {
+		defaultDuration = self.trex.DefaultSampleDuration
+		defaultSize = self.trex.DefaultSampleSize
+		defaultFlags = self.trex.DefaultSampleFlags
+	}
+	if tfhd.Flags&mp4io.TFHD_DEFAULT_DURATION != 0 {
+		defaultDuration = tfhd.DefaultDuration
+	}
+	if tfhd.Flags&mp4io.TFHD_DEFAULT_SIZE != 0 {
+		defaultSize = tfhd.DefaultSize
+	}
+	if tfhd.Flags&mp4io.TFHD_DEFAULT_FLAGS != 0 {
+		defaultFlags = tfhd.DefaultFlags
+	}
+
+	offset = base
+	if trun.Flags&mp4io.TRUN_DATA_OFFSET != 0 {
+		offset += int64(int32(trun.DataOffset))
+	}
+
+	for i, entry := range trun.Entries {
+		sample := fragSample{
+			offset: offset,
+			size:   defaultSize,
+			dts:    self.fragDts,
+		}
+		duration := defaultDuration
+		flags := defaultFlags
+		if trun.Flags&mp4io.TRUN_SAMPLE_DURATION != 0 {
+			duration = entry.Duration
+		}
+		if trun.Flags&mp4io.TRUN_SAMPLE_SIZE != 0 {
+			sample.size = entry.Size
+		}
+		if trun.Flags&mp4io.TRUN_SAMPLE_FLAGS != 0 {
+			flags = entry.Flags
+		}
+		if i == 0 && trun.Flags&mp4io.TRUN_FIRST_SAMPLE_FLAGS != 0 {
+			flags = trun.FirstSampleFlags
+		}
+		if trun.Flags&mp4io.TRUN_SAMPLE_CTS != 0 {
+			sample.cts = int32(entry.Cts)
+		}
+		// sample_is_non_sync_sample
+		sample.isKeyFrame = flags&0x10000 == 0
+
+		self.fragSamples = append(self.fragSamples, sample)
+		offset += int64(sample.size)
+		self.fragDts += int64(duration)
+	}
+	return
+}
+
+func (self *Demuxer) readFragPacket() (pkt av.Packet, err error) {
+	var chosen *Stream
+	var chosenidx int
+	for {
+		chosen = nil
+		pending := false
+		for i, stream := range self.streams {
+			if stream.fragSampleIndex >= len(stream.fragSamples) {
+				pending = true
+				continue
+			}
+			sample := stream.fragSamples[stream.fragSampleIndex]
+			if chosen == nil || stream.tsToTime(sample.dts) < chosen.tsToTime(chosen.fragSamples[chosen.fragSampleIndex].dts) {
+				chosen = stream
+				chosenidx = i
+			}
+		}
+		// keep streams interleaved unless there is nothing more to read
+		if !pending || self.fragEOF {
+			break
+		}
+		if err = self.readFragment(); err != nil {
+			return
+		}
+	}
+	if chosen == nil {
+		err = io.EOF
+		return
+	}
+
+	sample := chosen.fragSamples[chosen.fragSampleIndex]
+	pkt.Data = make([]byte, sample.size)
+	if err = self.readat(sample.offset, pkt.Data); err != nil {
+		return
+	}
+	pkt.Idx = int8(chosenidx)
+	pkt.Time = chosen.tsToTime(sample.dts)
+	pkt.CompositionTime = chosen.tsToTime(int64(sample.cts))
+	pkt.IsKeyFrame = sample.isKeyFrame
+	chosen.fragSampleIndex++
+	return
+}
+
+func (self *Stream) fragSeekToTime(tm time.Duration) (err error) {
+	targetTs := self.timeToTs(tm)
+	for !self.demuxer.fragEOF {
+		if n := len(self.fragSamples); n > 0 && self.fragSamples[n-1].dts > targetTs {
+			break
+		}
+		if err = self.demuxer.readFragment(); err != nil {
+			return
+		}
+	}
+
+	index := 0
+	for i, sample := range self.fragSamples {
+		if sample.dts > targetTs {
+			break
+		}
+		if sample.isKeyFrame || !self.Type().IsVideo() {
+			index = i
+		}
+	}
+	self.fragSampleIndex = index
+	return
+}
+
 func (self *Stream) setSampleIndex(index int) (err error) {
 	found := false
 	start := 0
@@ -305,6 +505,9 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 		err = errors.New("mp4: no streams available while trying to read a packet")
 		return
 	}
+	if self.fragmented {
+		return self.readFragPacket()
+	}
 
 	var chosen *Stream
 	var chosenidx int
@@ -329,12 +532,25 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 func (self *Demuxer) CurrentTime() (tm time.Duration) {
 	if len(self.streams) > 0 {
 		stream := self.streams[0]
+		if self.fragmented {
+			if stream.fragSampleIndex < len(stream.fragSamples) {
+				tm = stream.tsToTime(stream.fragSamples[stream.fragSampleIndex].dts)
+			}
+			return
+		}
 		tm = stream.tsToTime(stream.dts)
 	}
 	return
 }
 
 func (self *Demuxer) SeekToTime(tm time.Duration) (err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	if self.fragmented {
+		return self.fragSeekToTime(tm)
+	}
+
 	for _, stream := range self.streams {
 		if stream.Type().IsVideo() {
 			if err = stream.seekToTime(tm); err != nil {
@@ -356,6 +572,29 @@ func (self *Demuxer) SeekToTime(tm time.Duration) (err error) {
 	return
 }
 
+func (self *Demuxer) fragSeekToTime(tm time.Duration) (err error) {
+	for _, stream := range self.streams {
+		if stream.Type().IsVideo() {
+			if err = stream.fragSeekToTime(tm); err != nil {
+				return
+			}
+			if stream.fragSampleIndex < len(stream.fragSamples) {
+				tm = stream.tsToTime(stream.fragSamples[stream.fragSampleIndex].dts)
+			}
+			break
+		}
+	}
+
+	for _, stream := range self.streams {
+		if !stream.Type().IsVideo() {
+			if err = stream.fragSeekToTime(tm); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
 func (self *Stream) readPacket() (pkt av.Packet, err error) {
 	if !self.isSampleValid() {
 		err = io.EOF
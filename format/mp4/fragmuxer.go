@@ -0,0 +1,286 @@
+package mp4
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+type fragStream struct {
+	*Stream
+	lastpkt *av.Packet
+	lastdur int64
+	entries []mp4io.TrackFragRunEntry
+	datav   [][]byte
+	datalen int
+	// decode time of the first sample in the current fragment
+	basedts int64
+}
+
+// FragMuxer writes fragmented MP4: an init segment (ftyp+moov with mvex) at
+// WriteHeader and then one moof+mdat pair per fragment. Unlike Muxer it never
+// seeks, so the output can be streamed and is playable up to the last
+// complete fragment.
+type FragMuxer struct {
+	// Minimum fragment duration. A fragment is always closed right before a
+	// video keyframe, so zero means one fragment per GOP.
+	FragmentDuration time.Duration
+	// Use packet times as decode times instead of starting at zero, keeps
+	// muxers writing the tracks of one stream separately in sync.
+	KeepTime bool
+	// Write a styp box before each fragment, as DASH media segments start.
+	SegmentType bool
+
+	w         io.Writer
+	bufw      *bufio.Writer
+	streams   []*fragStream
+	videoidx  int
+	seqnum    uint32
+	starttime time.Duration
+	fragstart time.Duration
+	started   bool
+}
+
+func NewFragMuxer(w io.Writer) *FragMuxer {
+	return &FragMuxer{
+		w:    w,
+		bufw: bufio.NewWriterSize(w, pio.RecommendBufioSize),
+	}
+}
+
+// SetWriter changes the destination of subsequent writes, e.g. to put each
+// fragment into its own segment file.
+func (self *FragMuxer) SetWriter(w io.Writer) {
+	self.w = w
+	self.bufw.Reset(w)
+}
+
+func (self *FragMuxer) WriteHeader(streams []av.CodecData) (err error) {
+	self.streams = []*fragStream{}
+	self.videoidx = -1
+	for i, codec := range streams {
+		var stream *Stream
+		if stream, err = newStream(codec, i+1); err != nil {
+			return
+		}
+		if codec.Type().IsAudio() {
+			stream.timeScale = int64(codec.(av.AudioCodecData).SampleRate())
+		} else if self.videoidx == -1 {
+			self.videoidx = i
+		}
+		// samples are described by the fragments
+		stream.sample.SampleToChunk.Entries = nil
+		stream.sample.SyncSample = nil
+		self.streams = append(self.streams, &fragStream{Stream: stream})
+	}
+
+	ftyp := mp4io.FileType{
+		MajorBrand:   mp4io.StringToTag("iso5"),
+		MinorVersion: 512,
+		CompatibleBrands: []mp4io.Tag{
+			mp4io.StringToTag("iso5"),
+			mp4io.StringToTag("iso6"),
+			mp4io.StringToTag("mp41"),
+		},
+	}
+
+	moov := &mp4io.Movie{}
+	moov.Header = &mp4io.MovieHeader{
+		TimeScale:       1000,
+		PreferredRate:   1,
+		PreferredVolume: 1,
+		Matrix:          [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+		NextTrackId:     int32(len(self.streams) + 1),
+	}
+	moov.MovieExtend = &mp4io.MovieExtend{}
+	for _, stream := range self.streams {
+		if err = stream.fillTrackAtom(); err != nil {
+			return
+		}
+		moov.Tracks = append(moov.Tracks, stream.trackAtom)
+		moov.MovieExtend.Tracks = append(moov.MovieExtend.Tracks, &mp4io.TrackExtend{
+			TrackId:              uint32(stream.trackAtom.Header.TrackId),
+			DefaultSampleDescIdx: 1,
+		})
+	}
+
+	b := make([]byte, ftyp.Len()+moov.Len())
+	n := ftyp.Marshal(b)
+	moov.Marshal(b[n:])
+	if _, err = self.bufw.Write(b); err != nil {
+		return
+	}
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *fragStream) addSample(pkt av.Packet, dur int64) {
+	flags := uint32(mp4io.SAMPLE_FLAG_KEY)
+	if self.Type().IsVideo() && !pkt.IsKeyFrame {
+		flags = mp4io.SAMPLE_FLAG_NONKEY
+	}
+	self.entries = append(self.entries, mp4io.TrackFragRunEntry{
+		Duration: uint32(dur),
+		Size:     uint32(len(pkt.Data)),
+		Flags:    flags,
+		Cts:      uint32(self.timeToTs(pkt.CompositionTime)),
+	})
+	self.datav = append(self.datav, pkt.Data)
+	self.datalen += len(pkt.Data)
+	self.lastdur = dur
+}
+
+func (self *FragMuxer) WritePacket(pkt av.Packet) (err error) {
+	if pkt.IsScriptData {
+		return
+	}
+	if int(pkt.Idx) >= len(self.streams) {
+		err = fmt.Errorf("mp4: stream#%d not found", pkt.Idx)
+		return
+	}
+	stream := self.streams[pkt.Idx]
+
+	if !self.started {
+		if !self.KeepTime {
+			self.starttime = pkt.Time
+		}
+		self.fragstart = pkt.Time
+		self.started = true
+	}
+
+	if stream.lastpkt == nil && len(stream.entries) == 0 && stream.basedts == 0 {
+		stream.basedts = stream.timeToTs(pkt.Time - self.starttime)
+	}
+
+	if stream.lastpkt != nil {
+		dur := stream.timeToTs(pkt.Time) - stream.timeToTs(stream.lastpkt.Time)
+		if dur < 0 {
+			err = fmt.Errorf("mp4: stream#%d time=%v < lasttime=%v", pkt.Idx, pkt.Time, stream.lastpkt.Time)
+			return
+		}
+		stream.addSample(*stream.lastpkt, dur)
+	}
+
+	cutable := self.videoidx == -1 || (int(pkt.Idx) == self.videoidx && pkt.IsKeyFrame)
+	if cutable && pkt.Time-self.fragstart >= self.FragmentDuration {
+		if err = self.FlushFragment(); err != nil {
+			return
+		}
+		self.fragstart = pkt.Time
+	}
+
+	stream.lastpkt = &pkt
+	return
+}
+
+// FlushFragment writes the samples buffered so far as a fragment. The last
+// packet of each stream is kept until the next one gives its duration.
+func (self *FragMuxer) FlushFragment() (err error) {
+	moof := &mp4io.MovieFrag{
+		Header: &mp4io.MovieFragHeader{},
+	}
+	datalen := 0
+	for _, stream := range self.streams {
+		if len(stream.entries) == 0 {
+			continue
+		}
+		moof.Tracks = append(moof.Tracks, &mp4io.TrackFrag{
+			Header: &mp4io.TrackFragHeader{
+				Flags:   mp4io.TFHD_DEFAULT_BASE_IS_MOOF,
+				TrackId: uint32(stream.trackAtom.Header.TrackId),
+			},
+			DecodeTime: &mp4io.TrackFragDecodeTime{
+				Version: 1,
+				Time:    uint64(stream.basedts),
+			},
+			Run: &mp4io.TrackFragRun{
+				Flags:   mp4io.TRUN_DATA_OFFSET | mp4io.TRUN_SAMPLE_DURATION | mp4io.TRUN_SAMPLE_SIZE | mp4io.TRUN_SAMPLE_FLAGS | mp4io.TRUN_SAMPLE_CTS,
+				Entries: stream.entries,
+			},
+		})
+		datalen += stream.datalen
+	}
+	if len(moof.Tracks) == 0 {
+		return
+	}
+	self.seqnum++
+	moof.Header.Seqnum = self.seqnum
+
+	// data offsets are relative to the start of moof
+	offset := moof.Len() + 8
+	i := 0
+	for _, stream := range self.streams {
+		if len(stream.entries) == 0 {
+			continue
+		}
+		moof.Tracks[i].Run.DataOffset = uint32(offset)
+		offset += stream.datalen
+		i++
+	}
+
+	var styp *mp4io.FileType
+	if self.SegmentType {
+		styp = &mp4io.FileType{
+			Tag_:       mp4io.STYP,
+			MajorBrand: mp4io.StringToTag("msdh"),
+			CompatibleBrands: []mp4io.Tag{
+				mp4io.StringToTag("msdh"),
+				mp4io.StringToTag("msix"),
+			},
+		}
+	}
+
+	n := 0
+	if styp != nil {
+		n = styp.Len()
+	}
+	b := make([]byte, n+moof.Len()+8)
+	if styp != nil {
+		styp.Marshal(b)
+	}
+	n += moof.Marshal(b[n:])
+	pio.PutU32BE(b[n:], uint32(datalen+8))
+	pio.PutU32BE(b[n+4:], uint32(mp4io.MDAT))
+	if _, err = self.bufw.Write(b); err != nil {
+		return
+	}
+
+	for _, stream := range self.streams {
+		for _, data := range stream.datav {
+			if _, err = self.bufw.Write(data); err != nil {
+				return
+			}
+		}
+		for _, entry := range stream.entries {
+			stream.basedts += int64(entry.Duration)
+		}
+		stream.entries = nil
+		stream.datav = nil
+		stream.datalen = 0
+	}
+
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *FragMuxer) WriteTrailer() (err error) {
+	for _, stream := range self.streams {
+		if stream.lastpkt != nil {
+			stream.addSample(*stream.lastpkt, stream.lastdur)
+			stream.lastpkt = nil
+		}
+	}
+	if err = self.FlushFragment(); err != nil {
+		return
+	}
+	return
+}
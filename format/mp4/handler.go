@@ -6,7 +6,7 @@ import (
 	"github.com/nareix/joy4/av/avutil"
 )
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC}
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC}
 
 func Handler(h *avutil.RegisterHandler) {
 	h.Ext = ".mp4"
@@ -19,12 +19,21 @@ func Handler(h *avutil.RegisterHandler) {
 		return false
 	}
 
+	// mp4 needs seeking, nil tells avutil the reader or writer can't
 	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
-		return NewDemuxer(r.(io.ReadSeeker))
+		rs, ok := r.(io.ReadSeeker)
+		if !ok {
+			return nil
+		}
+		return NewDemuxer(rs)
 	}
 
 	h.WriterMuxer = func(w io.Writer) av.Muxer {
-		return NewMuxer(w.(io.WriteSeeker))
+		ws, ok := w.(io.WriteSeeker)
+		if !ok {
+			return nil
+		}
+		return NewMuxer(ws)
 	}
 
 	h.CodecTypes = CodecTypes
@@ -0,0 +1,30 @@
+package mp4
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nareix/joy4/av/avutil"
+)
+
+func TestCreateHTTPNotSeekable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	handlers := &avutil.Handlers{}
+	handlers.Add(Handler)
+	muxer, err := handlers.Create(server.URL + "/out.mp4")
+	if err == nil {
+		muxer.Close()
+		t.Fatal("created mp4 muxer on a http output")
+	}
+	if !strings.Contains(err.Error(), "not seekable") {
+		t.Fatalf("err=%v", err)
+	}
+}
@@ -201,6 +201,24 @@ func (self SoundMediaInfo) Tag() Tag {
 	return SMHD
 }
 
+const HEV1 = Tag(0x68657631)
+
+func (self HEV1Desc) Tag() Tag {
+	return HEV1
+}
+
+const HVC1 = Tag(0x68766331)
+
+func (self HVC1Desc) Tag() Tag {
+	return HVC1
+}
+
+const HVCC = Tag(0x68766343)
+
+func (self HVC1Conf) Tag() Tag {
+	return HVCC
+}
+
 const MDAT = Tag(0x6d646174)
 
 type Movie struct {
@@ -1682,6 +1700,8 @@ func (self SampleTable) Children() (r []Atom) {
 type SampleDesc struct {
 	Version		uint8
 	AVC1Desc	*AVC1Desc
+	HVC1Desc	*HVC1Desc
+	HEV1Desc	*HEV1Desc
 	MP4ADesc	*MP4ADesc
 	Unknowns	[]Atom
 	AtomPos
@@ -1701,6 +1721,12 @@ func (self SampleDesc) marshal(b []byte) (n int) {
 	if self.AVC1Desc != nil {
 		_childrenNR++
 	}
+	if self.HVC1Desc != nil {
+		_childrenNR++
+	}
+	if self.HEV1Desc != nil {
+		_childrenNR++
+	}
 	if self.MP4ADesc != nil {
 		_childrenNR++
 	}
@@ -1710,6 +1736,12 @@ func (self SampleDesc) marshal(b []byte) (n int) {
 	if self.AVC1Desc != nil {
 		n += self.AVC1Desc.Marshal(b[n:])
 	}
+	if self.HVC1Desc != nil {
+		n += self.HVC1Desc.Marshal(b[n:])
+	}
+	if self.HEV1Desc != nil {
+		n += self.HEV1Desc.Marshal(b[n:])
+	}
 	if self.MP4ADesc != nil {
 		n += self.MP4ADesc.Marshal(b[n:])
 	}
@@ -1726,6 +1758,12 @@ func (self SampleDesc) Len() (n int) {
 	if self.AVC1Desc != nil {
 		n += self.AVC1Desc.Len()
 	}
+	if self.HVC1Desc != nil {
+		n += self.HVC1Desc.Len()
+	}
+	if self.HEV1Desc != nil {
+		n += self.HEV1Desc.Len()
+	}
 	if self.MP4ADesc != nil {
 		n += self.MP4ADesc.Len()
 	}
@@ -1762,6 +1800,24 @@ func (self *SampleDesc) Unmarshal(b []byte, offset int) (n int, err error) {
 				}
 				self.AVC1Desc = atom
 			}
+		case HVC1:
+			{
+				atom := &HVC1Desc{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("hvc1", n+offset, err)
+					return
+				}
+				self.HVC1Desc = atom
+			}
+		case HEV1:
+			{
+				atom := &HEV1Desc{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("hev1", n+offset, err)
+					return
+				}
+				self.HEV1Desc = atom
+			}
 		case MP4A:
 			{
 				atom := &MP4ADesc{}
@@ -1789,6 +1845,12 @@ func (self SampleDesc) Children() (r []Atom) {
 	if self.AVC1Desc != nil {
 		r = append(r, self.AVC1Desc)
 	}
+	if self.HVC1Desc != nil {
+		r = append(r, self.HVC1Desc)
+	}
+	if self.HEV1Desc != nil {
+		r = append(r, self.HEV1Desc)
+	}
 	if self.MP4ADesc != nil {
 		r = append(r, self.MP4ADesc)
 	}
@@ -2206,6 +2268,476 @@ func (self AVC1Conf) Children() (r []Atom) {
 	return
 }
 
+type HVC1Desc struct {
+	DataRefIdx		int16
+	Version			int16
+	Revision		int16
+	Vendor			int32
+	TemporalQuality		int32
+	SpatialQuality		int32
+	Width			int16
+	Height			int16
+	HorizontalResolution	float64
+	VorizontalResolution	float64
+	FrameCount		int16
+	CompressorName		[32]byte
+	Depth			int16
+	ColorTableId		int16
+	Conf			*HVC1Conf
+	Unknowns		[]Atom
+	AtomPos
+}
+
+func (self HVC1Desc) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(HVC1))
+	n += self.marshal(b[8:])+8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+func (self HVC1Desc) marshal(b []byte) (n int) {
+	n += 6
+	pio.PutI16BE(b[n:], self.DataRefIdx)
+	n += 2
+	pio.PutI16BE(b[n:], self.Version)
+	n += 2
+	pio.PutI16BE(b[n:], self.Revision)
+	n += 2
+	pio.PutI32BE(b[n:], self.Vendor)
+	n += 4
+	pio.PutI32BE(b[n:], self.TemporalQuality)
+	n += 4
+	pio.PutI32BE(b[n:], self.SpatialQuality)
+	n += 4
+	pio.PutI16BE(b[n:], self.Width)
+	n += 2
+	pio.PutI16BE(b[n:], self.Height)
+	n += 2
+	PutFixed32(b[n:], self.HorizontalResolution)
+	n += 4
+	PutFixed32(b[n:], self.VorizontalResolution)
+	n += 4
+	n += 4
+	pio.PutI16BE(b[n:], self.FrameCount)
+	n += 2
+	copy(b[n:], self.CompressorName[:])
+	n += len(self.CompressorName[:])
+	pio.PutI16BE(b[n:], self.Depth)
+	n += 2
+	pio.PutI16BE(b[n:], self.ColorTableId)
+	n += 2
+	if self.Conf != nil {
+		n += self.Conf.Marshal(b[n:])
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	return
+}
+func (self HVC1Desc) Len() (n int) {
+	n += 8
+	n += 6
+	n += 2
+	n += 2
+	n += 2
+	n += 4
+	n += 4
+	n += 4
+	n += 2
+	n += 2
+	n += 4
+	n += 4
+	n += 4
+	n += 2
+	n += len(self.CompressorName[:])
+	n += 2
+	n += 2
+	if self.Conf != nil {
+		n += self.Conf.Len()
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Len()
+	}
+	return
+}
+func (self *HVC1Desc) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	n += 6
+	if len(b) < n+2 {
+		err = parseErr("DataRefIdx", n+offset, err)
+		return
+	}
+	self.DataRefIdx = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Version", n+offset, err)
+		return
+	}
+	self.Version = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Revision", n+offset, err)
+		return
+	}
+	self.Revision = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+4 {
+		err = parseErr("Vendor", n+offset, err)
+		return
+	}
+	self.Vendor = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("TemporalQuality", n+offset, err)
+		return
+	}
+	self.TemporalQuality = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("SpatialQuality", n+offset, err)
+		return
+	}
+	self.SpatialQuality = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+2 {
+		err = parseErr("Width", n+offset, err)
+		return
+	}
+	self.Width = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Height", n+offset, err)
+		return
+	}
+	self.Height = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+4 {
+		err = parseErr("HorizontalResolution", n+offset, err)
+		return
+	}
+	self.HorizontalResolution = GetFixed32(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("VorizontalResolution", n+offset, err)
+		return
+	}
+	self.VorizontalResolution = GetFixed32(b[n:])
+	n += 4
+	n += 4
+	if len(b) < n+2 {
+		err = parseErr("FrameCount", n+offset, err)
+		return
+	}
+	self.FrameCount = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+len(self.CompressorName) {
+		err = parseErr("CompressorName", n+offset, err)
+		return
+	}
+	copy(self.CompressorName[:], b[n:])
+	n += len(self.CompressorName)
+	if len(b) < n+2 {
+		err = parseErr("Depth", n+offset, err)
+		return
+	}
+	self.Depth = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("ColorTableId", n+offset, err)
+		return
+	}
+	self.ColorTableId = pio.I16BE(b[n:])
+	n += 2
+	for n+8 < len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case HVCC:
+			{
+				atom := &HVC1Conf{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("hvcC", n+offset, err)
+					return
+				}
+				self.Conf = atom
+			}
+		default:
+			{
+				atom := &Dummy{Tag_: tag, Data: b[n:n+size]}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("", n+offset, err)
+					return
+				}
+				self.Unknowns = append(self.Unknowns, atom)
+			}
+		}
+		n += size
+	}
+	return
+}
+func (self HVC1Desc) Children() (r []Atom) {
+	if self.Conf != nil {
+		r = append(r, self.Conf)
+	}
+	r = append(r, self.Unknowns...)
+	return
+}
+
+type HEV1Desc struct {
+	DataRefIdx		int16
+	Version			int16
+	Revision		int16
+	Vendor			int32
+	TemporalQuality		int32
+	SpatialQuality		int32
+	Width			int16
+	Height			int16
+	HorizontalResolution	float64
+	VorizontalResolution	float64
+	FrameCount		int16
+	CompressorName		[32]byte
+	Depth			int16
+	ColorTableId		int16
+	Conf			*HVC1Conf
+	Unknowns		[]Atom
+	AtomPos
+}
+
+func (self HEV1Desc) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(HEV1))
+	n += self.marshal(b[8:])+8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+func (self HEV1Desc) marshal(b []byte) (n int) {
+	n += 6
+	pio.PutI16BE(b[n:], self.DataRefIdx)
+	n += 2
+	pio.PutI16BE(b[n:], self.Version)
+	n += 2
+	pio.PutI16BE(b[n:], self.Revision)
+	n += 2
+	pio.PutI32BE(b[n:], self.Vendor)
+	n += 4
+	pio.PutI32BE(b[n:], self.TemporalQuality)
+	n += 4
+	pio.PutI32BE(b[n:], self.SpatialQuality)
+	n += 4
+	pio.PutI16BE(b[n:], self.Width)
+	n += 2
+	pio.PutI16BE(b[n:], self.Height)
+	n += 2
+	PutFixed32(b[n:], self.HorizontalResolution)
+	n += 4
+	PutFixed32(b[n:], self.VorizontalResolution)
+	n += 4
+	n += 4
+	pio.PutI16BE(b[n:], self.FrameCount)
+	n += 2
+	copy(b[n:], self.CompressorName[:])
+	n += len(self.CompressorName[:])
+	pio.PutI16BE(b[n:], self.Depth)
+	n += 2
+	pio.PutI16BE(b[n:], self.ColorTableId)
+	n += 2
+	if self.Conf != nil {
+		n += self.Conf.Marshal(b[n:])
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	return
+}
+func (self HEV1Desc) Len() (n int) {
+	n += 8
+	n += 6
+	n += 2
+	n += 2
+	n += 2
+	n += 4
+	n += 4
+	n += 4
+	n += 2
+	n += 2
+	n += 4
+	n += 4
+	n += 4
+	n += 2
+	n += len(self.CompressorName[:])
+	n += 2
+	n += 2
+	if self.Conf != nil {
+		n += self.Conf.Len()
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Len()
+	}
+	return
+}
+func (self *HEV1Desc) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	n += 6
+	if len(b) < n+2 {
+		err = parseErr("DataRefIdx", n+offset, err)
+		return
+	}
+	self.DataRefIdx = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Version", n+offset, err)
+		return
+	}
+	self.Version = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Revision", n+offset, err)
+		return
+	}
+	self.Revision = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+4 {
+		err = parseErr("Vendor", n+offset, err)
+		return
+	}
+	self.Vendor = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("TemporalQuality", n+offset, err)
+		return
+	}
+	self.TemporalQuality = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("SpatialQuality", n+offset, err)
+		return
+	}
+	self.SpatialQuality = pio.I32BE(b[n:])
+	n += 4
+	if len(b) < n+2 {
+		err = parseErr("Width", n+offset, err)
+		return
+	}
+	self.Width = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("Height", n+offset, err)
+		return
+	}
+	self.Height = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+4 {
+		err = parseErr("HorizontalResolution", n+offset, err)
+		return
+	}
+	self.HorizontalResolution = GetFixed32(b[n:])
+	n += 4
+	if len(b) < n+4 {
+		err = parseErr("VorizontalResolution", n+offset, err)
+		return
+	}
+	self.VorizontalResolution = GetFixed32(b[n:])
+	n += 4
+	n += 4
+	if len(b) < n+2 {
+		err = parseErr("FrameCount", n+offset, err)
+		return
+	}
+	self.FrameCount = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+len(self.CompressorName) {
+		err = parseErr("CompressorName", n+offset, err)
+		return
+	}
+	copy(self.CompressorName[:], b[n:])
+	n += len(self.CompressorName)
+	if len(b) < n+2 {
+		err = parseErr("Depth", n+offset, err)
+		return
+	}
+	self.Depth = pio.I16BE(b[n:])
+	n += 2
+	if len(b) < n+2 {
+		err = parseErr("ColorTableId", n+offset, err)
+		return
+	}
+	self.ColorTableId = pio.I16BE(b[n:])
+	n += 2
+	for n+8 < len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case HVCC:
+			{
+				atom := &HVC1Conf{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("hvcC", n+offset, err)
+					return
+				}
+				self.Conf = atom
+			}
+		default:
+			{
+				atom := &Dummy{Tag_: tag, Data: b[n:n+size]}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("", n+offset, err)
+					return
+				}
+				self.Unknowns = append(self.Unknowns, atom)
+			}
+		}
+		n += size
+	}
+	return
+}
+func (self HEV1Desc) Children() (r []Atom) {
+	if self.Conf != nil {
+		r = append(r, self.Conf)
+	}
+	r = append(r, self.Unknowns...)
+	return
+}
+
+type HVC1Conf struct {
+	Data	[]byte
+	AtomPos
+}
+
+func (self HVC1Conf) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(HVCC))
+	n += self.marshal(b[8:])+8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+func (self HVC1Conf) marshal(b []byte) (n int) {
+	copy(b[n:], self.Data[:])
+	n += len(self.Data[:])
+	return
+}
+func (self HVC1Conf) Len() (n int) {
+	n += 8
+	n += len(self.Data[:])
+	return
+}
+func (self *HVC1Conf) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	self.Data = b[n:]
+	n += len(b[n:])
+	return
+}
+func (self HVC1Conf) Children() (r []Atom) {
+	return
+}
+
 type TimeToSample struct {
 	Version	uint8
 	Flags	uint32
@@ -3144,13 +3676,8 @@ func (self TrackFragRun) marshal(b []byte) (n int) {
 		}
 	}
 
-	for i, entry := range self.Entries {
-		var flags uint32
-		if i > 0 {
-			flags = self.Flags
-		} else {
-			flags = self.FirstSampleFlags
-		}
+	for _, entry := range self.Entries {
+		flags := self.Flags
 		if flags&TRUN_SAMPLE_DURATION != 0 {
 			pio.PutU32BE(b[n:], entry.Duration)
 			n += 4
@@ -3186,26 +3713,7 @@ func (self TrackFragRun) Len() (n int) {
 		}
 	}
 
-	for i := range self.Entries {
-		var flags uint32
-		if i > 0 {
-			flags = self.Flags
-		} else {
-			flags = self.FirstSampleFlags
-		}
-		if flags&TRUN_SAMPLE_DURATION != 0 {
-			n += 4
-		}
-		if flags&TRUN_SAMPLE_SIZE != 0 {
-			n += 4
-		}
-		if flags&TRUN_SAMPLE_FLAGS != 0 {
-			n += 4
-		}
-		if flags&TRUN_SAMPLE_CTS != 0 {
-			n += 4
-		}
-	}
+	n += len(self.Entries) * self.entryLen()
 	return
 }
 func (self *TrackFragRun) Unmarshal(b []byte, offset int) (n int, err error) {
@@ -3247,14 +3755,13 @@ func (self *TrackFragRun) Unmarshal(b []byte, offset int) (n int, err error) {
 			n += 4
 		}
 	}
+	if len(b) < n+int(_len_Entries)*self.entryLen() {
+		err = parseErr("TrackFragRunEntry", n+offset, err)
+		return
+	}
 
 	for i := 0; i < int(_len_Entries); i++ {
-		var flags uint32
-		if i > 0 {
-			flags = self.Flags
-		} else {
-			flags = self.FirstSampleFlags
-		}
+		flags := self.Flags
 		entry := &self.Entries[i]
 		if flags&TRUN_SAMPLE_DURATION != 0 {
 			entry.Duration = pio.U32BE(b[n:])
@@ -3305,6 +3812,7 @@ const LenTrackFragRunEntry = 16
 type TrackFragHeader struct {
 	Version		uint8
 	Flags		uint32
+	TrackId		uint32
 	BaseDataOffset	uint64
 	StsdId		uint32
 	DefaultDuration	uint32
@@ -3324,6 +3832,8 @@ func (self TrackFragHeader) marshal(b []byte) (n int) {
 	n += 1
 	pio.PutU24BE(b[n:], self.Flags)
 	n += 3
+	pio.PutU32BE(b[n:], self.TrackId)
+	n += 4
 	if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
 		{
 			pio.PutU64BE(b[n:], self.BaseDataOffset)
@@ -3360,6 +3870,7 @@ func (self TrackFragHeader) Len() (n int) {
 	n += 8
 	n += 1
 	n += 3
+	n += 4
 	if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
 		{
 			n += 8
@@ -3402,6 +3913,12 @@ func (self *TrackFragHeader) Unmarshal(b []byte, offset int) (n int, err error)
 	}
 	self.Flags = pio.U24BE(b[n:])
 	n += 3
+	if len(b) < n+4 {
+		err = parseErr("TrackId", n+offset, err)
+		return
+	}
+	self.TrackId = pio.U32BE(b[n:])
+	n += 4
 	if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
 		{
 			if len(b) < n+8 {
@@ -3461,7 +3978,7 @@ func (self TrackFragHeader) Children() (r []Atom) {
 type TrackFragDecodeTime struct {
 	Version	uint8
 	Flags	uint32
-	Time	time.Time
+	Time	uint64
 	AtomPos
 }
 
@@ -3477,11 +3994,11 @@ func (self TrackFragDecodeTime) marshal(b []byte) (n int) {
 	pio.PutU24BE(b[n:], self.Flags)
 	n += 3
 	if self.Version != 0 {
-		PutTime64(b[n:], self.Time)
+		pio.PutU64BE(b[n:], self.Time)
 		n += 8
 	} else {
 
-		PutTime32(b[n:], self.Time)
+		pio.PutU32BE(b[n:], uint32(self.Time))
 		n += 4
 	}
 	return
@@ -3514,11 +4031,20 @@ func (self *TrackFragDecodeTime) Unmarshal(b []byte, offset int) (n int, err err
 	self.Flags = pio.U24BE(b[n:])
 	n += 3
 	if self.Version != 0 {
-		self.Time = GetTime64(b[n:])
+		if len(b) < n+8 {
+			err = parseErr("Time", n+offset, err)
+			return
+		}
+
+		self.Time = pio.U64BE(b[n:])
 		n += 8
 	} else {
+		if len(b) < n+4 {
+			err = parseErr("Time", n+offset, err)
+			return
+		}
 
-		self.Time = GetTime32(b[n:])
+		self.Time = uint64(pio.U32BE(b[n:]))
 		n += 4
 	}
 	return
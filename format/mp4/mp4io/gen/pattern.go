@@ -131,6 +131,8 @@ func stsd_SampleDesc() {
 	_skip(3)
 	int32(_childrenNR)
 	atom(AVC1Desc, AVC1Desc)
+	atom(HVC1Desc, HVC1Desc)
+	atom(HEV1Desc, HEV1Desc)
 	atom(MP4ADesc, MP4ADesc)
 	_unknowns()
 }
@@ -175,6 +177,52 @@ func avcC_AVC1Conf() {
 	bytesleft(Data)
 }
 
+func hvc1_HVC1Desc() {
+	_skip(6)
+	int16(DataRefIdx)
+	int16(Version)
+	int16(Revision)
+	int32(Vendor)
+	int32(TemporalQuality)
+	int32(SpatialQuality)
+	int16(Width)
+	int16(Height)
+	fixed32(HorizontalResolution)
+	fixed32(VorizontalResolution)
+	_skip(4)
+	int16(FrameCount)
+	bytes(CompressorName, 32)
+	int16(Depth)
+	int16(ColorTableId)
+	atom(Conf, HVC1Conf)
+	_unknowns()
+}
+
+func hev1_HEV1Desc() {
+	_skip(6)
+	int16(DataRefIdx)
+	int16(Version)
+	int16(Revision)
+	int32(Vendor)
+	int32(TemporalQuality)
+	int32(SpatialQuality)
+	int16(Width)
+	int16(Height)
+	fixed32(HorizontalResolution)
+	fixed32(VorizontalResolution)
+	_skip(4)
+	int16(FrameCount)
+	bytes(CompressorName, 32)
+	int16(Depth)
+	int16(ColorTableId)
+	atom(Conf, HVC1Conf)
+	_unknowns()
+}
+
+func hvcC_HVC1Conf() {
+	bytesleft(Data)
+}
+
 func stts_TimeToSample() {
 	uint8(Version)
 	uint24(Flags)
@@ -291,13 +339,8 @@ func trun_TrackFragRun() {
 	}))
 
 	slice(Entries, TrackFragRunEntry, _code(func() {
-		for i, entry := range self.Entries {
-			var flags uint32
-			if i > 0 {
-				flags = self.Flags
-			} else {
-				flags = self.FirstSampleFlags
-			}
+		for _, entry := range self.Entries {
+			flags := self.Flags
 			if flags&TRUN_SAMPLE_DURATION != 0 {
 				pio.PutU32BE(b[n:], entry.Duration)
 				n += 4
@@ -316,34 +359,14 @@ func trun_TrackFragRun() {
 			}
 		}
 	}, func() {
-		for i := range self.Entries {
-			var flags uint32
-			if i > 0 {
-				flags = self.Flags
-			} else {
-				flags = self.FirstSampleFlags
-			}
-			if flags&TRUN_SAMPLE_DURATION != 0 {
-				n += 4
-			}
-			if flags&TRUN_SAMPLE_SIZE != 0 {
-				n += 4
-			}
-			if flags&TRUN_SAMPLE_FLAGS != 0 {
-				n += 4
-			}
-			if flags&TRUN_SAMPLE_CTS != 0 {
-				n += 4
-			}
-		}
+		n += len(self.Entries) * self.entryLen()
 	}, func() {
+		if len(b) < n+int(_len_Entries)*self.entryLen() {
+			err = parseErr("TrackFragRunEntry", n+offset, err)
+			return
+		}
 		for i := 0; i < int(_len_Entries); i++ {
-			var flags uint32
-			if i > 0 {
-				flags = self.Flags
-			} else {
-				flags = self.FirstSampleFlags
-			}
+			flags := self.Flags
 			entry := &self.Entries[i]
 			if flags&TRUN_SAMPLE_DURATION != 0 {
 				entry.Duration = pio.U32BE(b[n:])
@@ -375,6 +398,7 @@ func TrackFragRunEntry() {
 func tfhd_TrackFragHeader() {
 	uint8(Version)
 	uint24(Flags)
+	uint32(TrackId)
 
 	uint64(BaseDataOffset, _code(func() {
 		if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
@@ -410,12 +434,12 @@ func tfhd_TrackFragHeader() {
 func tfdt_TrackFragDecodeTime() {
 	uint8(Version)
 	uint24(Flags)
-	time64(Time, _code(func() {
+	uint64(Time, _code(func() {
 		if self.Version != 0 {
-			PutTime64(b[n:], self.Time)
+			pio.PutU64BE(b[n:], self.Time)
 			n += 8
 		} else {
-			PutTime32(b[n:], self.Time)
+			pio.PutU32BE(b[n:], uint32(self.Time))
 			n += 4
 		}
 	}, func() {
@@ -426,10 +450,18 @@ func tfdt_TrackFragDecodeTime() {
 		}
 	}, func() {
 		if self.Version != 0 {
-			self.Time = GetTime64(b[n:])
+			if len(b) < n+8 {
+				err = parseErr("Time", n+offset, err)
+				return
+			}
+			self.Time = pio.U64BE(b[n:])
 			n += 8
 		} else {
-			self.Time = GetTime32(b[n:])
+			if len(b) < n+4 {
+				err = parseErr("Time", n+offset, err)
+				return
+			}
+			self.Time = uint64(pio.U32BE(b[n:]))
 			n += 4
 		}
 	}))
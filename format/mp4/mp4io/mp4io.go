@@ -182,6 +182,84 @@ const (
 	TRUN_SAMPLE_CTS         = 0x800
 )
 
+func (self TrackFragRun) entryLen() (n int) {
+	for _, flag := range []uint32{TRUN_SAMPLE_DURATION, TRUN_SAMPLE_SIZE, TRUN_SAMPLE_FLAGS, TRUN_SAMPLE_CTS} {
+		if self.Flags&flag != 0 {
+			n += 4
+		}
+	}
+	return
+}
+
+const (
+	// sample_depends_on = 2, the sample is an I-frame
+	SAMPLE_FLAG_KEY = 0x02000000
+	// sample_depends_on = 1 | sample_is_non_sync_sample
+	SAMPLE_FLAG_NONKEY = 0x01010000
+)
+
+const FTYP = Tag(0x66747970)
+const STYP = Tag(0x73747970)
+
+// FileType is the ftyp atom, or styp when Tag_ is set to STYP.
+type FileType struct {
+	Tag_             Tag
+	MajorBrand       Tag
+	MinorVersion     uint32
+	CompatibleBrands []Tag
+	AtomPos
+}
+
+func (self FileType) Tag() Tag {
+	if self.Tag_ == 0 {
+		return FTYP
+	}
+	return self.Tag_
+}
+
+func (self FileType) Children() []Atom {
+	return nil
+}
+
+func (self FileType) Len() int {
+	return 16 + 4*len(self.CompatibleBrands)
+}
+
+func (self FileType) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(self.Tag()))
+	n += 8
+	pio.PutU32BE(b[n:], uint32(self.MajorBrand))
+	n += 4
+	pio.PutU32BE(b[n:], self.MinorVersion)
+	n += 4
+	for _, brand := range self.CompatibleBrands {
+		pio.PutU32BE(b[n:], uint32(brand))
+		n += 4
+	}
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self *FileType) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	if len(b) < 16 {
+		err = parseErr("FileType", offset, err)
+		return
+	}
+	self.Tag_ = Tag(pio.U32BE(b[4:]))
+	n += 8
+	self.MajorBrand = Tag(pio.U32BE(b[n:]))
+	n += 4
+	self.MinorVersion = pio.U32BE(b[n:])
+	n += 4
+	self.CompatibleBrands = nil
+	for n+4 <= len(b) {
+		self.CompatibleBrands = append(self.CompatibleBrands, Tag(pio.U32BE(b[n:])))
+		n += 4
+	}
+	return
+}
+
 const (
 	MP4ESDescrTag          = 3
 	MP4DecConfigDescrTag   = 4
@@ -378,43 +456,59 @@ func (self *ElemStreamDesc) parseDescHdr(b []byte, offset int) (n int, tag uint8
 
 func ReadFileAtoms(r io.ReadSeeker) (atoms []Atom, err error) {
 	for {
-		offset, _ := r.Seek(0, 1)
-		taghdr := make([]byte, 8)
-		if _, err = io.ReadFull(r, taghdr); err != nil {
+		var atom Atom
+		if atom, err = ReadFileAtom(r); err != nil {
 			if err == io.EOF {
 				err = nil
 			}
 			return
 		}
-		size := pio.U32BE(taghdr[0:])
-		tag := Tag(pio.U32BE(taghdr[4:]))
+		atoms = append(atoms, atom)
+	}
+	return
+}
 
-		var atom Atom
-		switch tag {
-		case MOOV:
-			atom = &Movie{}
-		case MOOF:
-			atom = &MovieFrag{}
-		}
+// ReadFileAtom reads one top level atom at the current position.
+// MOOV and MOOF are parsed, others are skipped and returned as Dummy.
+func ReadFileAtom(r io.ReadSeeker) (atom Atom, err error) {
+	offset, _ := r.Seek(0, 1)
+	taghdr := make([]byte, 8)
+	if _, err = io.ReadFull(r, taghdr); err != nil {
+		return
+	}
+	size := pio.U32BE(taghdr[0:])
+	tag := Tag(pio.U32BE(taghdr[4:]))
+	if size < 8 {
+		err = parseErr("AtomSize", int(offset), err)
+		return
+	}
 
-		if atom != nil {
-			b := make([]byte, int(size))
-			if _, err = io.ReadFull(r, b[8:]); err != nil {
-				return
-			}
-			copy(b, taghdr)
-			if _, err = atom.Unmarshal(b, int(offset)); err != nil {
-				return
-			}
-			atoms = append(atoms, atom)
-		} else {
-			dummy := &Dummy{Tag_: tag}
-			dummy.setPos(int(offset), int(size))
-			if _, err = r.Seek(int64(size)-8, 1); err != nil {
-				return
+	switch tag {
+	case MOOV:
+		atom = &Movie{}
+	case MOOF:
+		atom = &MovieFrag{}
+	}
+
+	if atom != nil {
+		b := make([]byte, int(size))
+		if _, err = io.ReadFull(r, b[8:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
-			atoms = append(atoms, dummy)
+			return
 		}
+		copy(b, taghdr)
+		if _, err = atom.Unmarshal(b, int(offset)); err != nil {
+			return
+		}
+	} else {
+		dummy := &Dummy{Tag_: tag}
+		dummy.setPos(int(offset), int(size))
+		if _, err = r.Seek(int64(size)-8, 1); err != nil {
+			return
+		}
+		atom = dummy
 	}
 	return
 }
@@ -495,6 +589,12 @@ func (self *Track) GetAVC1Conf() (conf *AVC1Conf) {
 	return
 }
 
+func (self *Track) GetHVC1Conf() (conf *HVC1Conf) {
+	atom := FindChildren(self, HVCC)
+	conf, _ = atom.(*HVC1Conf)
+	return
+}
+
 func (self *Track) GetElemStreamDesc() (esds *ElemStreamDesc) {
 	atom := FindChildren(self, ESDS)
 	esds, _ = atom.(*ElemStreamDesc)
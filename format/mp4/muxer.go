@@ -6,6 +6,7 @@ import (
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"github.com/nareix/joy4/format/mp4/mp4io"
 	"github.com/nareix/joy4/utils/bits/pio"
 	"io"
@@ -27,14 +28,24 @@ func NewMuxer(w io.WriteSeeker) *Muxer {
 }
 
 func (self *Muxer) newStream(codec av.CodecData) (err error) {
+	var stream *Stream
+	if stream, err = newStream(codec, len(self.streams)+1); err != nil {
+		return
+	}
+	stream.muxer = self
+	self.streams = append(self.streams, stream)
+	return
+}
+
+func newStream(codec av.CodecData, trackId int) (stream *Stream, err error) {
 	switch codec.Type() {
-	case av.H264, av.AAC:
+	case av.H264, av.H265, av.AAC:
 
 	default:
 		err = fmt.Errorf("mp4: codec type=%v is not supported", codec.Type())
 		return
 	}
-	stream := &Stream{CodecData: codec}
+	stream = &Stream{CodecData: codec}
 
 	stream.sample = &mp4io.SampleTable{
 		SampleDesc:   &mp4io.SampleDesc{},
@@ -54,7 +65,7 @@ func (self *Muxer) newStream(codec av.CodecData) (err error) {
 
 	stream.trackAtom = &mp4io.Track{
 		Header: &mp4io.TrackHeader{
-			TrackId:  int32(len(self.streams)+1),
+			TrackId:  int32(trackId),
 			Flags:    0x0003, // Track enabled | Track in movie
 			Duration: 0,      // fill later
 			Matrix:   [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
@@ -79,13 +90,11 @@ func (self *Muxer) newStream(codec av.CodecData) (err error) {
 	}
 
 	switch codec.Type() {
-	case av.H264:
+	case av.H264, av.H265:
 		stream.sample.SyncSample = &mp4io.SyncSample{}
 	}
 
 	stream.timeScale = 90000
-	stream.muxer = self
-	self.streams = append(self.streams, stream)
 
 	return
 }
@@ -118,6 +127,30 @@ func (self *Stream) fillTrackAtom() (err error) {
 		self.trackAtom.Header.TrackWidth = float64(width)
 		self.trackAtom.Header.TrackHeight = float64(height)
 
+	} else if self.Type() == av.H265 {
+		codec := self.CodecData.(h265parser.CodecData)
+		width, height := codec.Width(), codec.Height()
+		self.sample.SampleDesc.HVC1Desc = &mp4io.HVC1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(width),
+			Height:               int16(height),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.HVC1Conf{Data: codec.HEVCDecoderConfRecordBytes()},
+		}
+		self.trackAtom.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'v','i','d','e'},
+			Name:    []byte("Video Media Handler"),
+		}
+		self.trackAtom.Media.Info.Video = &mp4io.VideoMediaInfo{
+			Flags: 0x000001,
+		}
+		self.trackAtom.Header.TrackWidth = float64(width)
+		self.trackAtom.Header.TrackHeight = float64(height)
+
 	} else if self.Type() == av.AAC {
 		codec := self.CodecData.(aacparser.CodecData)
 		self.sample.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
@@ -168,6 +201,9 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 }
 
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if pkt.IsScriptData {
+		return
+	}
 	stream := self.streams[pkt.Idx]
 	if stream.lastpkt != nil {
 		if err = stream.writePacket(*stream.lastpkt, pkt.Time-stream.lastpkt.Time); err != nil {
@@ -39,6 +39,19 @@ type Stream struct {
 
 	sttsEntry *mp4io.TimeToSampleEntry
 	cttsEntry *mp4io.CompositionOffsetEntry
+
+	trex            *mp4io.TrackExtend
+	fragSamples     []fragSample
+	fragSampleIndex int
+	fragDts         int64
+}
+
+type fragSample struct {
+	offset     int64
+	size       uint32
+	dts        int64
+	cts        int32
+	isKeyFrame bool
 }
 
 func timeToTs(tm time.Duration, timeScale int64) int64 {
@@ -0,0 +1,391 @@
+// Package reconnect implements an av.Demuxer that reopens its source when
+// reading fails, for long running pulls from cameras or rtmp servers.
+package reconnect
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/nareix/joy4/format/rtsp"
+)
+
+var ErrReadTimeout = fmt.Errorf("reconnect: read timeout")
+var ErrClosed = fmt.Errorf("reconnect: closed")
+
+var (
+	DefaultDialTimeout = time.Second * 10
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = time.Second * 30
+)
+
+// Demuxer reads from URL and reconnects with exponential backoff on errors.
+//
+// Packet times continue from the last packet before the failure, shifted
+// by the time spent reconnecting, so they keep increasing. The stream count
+// and order must stay the same across connections; if the codec data of a
+// stream changed, the first packet of that stream carries NewCodecData.
+type Demuxer struct {
+	URL string
+	// opens the source, by default rtsp.DialTimeout or rtmp.DialTimeout
+	// for rtsp and rtmp urls, avutil.Open for others
+	Dial        func(url string) (av.DemuxCloser, error)
+	DialTimeout time.Duration
+	// a connection that yields no packet for this long is dropped, 0
+	// disables the check
+	ReadTimeout time.Duration
+	// reconnect delay, doubled after each failed attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// give up after this many failed attempts in a row, 0 retries forever
+	MaxRetries int
+	// called with the error of every failed read or connect attempt
+	OnError func(err error)
+
+	lock    sync.Mutex
+	demuxer av.DemuxCloser
+	closed  bool
+	done    chan struct{}
+
+	streams  []av.CodecData
+	changed  []bool
+	lasttime time.Duration
+	lastwall time.Time
+	timebase time.Duration
+	rebase   bool
+	failures int
+	lasterr  error
+}
+
+func New(url string) *Demuxer {
+	return &Demuxer{
+		URL: url,
+	}
+}
+
+func (self *Demuxer) dial() (demuxer av.DemuxCloser, err error) {
+	if self.Dial != nil {
+		return self.Dial(self.URL)
+	}
+	timeout := self.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	switch {
+	case strings.HasPrefix(self.URL, "rtsp://"):
+		var cli *rtsp.Client
+		if cli, err = rtsp.DialTimeout(self.URL, timeout); err != nil {
+			return
+		}
+		cli.RtspTimeout = timeout
+		cli.InBandCodecDataChange = true
+		demuxer = cli
+	case strings.HasPrefix(self.URL, "rtmp://"), strings.HasPrefix(self.URL, "rtmps://"):
+		var conn *rtmp.Conn
+		if conn, err = rtmp.DialTimeout(self.URL, timeout); err != nil {
+			return
+		}
+		demuxer = conn
+	default:
+		demuxer, err = avutil.Open(self.URL)
+	}
+	return
+}
+
+// watch closes demuxer if fn doesn't return within ReadTimeout, to get
+// out of reads blocked on a stalled connection.
+func (self *Demuxer) watch(demuxer av.DemuxCloser, fn func() error) (err error) {
+	if self.ReadTimeout <= 0 {
+		return fn()
+	}
+	timer := time.AfterFunc(self.ReadTimeout, func() {
+		demuxer.Close()
+	})
+	err = fn()
+	if !timer.Stop() {
+		err = ErrReadTimeout
+	}
+	return
+}
+
+func (self *Demuxer) backoff() (delay time.Duration) {
+	min, max := self.MinBackoff, self.MaxBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max < min {
+		max = DefaultMaxBackoff
+		if max < min {
+			max = min
+		}
+	}
+	delay = min
+	for i := 1; i < self.failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return
+}
+
+func (self *Demuxer) fail(err error) {
+	self.failures++
+	self.lasterr = err
+	if self.OnError != nil {
+		self.OnError(err)
+	}
+}
+
+func (self *Demuxer) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
+}
+
+func (self *Demuxer) doneChan() chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.done == nil {
+		self.done = make(chan struct{})
+	}
+	return self.done
+}
+
+func (self *Demuxer) setDemuxer(demuxer av.DemuxCloser) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return false
+	}
+	self.demuxer = demuxer
+	return true
+}
+
+func (self *Demuxer) dropDemuxer() {
+	self.lock.Lock()
+	demuxer := self.demuxer
+	self.demuxer = nil
+	self.lock.Unlock()
+	if demuxer != nil {
+		demuxer.Close()
+	}
+}
+
+func (self *Demuxer) connectOnce() (err error) {
+	var demuxer av.DemuxCloser
+	if demuxer, err = self.dial(); err != nil {
+		return
+	}
+	if !self.setDemuxer(demuxer) {
+		demuxer.Close()
+		err = ErrClosed
+		return
+	}
+
+	var streams []av.CodecData
+	if err = self.watch(demuxer, func() (err error) {
+		streams, err = demuxer.Streams()
+		return
+	}); err != nil {
+		self.dropDemuxer()
+		return
+	}
+	if err = self.setStreams(streams); err != nil {
+		self.dropDemuxer()
+		return
+	}
+	return
+}
+
+// connect retries until a connection is up, Close is called or MaxRetries
+// attempts failed in a row. Failures only reset once a packet was read, so
+// a source failing right after connecting is backed off as well.
+func (self *Demuxer) connect() (err error) {
+	done := self.doneChan()
+	for {
+		if self.isClosed() {
+			return ErrClosed
+		}
+		if self.failures > 0 {
+			if self.MaxRetries > 0 && self.failures >= self.MaxRetries {
+				return self.lasterr
+			}
+			select {
+			case <-time.After(self.backoff()):
+			case <-done:
+				return ErrClosed
+			}
+		}
+		if err = self.connectOnce(); err == nil {
+			return
+		}
+		if err == ErrClosed {
+			return
+		}
+		self.fail(err)
+	}
+}
+
+// setStreams compares the streams of a new connection with the previous
+// ones and marks the changed ones.
+func (self *Demuxer) setStreams(streams []av.CodecData) (err error) {
+	if self.streams == nil {
+		self.streams = streams
+		self.changed = make([]bool, len(streams))
+		return
+	}
+	if len(streams) != len(self.streams) {
+		err = fmt.Errorf("reconnect: stream count changed from %d to %d", len(self.streams), len(streams))
+		return
+	}
+	// Streams() callers keep the old slice
+	newstreams := append([]av.CodecData{}, self.streams...)
+	for i, stream := range streams {
+		if !reflect.DeepEqual(stream, newstreams[i]) {
+			newstreams[i] = stream
+			self.changed[i] = true
+		}
+	}
+	self.streams = newstreams
+	self.rebase = true
+	return
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if self.streams == nil {
+		if err = self.connect(); err != nil {
+			return
+		}
+	}
+	streams = self.streams
+	return
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if self.streams == nil {
+		if err = self.connect(); err != nil {
+			return
+		}
+	}
+
+	for {
+		self.lock.Lock()
+		demuxer := self.demuxer
+		closed := self.closed
+		self.lock.Unlock()
+		if closed {
+			err = ErrClosed
+			return
+		}
+		if demuxer == nil {
+			if err = self.connect(); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = self.watch(demuxer, func() (err error) {
+			pkt, err = demuxer.ReadPacket()
+			return
+		}); err == nil {
+			self.fixPacket(&pkt)
+			return
+		}
+
+		if err == rtsp.ErrCodecDataChange {
+			if cli, ok := demuxer.(*rtsp.Client); ok {
+				if err = self.handleCodecDataChange(cli); err == nil {
+					continue
+				}
+			}
+		}
+
+		if self.isClosed() {
+			err = ErrClosed
+			return
+		}
+		self.fail(err)
+		self.dropDemuxer()
+	}
+}
+
+func (self *Demuxer) handleCodecDataChange(cli *rtsp.Client) (err error) {
+	var newcli *rtsp.Client
+	if newcli, err = cli.HandleCodecDataChange(); err != nil {
+		return
+	}
+	var streams []av.CodecData
+	if streams, err = newcli.Streams(); err != nil {
+		return
+	}
+	if !self.setDemuxer(newcli) {
+		err = ErrClosed
+		return
+	}
+	if err = self.setStreams(streams); err != nil {
+		return
+	}
+	// same connection, times go on unchanged
+	self.rebase = false
+	return
+}
+
+func (self *Demuxer) fixPacket(pkt *av.Packet) {
+	now := time.Now()
+	if self.rebase {
+		self.rebase = false
+		gap := now.Sub(self.lastwall)
+		if gap < time.Millisecond {
+			gap = time.Millisecond
+		}
+		self.timebase = self.lasttime + gap - pkt.Time
+	}
+	self.failures = 0
+	pkt.Time += self.timebase
+	if pkt.Time > self.lasttime {
+		self.lasttime = pkt.Time
+	}
+	self.lastwall = now
+
+	if pkt.IsScriptData || int(pkt.Idx) >= len(self.changed) {
+		return
+	}
+	if pkt.NewCodecData != nil {
+		// changed within the connection
+		streams := append([]av.CodecData{}, self.streams...)
+		streams[pkt.Idx] = pkt.NewCodecData
+		self.streams = streams
+		self.changed[pkt.Idx] = false
+	} else if self.changed[pkt.Idx] {
+		self.changed[pkt.Idx] = false
+		pkt.NewCodecData = self.streams[pkt.Idx]
+	}
+}
+
+// Close stops reconnecting and closes the current connection, a blocked
+// ReadPacket returns ErrClosed.
+func (self *Demuxer) Close() (err error) {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return
+	}
+	self.closed = true
+	if self.done != nil {
+		close(self.done)
+	}
+	demuxer := self.demuxer
+	self.demuxer = nil
+	self.lock.Unlock()
+
+	if demuxer != nil {
+		err = demuxer.Close()
+	}
+	return
+}
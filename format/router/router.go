@@ -0,0 +1,287 @@
+// Package router maps stream paths to pubsub queues for live streaming
+// servers: publishers write to a path, players read from it.
+//
+// A Router plugs into rtmp.Server and serves HTTP-FLV and WebSocket-FLV:
+//
+//	r := router.New()
+//	server := &rtmp.Server{HandlePublish: r.HandlePublish, HandlePlay: r.HandlePlay}
+//	http.Handle("/live/", r)
+package router
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/rtmp"
+)
+
+var ErrDuplicatePublisher = fmt.Errorf("router: stream is already being published")
+var ErrNotFound = fmt.Errorf("router: stream not found")
+var ErrTakenOver = fmt.Errorf("router: stream taken over by another publisher")
+
+// What Publish does when the path is already being published.
+type DuplicatePolicy int
+
+const (
+	// keep the current publisher, the new one fails with ErrDuplicatePublisher
+	Reject DuplicatePolicy = iota
+	// end the current stream and replace it with the new publisher
+	TakeOver
+)
+
+// Stream is a path being published.
+type Stream struct {
+	Path    string
+	Queue   *pubsub.Queue
+	Started time.Time
+	// free for use by OnPublish, e.g. to keep an hls.Muxer fed from Queue
+	Data interface{}
+
+	src       av.Demuxer
+	viewers   int
+	takenover bool
+}
+
+type StreamInfo struct {
+	Path    string
+	Streams []av.CodecData
+	Started time.Time
+	Viewers int
+}
+
+type Router struct {
+	DuplicatePolicy DuplicatePolicy
+	// how long players wait for a path that is not published yet, 0 fails
+	// right away with ErrNotFound
+	WaitTimeout time.Duration
+	// applied to every new queue, 0 keeps the pubsub default
+	MaxGopCount   int
+	MaxBufferSize int
+	// applied to the cursors of Play
+	LagPolicy pubsub.LagPolicy
+	MaxLag    time.Duration
+	// called with the router locked when a stream starts, before players
+	// can see it. src is the publisher passed to Publish.
+	OnPublish func(stream *Stream, src av.Demuxer)
+
+	lock    sync.Mutex
+	streams map[string]*Stream
+	waiting map[string]chan struct{}
+}
+
+func New() *Router {
+	return &Router{
+		streams: map[string]*Stream{},
+		waiting: map[string]chan struct{}{},
+	}
+}
+
+func (self *Router) register(path string, src av.Demuxer, streams []av.CodecData) (stream *Stream, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if old := self.streams[path]; old != nil {
+		if self.DuplicatePolicy != TakeOver {
+			err = ErrDuplicatePublisher
+			return
+		}
+		old.takenover = true
+		old.Queue.Close()
+		if closer, ok := old.src.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	stream = &Stream{
+		Path:    path,
+		Queue:   pubsub.NewQueue(),
+		Started: time.Now(),
+		src:     src,
+	}
+	if self.MaxGopCount > 0 {
+		stream.Queue.SetMaxGopCount(self.MaxGopCount)
+	}
+	if self.MaxBufferSize > 0 {
+		stream.Queue.SetMaxBufferSize(self.MaxBufferSize)
+	}
+	stream.Queue.WriteHeader(streams)
+	if self.OnPublish != nil {
+		self.OnPublish(stream, src)
+	}
+	self.streams[path] = stream
+
+	if ch := self.waiting[path]; ch != nil {
+		close(ch)
+		delete(self.waiting, path)
+	}
+	return
+}
+
+func (self *Router) unregister(stream *Stream) {
+	self.lock.Lock()
+	// a publisher that took over owns the path now
+	if self.streams[stream.Path] == stream {
+		delete(self.streams, stream.Path)
+	}
+	self.lock.Unlock()
+	stream.Queue.Close()
+}
+
+// Publish copies packets from src to path until src ends or another
+// publisher takes the path over.
+func (self *Router) Publish(path string, src av.Demuxer) (err error) {
+	var streams []av.CodecData
+	if streams, err = src.Streams(); err != nil {
+		return
+	}
+	var stream *Stream
+	if stream, err = self.register(path, src, streams); err != nil {
+		return
+	}
+	defer self.unregister(stream)
+
+	for {
+		var pkt av.Packet
+		if pkt, err = src.ReadPacket(); err != nil {
+			break
+		}
+		if err = stream.Queue.WritePacket(pkt); err != nil {
+			break
+		}
+	}
+
+	self.lock.Lock()
+	takenover := stream.takenover
+	self.lock.Unlock()
+	if takenover {
+		err = ErrTakenOver
+	} else if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// Subscribe returns the stream published at path, waiting up to
+// WaitTimeout for it to start. Call Unsubscribe once done reading.
+func (self *Router) Subscribe(path string) (stream *Stream, err error) {
+	var timeout <-chan time.Time
+	if self.WaitTimeout > 0 {
+		timer := time.NewTimer(self.WaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		self.lock.Lock()
+		if stream = self.streams[path]; stream != nil {
+			stream.viewers++
+			self.lock.Unlock()
+			return
+		}
+		if timeout == nil {
+			self.lock.Unlock()
+			err = ErrNotFound
+			return
+		}
+		ch := self.waiting[path]
+		if ch == nil {
+			ch = make(chan struct{})
+			self.waiting[path] = ch
+		}
+		self.lock.Unlock()
+
+		select {
+		case <-ch:
+		case <-timeout:
+			err = ErrNotFound
+			return
+		}
+	}
+}
+
+func (self *Router) Unsubscribe(stream *Stream) {
+	self.lock.Lock()
+	stream.viewers--
+	self.lock.Unlock()
+}
+
+// Play copies the stream at path to dst, starting at the latest packet,
+// until the stream ends or writing fails.
+func (self *Router) Play(path string, dst av.Muxer) (err error) {
+	var stream *Stream
+	if stream, err = self.Subscribe(path); err != nil {
+		return
+	}
+	defer self.Unsubscribe(stream)
+	return avutil.CopyFile(dst, self.cursor(stream))
+}
+
+func (self *Router) cursor(stream *Stream) *pubsub.QueueCursor {
+	cursor := stream.Queue.Latest()
+	cursor.LagPolicy = self.LagPolicy
+	cursor.MaxLag = self.MaxLag
+	return cursor
+}
+
+// Get returns the stream published at path, or nil.
+func (self *Router) Get(path string) *Stream {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.streams[path]
+}
+
+// Streams lists the active streams sorted by path.
+func (self *Router) Streams() (infos []StreamInfo) {
+	self.lock.Lock()
+	for _, stream := range self.streams {
+		streams, _ := stream.Queue.Oldest().Streams()
+		infos = append(infos, StreamInfo{
+			Path:    stream.Path,
+			Streams: streams,
+			Started: stream.Started,
+			Viewers: stream.viewers,
+		})
+	}
+	self.lock.Unlock()
+	sort.Sort(byPath(infos))
+	return
+}
+
+type byPath []StreamInfo
+
+func (self byPath) Len() int           { return len(self) }
+func (self byPath) Less(i, j int) bool { return self[i].Path < self[j].Path }
+func (self byPath) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// HandlePublish is a rtmp.Server HandlePublish publishing to the url path.
+func (self *Router) HandlePublish(conn *rtmp.Conn) {
+	self.Publish(conn.URL.Path, conn)
+}
+
+// HandlePlay is a rtmp.Server HandlePlay playing the url path.
+func (self *Router) HandlePlay(conn *rtmp.Conn) {
+	self.Play(conn.URL.Path, conn)
+}
+
+// ServeHTTP serves the stream at the request path as HTTP-FLV, or as
+// WebSocket-FLV to WebSocket requests. A .flv extension is ignored:
+// /live/movie.flv plays /live/movie.
+func (self *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, ".flv")
+	stream, err := self.Subscribe(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer self.Unsubscribe(stream)
+	flv.ServeStream(w, r, self.cursor(stream))
+}
@@ -0,0 +1,115 @@
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/nareix/joy4/format/flv/flvio"
+)
+
+// AuthRequest is passed to Server.Authorize on connect, publish and play.
+type AuthRequest struct {
+	// "connect", "publish" or "play"
+	Command string
+	App     string
+	// stream name without query, empty on connect
+	StreamKey string
+	// query of the stream name on publish/play, of app and tcUrl on connect
+	Query         url.Values
+	TcUrl         string
+	RemoteAddr    net.Addr
+	ConnectParams flvio.AMFMap
+}
+
+// AuthError rejects a request with a specific status code, e.g.
+// "NetStream.Publish.Unauthorized". Other errors are sent as
+// NetConnection.Connect.Rejected on connect, NetStream.Publish.BadName on
+// publish and NetStream.Play.Failed on play.
+type AuthError struct {
+	Code        string
+	Description string
+}
+
+func (self *AuthError) Error() string {
+	return fmt.Sprintf("rtmp: %s: %s", self.Code, self.Description)
+}
+
+func splitQuery(s string) (name string, query url.Values) {
+	query = url.Values{}
+	name = s
+	if i := strings.Index(s, "?"); i != -1 {
+		name = s[:i]
+		query, _ = url.ParseQuery(s[i+1:])
+	}
+	return
+}
+
+func (self *Conn) newAuthRequest(command, app, tcurl, stream string, params flvio.AMFMap) *AuthRequest {
+	req := &AuthRequest{
+		Command:       command,
+		TcUrl:         tcurl,
+		RemoteAddr:    self.netconn.RemoteAddr(),
+		ConnectParams: params,
+	}
+	var query url.Values
+	req.App, query = splitQuery(app)
+	if command == "connect" {
+		req.Query = query
+		if u, err := url.Parse(tcurl); err == nil {
+			for k, v := range u.Query() {
+				req.Query[k] = append(req.Query[k], v...)
+			}
+		}
+	} else {
+		req.StreamKey, req.Query = splitQuery(stream)
+	}
+	return req
+}
+
+// authorize runs Authorize and returns the status code and description to
+// reject the request with.
+func (self *Conn) authorize(req *AuthRequest, defcode string) (code string, desc string, err error) {
+	if self.Authorize == nil {
+		return
+	}
+	if err = self.Authorize(req); err == nil {
+		return
+	}
+	if autherr, ok := err.(*AuthError); ok {
+		code, desc = autherr.Code, autherr.Description
+	} else {
+		code, desc = defcode, err.Error()
+	}
+	return
+}
+
+func (self *Conn) writeConnectRejected(code, desc string) (err error) {
+	// > _error("NetConnection.Connect.Rejected")
+	if err = self.writeCommandMsg(3, 0, "_error", self.commandtransid, nil,
+		flvio.AMFMap{
+			"level":       "error",
+			"code":        code,
+			"description": desc,
+		},
+	); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
+
+func (self *Conn) writeStreamError(code, desc string) (err error) {
+	// > onStatus()
+	if err = self.writeCommandMsg(5, self.avmsgsid,
+		"onStatus", self.commandtransid, nil,
+		flvio.AMFMap{
+			"level":       "error",
+			"code":        code,
+			"description": desc,
+		},
+	); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
@@ -0,0 +1,504 @@
+// Package relay pushes one stream to several rtmp destinations, e.g. an
+// ingest restreamed to multiple platforms and a recorder at the same time.
+//
+// Each destination has its own goroutine and bounded packet buffer. A slow
+// destination drops packets up to the next keyframe instead of blocking the
+// source or the other destinations, and a failing one is reconnected with
+// exponential backoff.
+package relay
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/rtmp"
+)
+
+type State int
+
+const (
+	Connecting State = iota
+	Streaming
+	// waiting to reconnect after an error
+	Waiting
+	Stopped
+)
+
+func (self State) String() string {
+	switch self {
+	case Connecting:
+		return "connecting"
+	case Streaming:
+		return "streaming"
+	case Waiting:
+		return "waiting"
+	case Stopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("State(%d)", int(self))
+}
+
+type Status struct {
+	URL   string
+	State State
+	// error of the last failed connection, kept after reconnecting
+	LastError  error
+	Reconnects int
+	Written    int64
+	Dropped    int64
+}
+
+var (
+	DefaultBufferSize  = 512
+	DefaultDialTimeout = time.Second * 10
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = time.Second * 30
+)
+
+type Relay struct {
+	// opens a destination, rtmp.DialTimeout with DialTimeout by default
+	Dial        func(url string) (av.MuxCloser, error)
+	DialTimeout time.Duration
+	// packets buffered per destination
+	BufferSize int
+	// reconnect delay, doubled after each failed attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// called from the destination goroutines on every state change
+	OnStatus func(Status)
+
+	lock     sync.Mutex
+	dests    []*destination
+	streams  []av.CodecData
+	videoidx int
+	running  bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func New(urls ...string) *Relay {
+	relay := &Relay{}
+	for _, url := range urls {
+		relay.Add(url)
+	}
+	return relay
+}
+
+func (self *Relay) dial(url string) (av.MuxCloser, error) {
+	if self.Dial != nil {
+		return self.Dial(url)
+	}
+	timeout := self.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	conn, err := rtmp.DialTimeout(url, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (self *Relay) backoff() (min, max time.Duration) {
+	if min = self.MinBackoff; min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max = self.MaxBackoff; max < min {
+		max = DefaultMaxBackoff
+		if max < min {
+			max = min
+		}
+	}
+	return
+}
+
+// Add starts relaying to url, right away if Run was already called.
+func (self *Relay) Add(url string) {
+	size := self.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	dest := &destination{
+		relay:  self,
+		url:    url,
+		ch:     make(chan av.Packet, size),
+		quit:   make(chan struct{}),
+		status: Status{URL: url},
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return
+	}
+	self.dests = append(self.dests, dest)
+	if self.running {
+		self.start(dest)
+	}
+}
+
+// Remove stops relaying to url.
+func (self *Relay) Remove(url string) {
+	self.lock.Lock()
+	var removed []*destination
+	dests := self.dests[:0]
+	for _, dest := range self.dests {
+		if dest.url == url {
+			removed = append(removed, dest)
+		} else {
+			dests = append(dests, dest)
+		}
+	}
+	self.dests = dests
+	self.lock.Unlock()
+
+	for _, dest := range removed {
+		dest.stop()
+	}
+}
+
+func (self *Relay) start(dest *destination) {
+	self.wg.Add(1)
+	go dest.run(self.streams, self.videoidx)
+}
+
+// Status returns the status of each destination in the order they were
+// added.
+func (self *Relay) Status() (status []Status) {
+	self.lock.Lock()
+	dests := append([]*destination{}, self.dests...)
+	self.lock.Unlock()
+
+	for _, dest := range dests {
+		status = append(status, dest.getStatus())
+	}
+	return
+}
+
+// Run relays packets read from src until it ends or Close is called. To
+// relay a pubsub.Queue pass one of its cursors, e.g. que.Latest().
+// Destinations get WriteTrailer once src ends, Run then waits for them to
+// finish writing their buffered packets.
+func (self *Relay) Run(src av.Demuxer) (err error) {
+	var streams []av.CodecData
+	if streams, err = src.Streams(); err != nil {
+		return
+	}
+
+	self.lock.Lock()
+	if self.running || self.closed {
+		self.lock.Unlock()
+		err = fmt.Errorf("relay: already running or closed")
+		return
+	}
+	self.streams = streams
+	self.videoidx = -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			self.videoidx = i
+		}
+	}
+	self.running = true
+	for _, dest := range self.dests {
+		self.start(dest)
+	}
+	self.lock.Unlock()
+
+	for {
+		var pkt av.Packet
+		if pkt, err = src.ReadPacket(); err != nil {
+			break
+		}
+		self.lock.Lock()
+		closed := self.closed
+		if pkt.NewCodecData != nil && !pkt.IsScriptData && int(pkt.Idx) < len(self.streams) {
+			// destinations added later start with the new codec data
+			streams := append([]av.CodecData{}, self.streams...)
+			streams[pkt.Idx] = pkt.NewCodecData
+			self.streams = streams
+		}
+		if !closed {
+			for _, dest := range self.dests {
+				dest.push(pkt, self.videoidx)
+			}
+		}
+		self.lock.Unlock()
+		if closed {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	self.lock.Lock()
+	self.running = false
+	self.closed = true
+	for _, dest := range self.dests {
+		close(dest.ch)
+	}
+	self.lock.Unlock()
+
+	self.wg.Wait()
+	return
+}
+
+// Close stops all destinations without waiting for their buffers to drain.
+// Run returns after the next packet is read from its source.
+func (self *Relay) Close() (err error) {
+	self.lock.Lock()
+	self.closed = true
+	dests := append([]*destination{}, self.dests...)
+	self.lock.Unlock()
+
+	for _, dest := range dests {
+		dest.stop()
+	}
+	return
+}
+
+type destination struct {
+	relay *Relay
+	url   string
+	ch    chan av.Packet
+	quit  chan struct{}
+	once  sync.Once
+
+	// only used by Relay.Run
+	dropping bool
+	// codec data changes of dropped packets, sent with the next packet of
+	// the stream
+	pending map[int8]av.CodecData
+
+	lock   sync.Mutex
+	status Status
+	muxer  av.MuxCloser
+
+	// only used by the destination goroutine, follows NewCodecData of the
+	// packets taken from ch so a reconnect starts with the current streams
+	streams []av.CodecData
+}
+
+func isKeyFrame(pkt av.Packet, videoidx int) bool {
+	if videoidx == -1 {
+		return !pkt.IsScriptData
+	}
+	return int(pkt.Idx) == videoidx && pkt.IsKeyFrame && !pkt.IsScriptData
+}
+
+// push never blocks. Once the buffer is full packets are dropped up to the
+// next keyframe, so the destination resumes with a decodable picture.
+func (self *destination) push(pkt av.Packet, videoidx int) {
+	if self.dropping {
+		if !isKeyFrame(pkt, videoidx) {
+			self.drop(pkt)
+			return
+		}
+		self.dropping = false
+	}
+	if codec, ok := self.pending[pkt.Idx]; ok && pkt.NewCodecData == nil && !pkt.IsScriptData {
+		pkt.NewCodecData = codec
+	}
+	select {
+	case self.ch <- pkt:
+		if !pkt.IsScriptData {
+			delete(self.pending, pkt.Idx)
+		}
+	default:
+		self.dropping = true
+		self.drop(pkt)
+	}
+}
+
+func (self *destination) drop(pkt av.Packet) {
+	if pkt.NewCodecData != nil && !pkt.IsScriptData {
+		if self.pending == nil {
+			self.pending = map[int8]av.CodecData{}
+		}
+		self.pending[pkt.Idx] = pkt.NewCodecData
+	}
+	self.addDropped(1)
+}
+
+func (self *destination) addDropped(n int64) {
+	self.lock.Lock()
+	self.status.Dropped += n
+	self.lock.Unlock()
+}
+
+func (self *destination) getStatus() Status {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.status
+}
+
+func (self *destination) setState(state State, err error) {
+	self.lock.Lock()
+	self.status.State = state
+	if err != nil {
+		self.status.LastError = err
+	}
+	if state == Waiting {
+		self.status.Reconnects++
+	}
+	status := self.status
+	self.lock.Unlock()
+
+	if self.relay.OnStatus != nil {
+		self.relay.OnStatus(status)
+	}
+}
+
+func (self *destination) stop() {
+	self.once.Do(func() {
+		close(self.quit)
+		self.lock.Lock()
+		if self.muxer != nil {
+			// unblocks a pending write
+			self.muxer.Close()
+		}
+		self.lock.Unlock()
+	})
+}
+
+func (self *destination) take(pkt av.Packet) {
+	if pkt.NewCodecData != nil && !pkt.IsScriptData && int(pkt.Idx) < len(self.streams) {
+		streams := append([]av.CodecData{}, self.streams...)
+		streams[pkt.Idx] = pkt.NewCodecData
+		self.streams = streams
+	}
+}
+
+func (self *destination) run(streams []av.CodecData, videoidx int) {
+	defer self.relay.wg.Done()
+	self.streams = streams
+
+	min, max := self.relay.backoff()
+	backoff := min
+	for {
+		self.setState(Connecting, nil)
+		connected, done, err := self.stream(videoidx)
+		if done {
+			self.setState(Stopped, err)
+			return
+		}
+		if connected {
+			backoff = min
+		}
+		self.setState(Waiting, err)
+		if !self.wait(backoff) {
+			self.setState(Stopped, nil)
+			return
+		}
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// stream writes packets to one connection until it fails. done is set
+// when the destination is stopped or the source ended.
+func (self *destination) stream(videoidx int) (connected bool, done bool, err error) {
+	var muxer av.MuxCloser
+	if muxer, err = self.relay.dial(self.url); err != nil {
+		return
+	}
+	self.lock.Lock()
+	self.muxer = muxer
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		self.muxer = nil
+		self.lock.Unlock()
+		muxer.Close()
+	}()
+
+	select {
+	case <-self.quit:
+		done = true
+		return
+	default:
+	}
+
+	if err = muxer.WriteHeader(self.streams); err != nil {
+		return
+	}
+	connected = true
+	self.setState(Streaming, nil)
+
+	// a new connection starts at a keyframe
+	started := false
+	// codec data changes of packets dropped since WriteHeader, sent with
+	// the next packet of the stream
+	var changed map[int8]av.CodecData
+	for {
+		select {
+		case pkt, ok := <-self.ch:
+			if !ok {
+				done = true
+				err = muxer.WriteTrailer()
+				return
+			}
+			self.take(pkt)
+			if !started {
+				if !pkt.IsScriptData && !isKeyFrame(pkt, videoidx) {
+					if pkt.NewCodecData != nil {
+						if changed == nil {
+							changed = map[int8]av.CodecData{}
+						}
+						changed[pkt.Idx] = pkt.NewCodecData
+					}
+					self.addDropped(1)
+					continue
+				}
+				started = !pkt.IsScriptData
+			}
+			if codec, ok := changed[pkt.Idx]; ok && !pkt.IsScriptData {
+				if pkt.NewCodecData == nil {
+					pkt.NewCodecData = codec
+				}
+				delete(changed, pkt.Idx)
+			}
+			if err = muxer.WritePacket(pkt); err != nil {
+				select {
+				case <-self.quit:
+					done = true
+					err = nil
+				default:
+				}
+				return
+			}
+			self.lock.Lock()
+			self.status.Written++
+			self.lock.Unlock()
+
+		case <-self.quit:
+			done = true
+			return
+		}
+	}
+}
+
+// wait sleeps for the backoff while discarding packets, which would be
+// stale after reconnecting. It returns false once the destination is done.
+func (self *destination) wait(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	for {
+		select {
+		case pkt, ok := <-self.ch:
+			if !ok {
+				return false
+			}
+			self.take(pkt)
+			self.addDropped(1)
+		case <-self.quit:
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+}
@@ -3,14 +3,17 @@ package rtmp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"io"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"fmt"
@@ -31,18 +34,32 @@ func ParseURL(uri string) (u *url.URL, err error) {
 	}
 	log.Infof("u.Host: %v", u.Host)
 	if _, _, serr := net.SplitHostPort(u.Host); serr != nil {
-		u.Host += ":1935"
+		if u.Scheme == "rtmps" {
+			u.Host += ":443"
+		} else {
+			u.Host += ":1935"
+		}
 	}
 	log.Infof("u.Host: %v", u.Host)
 	return
 }
 
+func isRtmpURL(uri string) bool {
+	return strings.HasPrefix(uri, "rtmp://") || strings.HasPrefix(uri, "rtmps://")
+}
+
 func Dial(uri string) (conn *Conn, err error) {
 	fmt.Println("Dial Start")
 	return DialTimeout(uri, 0)
 }
 
 func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
+	return DialTLSTimeout(uri, timeout, nil)
+}
+
+// DialTLSTimeout is DialTimeout with the TLS config used for rtmps:// URLs.
+// A nil config verifies the server against the URL host.
+func DialTLSTimeout(uri string, timeout time.Duration, config *tls.Config) (conn *Conn, err error) {
 	var u *url.URL
 	if u, err = ParseURL(uri); err != nil {
 		return
@@ -50,8 +67,21 @@ func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
 
 	dailer := net.Dialer{Timeout: timeout}
 	var netconn net.Conn
-	if netconn, err = dailer.Dial("tcp", u.Host); err != nil {
-		return
+	if u.Scheme == "rtmps" {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		if netconn, err = tls.DialWithDialer(&dailer, "tcp", u.Host, config); err != nil {
+			return
+		}
+	} else {
+		if netconn, err = dailer.Dial("tcp", u.Host); err != nil {
+			return
+		}
 	}
 
 	conn = NewConn(netconn)
@@ -65,6 +95,27 @@ type Server struct {
 	HandlePlay    func(*Conn)
 	HandleConn    func(*Conn)
 	Logger        *log.Logger
+	// used by ListenAndServeTLS
+	TLSConfig *tls.Config
+	// validates connect, publish and play requests, see AuthRequest
+	Authorize func(*AuthRequest) error
+
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[*Conn]bool
+	handlers  sync.WaitGroup
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or
+// Close.
+var ErrServerClosed = fmt.Errorf("rtmp: Server closed")
+
+func (self *Server) logger() *log.Logger {
+	if self.Logger == nil {
+		return log.StandardLogger()
+	}
+	return self.Logger
 }
 
 func (self *Server) handleConn(conn *Conn) (err error) {
@@ -97,7 +148,7 @@ func (self *Server) ListenAndServe() (err error) {
 	var tcpaddr *net.TCPAddr
 	if tcpaddr, err = net.ResolveTCPAddr("tcp", addr); err != nil {
 		//err = self.Logger.Errorf("rtmp: ListenAndServe: %s", err)
-		self.Logger.Errorf("rtmp: ListenAndServe: %v", err)
+		self.logger().Errorf("rtmp: ListenAndServe: %v", err)
 		return
 	}
 
@@ -105,35 +156,187 @@ func (self *Server) ListenAndServe() (err error) {
 	if listener, err = net.ListenTCP("tcp", tcpaddr); err != nil {
 		return
 	}
-	self.Logger.Info("Listen Success")
+	self.logger().Info("Listen Success")
 
 	if Debug {
-		self.Logger.Debugf("rtmp: server: listening on : %v", addr)
+		self.logger().Debugf("rtmp: server: listening on : %v", addr)
+	}
+
+	return self.Serve(listener)
+}
+
+// ListenAndServeTLS serves rtmps. The certificate files may be empty if
+// TLSConfig already has certificates.
+func (self *Server) ListenAndServeTLS(certFile, keyFile string) (err error) {
+	addr := self.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+
+	config := &tls.Config{}
+	if self.TLSConfig != nil {
+		config = self.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			err = fmt.Errorf("rtmp: ListenAndServeTLS: %s", err)
+			return
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		err = fmt.Errorf("rtmp: ListenAndServeTLS: no certificate")
+		return
+	}
+
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		return
 	}
 
+	if Debug {
+		self.logger().Debugf("rtmp: server: listening on : %v (tls)", addr)
+	}
+
+	return self.Serve(tls.NewListener(listener, config))
+}
+
+func (self *Server) trackListener(listener net.Listener, add bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if add {
+		if self.closed {
+			return false
+		}
+		if self.listeners == nil {
+			self.listeners = map[net.Listener]bool{}
+		}
+		self.listeners[listener] = true
+	} else {
+		delete(self.listeners, listener)
+	}
+	return true
+}
+
+func (self *Server) trackConn(conn *Conn, add bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if add {
+		if self.closed {
+			return false
+		}
+		if self.conns == nil {
+			self.conns = map[*Conn]bool{}
+		}
+		self.conns[conn] = true
+		self.handlers.Add(1)
+	} else {
+		delete(self.conns, conn)
+		self.handlers.Done()
+	}
+	return true
+}
+
+// Serve accepts connections on listener and handles each one in a new
+// goroutine. The connection is closed when its handler returns. Serve always
+// returns a non-nil error, ErrServerClosed after Shutdown or Close.
+func (self *Server) Serve(listener net.Listener) (err error) {
+	if !self.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer self.trackListener(listener, false)
+
+	var delay time.Duration
 	for {
 		var netconn net.Conn
 		if netconn, err = listener.Accept(); err != nil {
+			if self.isClosed() {
+				err = ErrServerClosed
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				self.logger().Errorf("rtmp: server: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
 			return
 		}
-		self.Logger.Info("Accept Success")
+		delay = 0
+		self.logger().Info("Accept Success")
 
 		if Debug {
-			self.Logger.Debug("rtmp: server: accepted")
+			self.logger().Debug("rtmp: server: accepted")
 		}
 
 		conn := NewConn(netconn)
-		conn.Logger = self.Logger
+		conn.Logger = self.logger()
+		conn.Authorize = self.Authorize
 		conn.isserver = true
+		if !self.trackConn(conn, true) {
+			netconn.Close()
+			err = ErrServerClosed
+			return
+		}
 		go func() {
 			err := self.handleConn(conn)
+			conn.Close()
+			self.trackConn(conn, false)
 			if Debug {
-				self.Logger.Debugf("rtmp: server: client closed err: %v", err)
+				self.logger().Debugf("rtmp: server: client closed err: %v", err)
 			}
 		}()
 	}
 }
 
+func (self *Server) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
+}
+
+// Close stops all listeners and closes every active connection without
+// waiting for the handlers to return.
+func (self *Server) Close() (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	for listener := range self.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range self.conns {
+		conn.Close()
+	}
+	return
+}
+
+// Shutdown is Close followed by waiting for the handlers of all connections
+// to return, or for ctx to be done.
+func (self *Server) Shutdown(ctx context.Context) (err error) {
+	err = self.Close()
+
+	done := make(chan struct{})
+	go func() {
+		self.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
 const (
 	stageHandshakeDone = iota + 1
 	stageCommandDone
@@ -148,6 +351,11 @@ const (
 type Conn struct {
 	URL             *url.URL
 	OnPlayOrPublish func(string, flvio.AMFMap) error
+	// called on connect, publish and play, an error rejects the request
+	Authorize func(*AuthRequest) error
+	// return data messages (onMetaData, onCuePoint, ...) from ReadPacket as
+	// packets with IsScriptData set
+	ReadScriptData bool
 
 	prober  *flv.Prober
 	streams []av.CodecData
@@ -224,6 +432,7 @@ func NewConn(netconn net.Conn) *Conn {
 	conn.txrxcount = &txrxcount{ReadWriter: netconn}
 	conn.writebuf = make([]byte, 4096)
 	conn.readbuf = make([]byte, 4096)
+	conn.Logger = log.StandardLogger()
 	return conn
 }
 
@@ -300,6 +509,11 @@ func (self *Conn) pollAVTag() (tag flvio.Tag, err error) {
 		case msgtypeidVideoMsg, msgtypeidAudioMsg:
 			tag = self.avtag
 			return
+		case msgtypeidDataMsgAMF0, msgtypeidDataMsgAMF3:
+			if self.ReadScriptData && self.avtag.Type == flvio.TAG_SCRIPTDATA {
+				tag = self.avtag
+				return
+			}
 		}
 	}
 }
@@ -418,6 +632,12 @@ func (self *Conn) readConnect() (err error) {
 	}
 	connectparams := self.commandobj
 
+	var code, desc string
+	if code, desc, err = self.authorize(self.newAuthRequest("connect", connectpath, tcurl, "", connectparams), "NetConnection.Connect.Rejected"); err != nil {
+		self.writeConnectRejected(code, desc)
+		return
+	}
+
 	if err = self.writeBasicConf(); err != nil {
 		return
 	}
@@ -474,9 +694,15 @@ func (self *Conn) readConnect() (err error) {
 				}
 				publishpath, _ := self.commandparams[0].(string)
 
-				var cberr error
 				if self.OnPlayOrPublish != nil {
-					cberr = self.OnPlayOrPublish(self.commandname, connectparams)
+					if err = self.OnPlayOrPublish(self.commandname, connectparams); err != nil {
+						self.writeStreamError("NetStream.Publish.BadName", err.Error())
+						return
+					}
+				}
+				if code, desc, err = self.authorize(self.newAuthRequest("publish", connectpath, tcurl, publishpath, connectparams), "NetStream.Publish.BadName"); err != nil {
+					self.writeStreamError(code, desc)
+					return
 				}
 
 				// > onStatus()
@@ -494,12 +720,6 @@ func (self *Conn) readConnect() (err error) {
 					return
 				}
 
-				if cberr != nil {
-					//err = fmt.Errorf("rtmp: OnPlayOrPublish check failed")
-					self.Logger.Error("rtmp: OnPlayOrPublish check failed")
-					return
-				}
-
 				self.URL = createURL(tcurl, connectpath, publishpath)
 				self.publishing = true
 				self.reading = true
@@ -520,6 +740,17 @@ func (self *Conn) readConnect() (err error) {
 				}
 				playpath, _ := self.commandparams[0].(string)
 
+				if self.OnPlayOrPublish != nil {
+					if err = self.OnPlayOrPublish(self.commandname, connectparams); err != nil {
+						self.writeStreamError("NetStream.Play.Failed", err.Error())
+						return
+					}
+				}
+				if code, desc, err = self.authorize(self.newAuthRequest("play", connectpath, tcurl, playpath, connectparams), "NetStream.Play.Failed"); err != nil {
+					self.writeStreamError(code, desc)
+					return
+				}
+
 				// > streamBegin(streamid)
 				if err = self.writeStreamBegin(self.avmsgsid); err != nil {
 					return
@@ -635,6 +866,7 @@ func (self *Conn) writeConnect(path string) (err error) {
 			"audioCodecs":   4071,
 			"videoCodecs":   252,
 			"videoFunction": 1,
+			"fourCcList":    flvio.AMFArray{"hvc1"},
 		},
 	); err != nil {
 		return
@@ -663,6 +895,17 @@ func (self *Conn) writeConnect(path string) (err error) {
 					self.Logger.Debug("rtmp: < _result() of connect\n")
 				}
 				break
+			} else if self.commandname == "_error" {
+				// < _error("NetConnection.Connect.Rejected")
+				code, desc := "", ""
+				if len(self.commandparams) > 0 {
+					if obj, _ := self.commandparams[0].(flvio.AMFMap); obj != nil {
+						code, _ = obj["code"].(string)
+						desc, _ = obj["description"].(string)
+					}
+				}
+				err = fmt.Errorf("rtmp: command connect failed: %s %s", code, desc)
+				return
 			}
 		} else {
 			if self.msgtypeid == msgtypeidWindowAckSize {
@@ -887,7 +1130,25 @@ func (self *Conn) WritePacket(pkt av.Packet) (err error) {
 		return
 	}
 
-	stream := self.streams[pkt.Idx]
+	if pkt.NewCodecData != nil && !pkt.IsScriptData {
+		var streams []av.CodecData
+		var tag flvio.Tag
+		var ok bool
+		if streams, tag, ok, err = flv.ChangeCodecData(self.streams, int(pkt.Idx), pkt.NewCodecData); err != nil {
+			return
+		}
+		self.streams = streams
+		if ok {
+			if err = self.writeAVTag(tag, flvio.TimeToTs(pkt.Time)); err != nil {
+				return
+			}
+		}
+	}
+
+	var stream av.CodecData
+	if !pkt.IsScriptData {
+		stream = self.streams[pkt.Idx]
+	}
 	tag, timestamp := flv.PacketToTag(pkt, stream)
 
 	if Debug {
@@ -920,7 +1181,12 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 	}
 
 	// > onMetaData()
-	if err = self.writeDataMsg(5, self.avmsgsid, "onMetaData", metadata); err != nil {
+	if self.publishing && !self.isserver {
+		err = self.writeDataMsg(5, self.avmsgsid, "@setDataFrame", "onMetaData", metadata)
+	} else {
+		err = self.writeDataMsg(5, self.avmsgsid, "onMetaData", metadata)
+	}
+	if err != nil {
 		return
 	}
 
@@ -1014,6 +1280,12 @@ func (self *Conn) writeAMF0Msg(msgtypeid uint8, csid, msgsid uint32, args ...int
 	return
 }
 
+var setDataFrame = func() []byte {
+	b := make([]byte, flvio.LenAMF0Val("@setDataFrame"))
+	flvio.FillAMF0Val(b, "@setDataFrame")
+	return b
+}()
+
 func (self *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
 	var msgtypeid uint8
 	var csid uint32
@@ -1029,6 +1301,18 @@ func (self *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
 		msgtypeid = msgtypeidVideoMsg
 		csid = 7
 		data = tag.Data
+
+	case flvio.TAG_SCRIPTDATA:
+		msgtypeid = msgtypeidDataMsgAMF0
+		csid = 5
+		data = tag.Data
+		// servers only keep metadata for players when it is published as
+		// @setDataFrame("onMetaData", ...)
+		if self.publishing && !self.isserver {
+			if name, _, _ := flvio.ParseAMF0Val(data); name == "onMetaData" {
+				data = append(append([]byte{}, setDataFrame...), data...)
+			}
+		}
 	}
 
 	actualChunkHeaderLength := chunkHeaderLength
@@ -1396,6 +1680,36 @@ func (self *Conn) handleCommandMsgAMF0(b []byte) (n int, err error) {
 	return
 }
 
+func (self *Conn) handleDataMsgAMF0(b []byte) (err error) {
+	n := 0
+	for n < len(b) {
+		var obj interface{}
+		var size int
+		if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+			return
+		}
+		n += size
+		self.datamsgvals = append(self.datamsgvals, obj)
+		// @setDataFrame("onMetaData", ...) from publishers is relayed as
+		// onMetaData(...)
+		if len(self.datamsgvals) == 1 && obj == "@setDataFrame" {
+			self.datamsgvals = nil
+			b = b[n:]
+			n = 0
+		}
+	}
+	if n < len(b) {
+		//err = fmt.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+		self.Logger.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+		return
+	}
+	// |RtmpSampleAccess is sent by servers on play and is not stream data
+	if len(self.datamsgvals) > 0 && self.datamsgvals[0] != "|RtmpSampleAccess" {
+		self.avtag = flvio.Tag{Type: flvio.TAG_SCRIPTDATA, Data: b}
+	}
+	return
+}
+
 func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
 	self.msgdata = msgdata
 	self.msgtypeid = msgtypeid
@@ -1413,7 +1727,8 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 			self.Logger.Error("rtmp: short packet of CommandMsgAMF3")
 			return
 		}
-		// skip first byte
+		// the first byte selects the encoding, values then switch to AMF3
+		// with the avmplus-object marker
 		if _, err = self.handleCommandMsgAMF0(msgdata[1:]); err != nil {
 			return
 		}
@@ -1427,20 +1742,17 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 		self.eventtype = pio.U16BE(msgdata)
 
 	case msgtypeidDataMsgAMF0:
-		b := msgdata
-		n := 0
-		for n < len(b) {
-			var obj interface{}
-			var size int
-			if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
-				return
-			}
-			n += size
-			self.datamsgvals = append(self.datamsgvals, obj)
+		if err = self.handleDataMsgAMF0(msgdata); err != nil {
+			return
+		}
+
+	case msgtypeidDataMsgAMF3:
+		if len(msgdata) < 1 {
+			//err = fmt.Errorf("rtmp: short packet of DataMsgAMF3")
+			self.Logger.Error("rtmp: short packet of DataMsgAMF3")
+			return
 		}
-		if n < len(b) {
-			//err = fmt.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
-			self.Logger.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+		if err = self.handleDataMsgAMF0(msgdata[1:]); err != nil {
 			return
 		}
 
@@ -1691,7 +2003,7 @@ func (self closeConn) Close() error {
 
 func Handler(h *avutil.RegisterHandler) {
 	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
-		if !strings.HasPrefix(uri, "rtmp://") {
+		if !isRtmpURL(uri) {
 			return
 		}
 		ok = true
@@ -1700,7 +2012,7 @@ func Handler(h *avutil.RegisterHandler) {
 	}
 
 	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
-		if !strings.HasPrefix(uri, "rtmp://") {
+		if !isRtmpURL(uri) {
 			return
 		}
 		ok = true
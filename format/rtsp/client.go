@@ -14,6 +14,7 @@ import (
 	"github.com/nareix/joy4/codec"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"github.com/nareix/joy4/format/rtsp/sdp"
 	"io"
 	"net"
@@ -43,6 +44,21 @@ type Client struct {
 	Headers   []string
 
 	SkipErrRtpBlock bool
+	// report sps/pps changes with Packet.NewCodecData instead of returning
+	// ErrCodecDataChange
+	InBandCodecDataChange bool
+
+	// TransportTCP (default), TransportUDP or TransportUDPMulticast
+	Transport int
+	// Number of out of order RTP packets held for reordering on UDP
+	JitterBufferSize int
+	// Longest time a packet is held waiting for a missing one on UDP, 200ms
+	// if zero
+	JitterBufferDelay time.Duration
+	// Interval of RTCP receiver reports, 5s if zero, disabled if negative
+	RtcpInterval time.Duration
+	rtcpTimer    time.Time
+	rtcpSSRC     uint32
 
 	RtspTimeout          time.Duration
 	RtpTimeout           time.Duration
@@ -66,6 +82,11 @@ type Client struct {
 	streamsintf []av.CodecData
 	session    string
 	body       io.Reader
+	udp        *udpReceiver
+
+	// publishing
+	packetizers []*rtpPacketizer
+	bufw        *bufio.Writer
 }
 
 type Request struct {
@@ -593,6 +614,13 @@ func (self *Client) Setup(idx []int) (err error) {
 		} else {
 			uri = self.requestUri + "/" + control
 		}
+		if self.Transport != TransportTCP {
+			if err = self.setupUDP(si, uri); err != nil {
+				return
+			}
+			continue
+		}
+
 		req := Request{Method: "SETUP", Uri: uri}
 		req.Header = append(req.Header, fmt.Sprintf("Transport: RTP/AVP/TCP;unicast;interleaved=%d-%d", si*2, si*2+1))
 		if self.session != "" {
@@ -651,7 +679,7 @@ func (self *Client) Describe() (streams []sdp.Media, err error) {
 
 	self.streams = []*Stream{}
 	for _, media := range medias {
-		stream := &Stream{Sdp: media, client: self}
+		stream := &Stream{Sdp: media, client: self, stats: &rtpStats{}}
 		stream.makeCodecData()
 		self.streams = append(self.streams, stream)
 		streams = append(streams, media)
@@ -691,7 +719,7 @@ func (self *Client) HandleCodecDataChange() (_newcli *Client, err error) {
 		newstream.client = newcli
 
 		if newstream.isCodecDataChange() {
-			if err = newstream.makeCodecData(); err != nil {
+			if err = newstream.makeCodecDataFromParamSets(); err != nil {
 				return
 			}
 			newstream.clearCodecDataChange()
@@ -703,7 +731,26 @@ func (self *Client) HandleCodecDataChange() (_newcli *Client, err error) {
 	return
 }
 
+// makeCodecDataFromParamSets builds the codec data from the parameter sets
+// received in-band, unlike makeCodecData which starts from the sdp.
+func (self *Stream) makeCodecDataFromParamSets() (err error) {
+	switch self.Sdp.Type {
+	case av.H264:
+		if self.CodecData, err = h264parser.NewCodecDataFromSPSAndPPS(self.sps, self.pps); err != nil {
+			err = fmt.Errorf("rtsp: h264 sps/pps invalid: %s", err)
+			return
+		}
+	case av.H265:
+		if self.CodecData, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(self.vps, self.sps, self.pps); err != nil {
+			err = fmt.Errorf("rtsp: h265 vps/sps/pps invalid: %s", err)
+			return
+		}
+	}
+	return
+}
+
 func (self *Stream) clearCodecDataChange() {
+	self.vpsChanged = false
 	self.spsChanged = false
 	self.ppsChanged = false
 }
@@ -756,6 +803,23 @@ func (self *Stream) makeCodecData() (err error) {
 				return
 			}
 
+		case av.H265:
+			for _, nalu := range [][]byte{media.SpropVPS, media.SpropSPS, media.SpropPPS} {
+				if len(nalu) > 0 {
+					self.handleH265Payload(0, nalu)
+				}
+			}
+
+			if len(self.vps) > 0 && len(self.sps) > 0 && len(self.pps) > 0 {
+				if self.CodecData, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(self.vps, self.sps, self.pps); err != nil {
+					err = fmt.Errorf("rtsp: h265 vps/sps/pps invalid: %s", err)
+					return
+				}
+			} else {
+				err = fmt.Errorf("rtsp: missing h265 vps, sps or pps")
+				return
+			}
+
 		case av.AAC:
 			if len(media.Config) == 0 {
 				err = fmt.Errorf("rtsp: aac sdp config missing")
@@ -842,34 +906,10 @@ func (self *Stream) handleH264Payload(timestamp uint32, packet []byte) (err erro
 			self.timestamp = timestamp
 
 	case naluType == 7: // sps
-		if self.client != nil && self.client.DebugRtp {
-			fmt.Println("rtsp: got sps")
-		}
-		if len(self.sps) == 0 {
-			self.sps = packet
-			self.makeCodecData()
-		} else if bytes.Compare(self.sps, packet) != 0 {
-			self.spsChanged = true
-			self.sps = packet
-			if self.client != nil && self.client.DebugRtp {
-				fmt.Println("rtsp: sps changed")
-			}
-		}
+		self.setParamSet("sps", &self.sps, &self.spsChanged, packet)
 
 	case naluType == 8: // pps
-		if self.client != nil && self.client.DebugRtp {
-			fmt.Println("rtsp: got pps")
-		}
-		if len(self.pps) == 0 {
-			self.pps = packet
-			self.makeCodecData()
-		} else if bytes.Compare(self.pps, packet) != 0 {
-			self.ppsChanged = true
-			self.pps = packet
-			if self.client != nil && self.client.DebugRtp {
-				fmt.Println("rtsp: pps changed")
-			}
-		}
+		self.setParamSet("pps", &self.pps, &self.ppsChanged, packet)
 
 	case naluType == 28: // FU-A
 		/*
@@ -988,8 +1028,152 @@ func (self *Stream) handleH264Payload(timestamp uint32, packet []byte) (err erro
 	return
 }
 
+// setParamSet stores a parameter set NALU into *dst, marking it changed if it
+// differs from the previous one. The first one seen triggers makeCodecData.
+func (self *Stream) setParamSet(name string, dst *[]byte, changed *bool, nalu []byte) {
+	if self.client != nil && self.client.DebugRtp {
+		fmt.Println("rtsp: got", name)
+	}
+	if len(*dst) == 0 {
+		*dst = nalu
+		self.makeCodecData()
+	} else if bytes.Compare(*dst, nalu) != 0 {
+		*changed = true
+		*dst = nalu
+		if self.client != nil && self.client.DebugRtp {
+			fmt.Println("rtsp:", name, "changed")
+		}
+	}
+}
+
+func (self *Stream) handleH265Payload(timestamp uint32, packet []byte) (err error) {
+	if len(packet) < 3 {
+		err = fmt.Errorf("rtp: h265 packet too short")
+		return
+	}
+
+	/*
+		RFC 7798 1.1.4. NAL Unit Header
+		+---------------+---------------+
+		|0|1|2|3|4|5|6|7|0|1|2|3|4|5|6|7|
+		+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		|F|   Type    |  LayerId  | TID |
+		+-------------+-----------------+
+
+		0-31     VCL NAL units
+		32       VPS
+		33       SPS
+		34       PPS
+		48       AP   Aggregation packet      4.4.2
+		49       FU   Fragmentation unit      4.4.3
+		50       PACI                         4.4.4
+	*/
+	naluType := (packet[0] >> 1) & 0x3f
+
+	switch {
+	case naluType <= 31:
+		if h265parser.IsKeyFrameNALU(packet) {
+			self.pkt.IsKeyFrame = true
+		}
+		self.gotpkt = true
+		// raw nalu to avcc
+		b := make([]byte, 4+len(packet))
+		pio.PutU32BE(b[0:4], uint32(len(packet)))
+		copy(b[4:], packet)
+		self.pkt.Data = b
+		self.timestamp = timestamp
+
+	case naluType == h265parser.NALU_VPS:
+		self.setParamSet("vps", &self.vps, &self.vpsChanged, packet)
+
+	case naluType == h265parser.NALU_SPS:
+		self.setParamSet("sps", &self.sps, &self.spsChanged, packet)
+
+	case naluType == h265parser.NALU_PPS:
+		self.setParamSet("pps", &self.pps, &self.ppsChanged, packet)
+
+	case naluType == 48: // AP
+		/*
+			0                   1                   2                   3
+			0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+			|                          RTP Header                           |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+			|   PayloadHdr (Type=48)        |         NALU 1 Size           |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+			|          NALU 1 HDR           |                               |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+         NALU 1 Data           |
+			|                   . . .                                       |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+			|  . . .        | NALU 2 Size                   | NALU 2 HDR    |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+			Figure 8. An example of an AP packet containing two aggregation
+			units without the DONL and DOND fields
+		*/
+		packet = packet[2:]
+		for len(packet) >= 2 {
+			size := int(packet[0])<<8 | int(packet[1])
+			if size+2 > len(packet) {
+				break
+			}
+			if err = self.handleH265Payload(timestamp, packet[2:size+2]); err != nil {
+				return
+			}
+			packet = packet[size+2:]
+		}
+		return
+
+	case naluType == 49: // FU
+		/*
+			0                   1                   2                   3
+			0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+			|    PayloadHdr (Type=49)       |   FU header   |               |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+               |
+			|                         FU payload                            |
+			|                                                               |
+			|                               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+			|                               :...OPTIONAL RTP padding        |
+			+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+			The FU header:
+			+---------------+
+			|0|1|2|3|4|5|6|7|
+			+-+-+-+-+-+-+-+-+
+			|S|E|  FuType   |
+			+---------------+
+		*/
+		fuHeader := packet[2]
+		isStart := fuHeader&0x80 != 0
+		isEnd := fuHeader&0x40 != 0
+		if isStart {
+			self.fuStarted = true
+			self.fuBuffer = []byte{packet[0]&0x81 | (fuHeader&0x3f)<<1, packet[1]}
+		}
+		if self.fuStarted {
+			self.fuBuffer = append(self.fuBuffer, packet[3:]...)
+			if isEnd {
+				self.fuStarted = false
+				if err = self.handleH265Payload(timestamp, self.fuBuffer); err != nil {
+					return
+				}
+			}
+		}
+
+	case naluType <= 47: // other single NALU packet
+	case naluType == 50: // PACI
+
+	default:
+		err = fmt.Errorf("rtsp: unsupported H265 naluType=%d", naluType)
+		return
+	}
+
+	return
+}
+
 func (self *Stream) handleRtpPacket(packet []byte) (err error) {
-	if self.isCodecDataChange() {
+	if self.isCodecDataChange() && !(self.client != nil && self.client.InBandCodecDataChange) {
 		err = ErrCodecDataChange
 		return
 	}
@@ -1079,6 +1263,11 @@ func (self *Stream) handleRtpPacket(packet []byte) (err error) {
 			return
 		}
 
+	case av.H265:
+		if err = self.handleH265Payload(timestamp, payload); err != nil {
+			return
+		}
+
 	case av.AAC:
 		if len(payload) < 4 {
 			err = fmt.Errorf("rtp: aac packet too short")
@@ -1107,6 +1296,9 @@ func (self *Client) Play() (err error) {
 	if err = self.WriteRequest(req); err != nil {
 		return
 	}
+	if self.udp != nil {
+		self.udp.start(self)
+	}
 
 	if self.allCodecDataReady() {
 		self.stage = stageCodecDataDone
@@ -1129,26 +1321,39 @@ func (self *Client) Teardown() (err error) {
 }
 
 func (self *Client) Close() (err error) {
+	if self.udp != nil {
+		self.udp.close()
+	}
 	return self.conn.Conn.Close()
 }
 
 func (self *Client) handleBlock(block []byte) (pkt av.Packet, ok bool, err error) {
 	_, blockno, _ := self.parseBlockHeader(block)
+
+	i := blockno/2
+	if i >= len(self.streams) {
+		err = fmt.Errorf("rtsp: block no=%d invalid", blockno)
+		return
+	}
+
 	if blockno%2 != 0 {
 		if self.DebugRtp {
 			fmt.Println("rtsp: rtcp block len", len(block)-4)
 		}
+		if herr := self.streams[i].handleRtcpPacket(block[4:]); herr != nil && !self.SkipErrRtpBlock {
+			err = herr
+		}
 		return
 	}
 
-	i := blockno/2
-	if i >= len(self.streams) {
-		err = fmt.Errorf("rtsp: block no=%d invalid", blockno)
-		return
-	}
+	self.streams[i].stats.update(block[4:], time.Now(), self.streams[i].timeScale())
+	return self.handleRtp(i, block[4:])
+}
+
+func (self *Client) handleRtp(i int, packet []byte) (pkt av.Packet, ok bool, err error) {
 	stream := self.streams[i]
 
-	herr := stream.handleRtpPacket(block[4:])
+	herr := stream.handleRtpPacket(packet)
 	if herr != nil {
 		if !self.SkipErrRtpBlock {
 			err = herr
@@ -1157,35 +1362,14 @@ func (self *Client) handleBlock(block []byte) (pkt av.Packet, ok bool, err error
 	}
 
 	if stream.gotpkt {
-		/*
-		TODO: sync AV by rtcp NTP timestamp
-		TODO: handle timestamp overflow
-		https://tools.ietf.org/html/rfc3550
-		A receiver can then synchronize presentation of the audio and video packets by relating 
-		their RTP timestamps using the timestamp pairs in RTCP SR packets.
-		*/
-		if stream.firsttimestamp == 0 {
-			stream.firsttimestamp = stream.timestamp
-		}
-		stream.timestamp -= stream.firsttimestamp
-
-		ok = true
-		pkt = stream.pkt
-		pkt.Time = time.Duration(stream.timestamp)*time.Second / time.Duration(stream.timeScale())
-		pkt.Idx = int8(self.setupMap[i])
-
-		if pkt.Time < stream.lasttime || pkt.Time - stream.lasttime > time.Minute*30 {
-			err = fmt.Errorf("rtp: time invalid stream#%d time=%v lasttime=%v", pkt.Idx, pkt.Time, stream.lasttime)
+		if pkt, err = stream.takePacket(int8(self.setupMap[i])); err != nil {
 			return
 		}
-		stream.lasttime = pkt.Time
+		ok = true
 
 		if self.DebugRtp {
 			fmt.Println("rtp: pktout", pkt.Idx, pkt.Time, len(pkt.Data))
 		}
-
-		stream.pkt = av.Packet{}
-		stream.gotpkt = false
 	}
 
 	return
@@ -1195,6 +1379,13 @@ func (self *Client) readPacket() (pkt av.Packet, err error) {
 	if err = self.SendRtpKeepalive(); err != nil {
 		return
 	}
+	if err = self.sendRtcpReports(); err != nil {
+		return
+	}
+
+	if self.udp != nil {
+		return self.readUDPPacket()
+	}
 
 	for {
 		var res Response
@@ -1235,5 +1426,14 @@ func Handler(h *avutil.RegisterHandler) {
 		demuxer, err = Dial(uri)
 		return
 	}
+
+	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
+		if !strings.HasPrefix(uri, "rtsp://") {
+			return
+		}
+		ok = true
+		muxer, err = Dial(uri)
+		return
+	}
 }
 
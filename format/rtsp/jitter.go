@@ -0,0 +1,153 @@
+package rtsp
+
+import (
+	"time"
+)
+
+const defaultJitterBufferSize = 64
+const defaultJitterBufferDelay = 200 * time.Millisecond
+
+// RFC 3550 A.1, sequence numbers further off than these are not reordering
+// but a jump, e.g. the sender restarted
+const (
+	jitterMaxDropout  = 3000
+	jitterMaxMisorder = 100
+)
+
+type jitterPacket struct {
+	data []byte
+	// number of packets lost right before this one
+	lost int
+	// the sequence numbers jumped right before this one
+	resync bool
+}
+
+type jitterEntry struct {
+	data []byte
+	time time.Time
+}
+
+// jitterBuffer reorders RTP packets received over UDP by sequence number.
+// A missing packet is waited for until size packets are held or the oldest
+// held one arrived delay ago, then the gap is counted as lost and skipped.
+type jitterBuffer struct {
+	size    int
+	delay   time.Duration
+	packets map[uint16]jitterEntry
+	nextseq uint16
+	started bool
+	lost    int
+
+	// first packet after a jump, resynced to if the next one follows it
+	bad     []byte
+	badtime time.Time
+	badseq  uint16
+}
+
+func newJitterBuffer(size int, delay time.Duration) *jitterBuffer {
+	if size <= 0 {
+		size = defaultJitterBufferSize
+	}
+	if delay <= 0 {
+		delay = defaultJitterBufferDelay
+	}
+	return &jitterBuffer{
+		size:    size,
+		delay:   delay,
+		packets: map[uint16]jitterEntry{},
+	}
+}
+
+func rtpSeq(packet []byte) uint16 {
+	return uint16(packet[2])<<8 | uint16(packet[3])
+}
+
+// push adds an RTP packet arrived at now and returns the packets that are
+// now in order.
+func (self *jitterBuffer) push(packet []byte, now time.Time) (out []jitterPacket) {
+	if len(packet) < 12 {
+		return
+	}
+	seq := rtpSeq(packet)
+
+	if !self.started {
+		self.started = true
+		self.nextseq = seq
+	}
+	d := int(int16(seq - self.nextseq))
+	if d < -jitterMaxMisorder || d >= jitterMaxDropout {
+		if self.bad == nil || seq != self.badseq+1 {
+			self.bad = packet
+			self.badtime = now
+			self.badseq = seq
+			return self.release(now, false)
+		}
+		// two sequential packets, start over at the first
+		out = self.release(now, true)
+		self.nextseq = self.badseq
+		self.packets[self.badseq] = jitterEntry{data: self.bad, time: self.badtime}
+		self.bad = nil
+		self.packets[seq] = jitterEntry{data: packet, time: now}
+		n := len(out)
+		out = append(out, self.release(now, false)...)
+		if n < len(out) {
+			out[n].resync = true
+		}
+		return
+	}
+	if d < 0 {
+		// late or duplicated
+		return self.release(now, false)
+	}
+	self.bad = nil
+	self.packets[seq] = jitterEntry{data: packet, time: now}
+	return self.release(now, false)
+}
+
+// release returns the packets in order, skipping gaps that were waited for
+// long enough, or all gaps if flush is set.
+func (self *jitterBuffer) release(now time.Time, flush bool) (out []jitterPacket) {
+	lost := 0
+	for len(self.packets) > 0 {
+		if entry, ok := self.packets[self.nextseq]; ok {
+			delete(self.packets, self.nextseq)
+			out = append(out, jitterPacket{data: entry.data, lost: lost})
+			self.nextseq++
+			lost = 0
+			continue
+		}
+		if !flush && len(self.packets) < self.size && now.Sub(self.oldest()) < self.delay {
+			break
+		}
+		// give up waiting and skip to the first packet held
+		gap := uint16(0xffff)
+		for seq := range self.packets {
+			if d := seq - self.nextseq; d < gap {
+				gap = d
+			}
+		}
+		lost += int(gap)
+		self.lost += int(gap)
+		self.nextseq += gap
+	}
+	return
+}
+
+// oldest returns the arrival time of the earliest held packet.
+func (self *jitterBuffer) oldest() (t time.Time) {
+	for _, entry := range self.packets {
+		if t.IsZero() || entry.time.Before(t) {
+			t = entry.time
+		}
+	}
+	return
+}
+
+// deadline returns when release stops waiting for the missing packet, ok is
+// false if no packet is held.
+func (self *jitterBuffer) deadline() (t time.Time, ok bool) {
+	if len(self.packets) == 0 {
+		return
+	}
+	return self.oldest().Add(self.delay), true
+}
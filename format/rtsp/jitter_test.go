@@ -0,0 +1,102 @@
+package rtsp
+
+import (
+	"testing"
+	"time"
+)
+
+func rtpPacket(seq uint16) []byte {
+	b := make([]byte, 12)
+	b[0] = 0x80
+	b[2] = byte(seq >> 8)
+	b[3] = byte(seq)
+	return b
+}
+
+type jitterResult struct {
+	seq    uint16
+	lost   int
+	resync bool
+}
+
+func checkJitter(t *testing.T, got []jitterPacket, want ...jitterResult) {
+	ok := len(got) == len(want)
+	for i := 0; ok && i < len(got); i++ {
+		ok = rtpSeq(got[i].data) == want[i].seq && got[i].lost == want[i].lost && got[i].resync == want[i].resync
+	}
+	if !ok {
+		var res []jitterResult
+		for _, jp := range got {
+			res = append(res, jitterResult{rtpSeq(jp.data), jp.lost, jp.resync})
+		}
+		t.Fatalf("got %v, want %v", res, want)
+	}
+}
+
+func TestJitterReorder(t *testing.T) {
+	now := time.Now()
+	jitter := newJitterBuffer(0, 0)
+	checkJitter(t, jitter.push(rtpPacket(65534), now), jitterResult{seq: 65534})
+	checkJitter(t, jitter.push(rtpPacket(0), now))
+	checkJitter(t, jitter.push(rtpPacket(1), now))
+	// wraps around
+	checkJitter(t, jitter.push(rtpPacket(65535), now),
+		jitterResult{seq: 65535}, jitterResult{seq: 0}, jitterResult{seq: 1})
+	// late and duplicated
+	checkJitter(t, jitter.push(rtpPacket(65535), now))
+	checkJitter(t, jitter.push(rtpPacket(1), now))
+	checkJitter(t, jitter.push(rtpPacket(2), now), jitterResult{seq: 2})
+}
+
+func TestJitterLoss(t *testing.T) {
+	now := time.Now()
+	jitter := newJitterBuffer(4, 100*time.Millisecond)
+	checkJitter(t, jitter.push(rtpPacket(10), now), jitterResult{seq: 10})
+
+	// 11 is lost, given up on when 4 packets are held
+	checkJitter(t, jitter.push(rtpPacket(12), now))
+	checkJitter(t, jitter.push(rtpPacket(13), now))
+	checkJitter(t, jitter.push(rtpPacket(14), now))
+	checkJitter(t, jitter.push(rtpPacket(15), now),
+		jitterResult{seq: 12, lost: 1}, jitterResult{seq: 13}, jitterResult{seq: 14}, jitterResult{seq: 15})
+
+	// 16 and 17 are lost, given up on after 100ms
+	checkJitter(t, jitter.push(rtpPacket(18), now))
+	if deadline, ok := jitter.deadline(); !ok || !deadline.Equal(now.Add(100*time.Millisecond)) {
+		t.Fatalf("deadline=%v ok=%v", deadline, ok)
+	}
+	checkJitter(t, jitter.push(rtpPacket(19), now.Add(50*time.Millisecond)))
+	checkJitter(t, jitter.release(now.Add(99*time.Millisecond), false))
+	checkJitter(t, jitter.release(now.Add(100*time.Millisecond), false),
+		jitterResult{seq: 18, lost: 2}, jitterResult{seq: 19})
+	if _, ok := jitter.deadline(); ok {
+		t.Fatal("packets held")
+	}
+
+	// released at end of stream
+	checkJitter(t, jitter.push(rtpPacket(21), now))
+	checkJitter(t, jitter.release(now, true), jitterResult{seq: 21, lost: 1})
+}
+
+func TestJitterResync(t *testing.T) {
+	now := time.Now()
+	jitter := newJitterBuffer(0, 0)
+	checkJitter(t, jitter.push(rtpPacket(20000), now), jitterResult{seq: 20000})
+	checkJitter(t, jitter.push(rtpPacket(20002), now))
+
+	// a single stray packet is dropped
+	checkJitter(t, jitter.push(rtpPacket(5), now))
+	checkJitter(t, jitter.push(rtpPacket(20001), now), jitterResult{seq: 20001}, jitterResult{seq: 20002})
+
+	// the sender restarted, sequence numbers jump backwards
+	checkJitter(t, jitter.push(rtpPacket(20004), now))
+	checkJitter(t, jitter.push(rtpPacket(100), now))
+	checkJitter(t, jitter.push(rtpPacket(101), now),
+		jitterResult{seq: 20004, lost: 1}, jitterResult{seq: 100, resync: true}, jitterResult{seq: 101})
+	checkJitter(t, jitter.push(rtpPacket(102), now), jitterResult{seq: 102})
+
+	// and forwards
+	checkJitter(t, jitter.push(rtpPacket(40000), now))
+	checkJitter(t, jitter.push(rtpPacket(40001), now),
+		jitterResult{seq: 40000, resync: true}, jitterResult{seq: 40001})
+}
@@ -0,0 +1,167 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// The Client is an av.Muxer when publishing: WriteHeader sends ANNOUNCE,
+// SETUP (mode=record) and RECORD, and packets are then sent as RTP
+// interleaved in the RTSP connection.
+
+func (self *Client) request(req Request) (res Response, err error) {
+	for i := 0; i < 2; i++ {
+		if err = self.WriteRequest(req); err != nil {
+			return
+		}
+		if res, err = self.ReadResponse(); err != nil {
+			return
+		}
+		// retry once with the credentials from the 401
+		if res.StatusCode != 401 {
+			break
+		}
+	}
+	if res.StatusCode != 200 {
+		err = fmt.Errorf("rtsp: %s failed, StatusCode=%d", req.Method, res.StatusCode)
+		return
+	}
+	return
+}
+
+func (self *Client) Announce(streams []av.CodecData) (err error) {
+	self.packetizers = []*rtpPacketizer{}
+	for i, codec := range streams {
+		var packetizer *rtpPacketizer
+		if packetizer, err = newRtpPacketizer(codec, i); err != nil {
+			return
+		}
+		self.packetizers = append(self.packetizers, packetizer)
+	}
+
+	body := makeSdp(self.requestUri, self.packetizers)
+	if self.DebugRtsp {
+		fmt.Print("> ", string(body))
+	}
+
+	// WriteRequest has no body, so the sdp follows the header block
+	req := Request{
+		Method: "ANNOUNCE",
+		Uri:    self.requestUri,
+		Header: []string{
+			"Content-Type: application/sdp",
+			fmt.Sprintf("Content-Length: %d", len(body)),
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err = self.WriteRequest(req); err != nil {
+			return
+		}
+		if _, err = self.conn.Write(body); err != nil {
+			return
+		}
+		var res Response
+		if res, err = self.ReadResponse(); err != nil {
+			return
+		}
+		if res.StatusCode == 200 {
+			return
+		}
+		if res.StatusCode != 401 || i == 1 {
+			err = fmt.Errorf("rtsp: ANNOUNCE failed, StatusCode=%d", res.StatusCode)
+			return
+		}
+	}
+	return
+}
+
+func (self *Client) Record() (err error) {
+	for i := range self.packetizers {
+		req := Request{
+			Method: "SETUP",
+			Uri:    fmt.Sprintf("%s/streamid=%d", self.requestUri, i),
+			Header: []string{
+				fmt.Sprintf("Transport: RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", i*2, i*2+1),
+			},
+		}
+		if self.session != "" {
+			req.Header = append(req.Header, "Session: "+self.session)
+		}
+		if _, err = self.request(req); err != nil {
+			return
+		}
+	}
+
+	req := Request{
+		Method: "RECORD",
+		Uri:    self.requestUri,
+		Header: []string{"Session: " + self.session, "Range: npt=0.000-"},
+	}
+	if _, err = self.request(req); err != nil {
+		return
+	}
+
+	// nothing but RTCP and keepalive responses are expected from here on
+	conn := self.conn.Conn
+	conn.SetReadDeadline(time.Time{})
+	go io.Copy(ioutil.Discard, conn)
+	self.bufw = bufio.NewWriterSize(self.conn, pio.RecommendBufioSize)
+	return
+}
+
+func (self *Client) WriteHeader(streams []av.CodecData) (err error) {
+	if err = self.Announce(streams); err != nil {
+		return
+	}
+	if err = self.Record(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Client) WritePacket(pkt av.Packet) (err error) {
+	if self.bufw == nil {
+		err = fmt.Errorf("rtsp: WritePacket before WriteHeader")
+		return
+	}
+	if pkt.IsScriptData {
+		return
+	}
+	if int(pkt.Idx) >= len(self.packetizers) {
+		err = fmt.Errorf("rtsp: stream#%d not found", pkt.Idx)
+		return
+	}
+	channel := byte(pkt.Idx) * 2
+
+	self.conn.Timeout = self.RtpTimeout
+	if err = self.packetizers[pkt.Idx].packetize(pkt, func(b []byte) error {
+		h := [4]byte{'$', channel}
+		pio.PutU16BE(h[2:4], uint16(len(b)))
+		if _, err := self.bufw.Write(h[:]); err != nil {
+			return err
+		}
+		_, err := self.bufw.Write(b)
+		return err
+	}); err != nil {
+		return
+	}
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Client) WriteTrailer() (err error) {
+	if self.bufw != nil {
+		if err = self.bufw.Flush(); err != nil {
+			return
+		}
+	}
+	return self.Teardown()
+}
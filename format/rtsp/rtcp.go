@@ -0,0 +1,283 @@
+package rtsp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	rtcpSR = 200
+	rtcpRR = 201
+)
+
+const defaultRtcpInterval = time.Second * 5
+
+// seconds between 1900 (NTP epoch) and 1970
+const ntpEpochOffset = 2208988800
+
+func ntpToTime(ntp uint64) time.Time {
+	sec := int64(ntp>>32) - ntpEpochOffset
+	nsec := int64((ntp & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(sec, nsec)
+}
+
+// StreamStats are the reception statistics of one stream as defined in
+// RFC 3550 6.4.1.
+type StreamStats struct {
+	PacketsReceived uint32
+	PacketsLost     int32
+	// fraction lost since the previous receiver report, 0-1
+	FractionLost float64
+	Jitter       time.Duration
+	// wallclock of the last sender report, zero if none was received
+	LastSenderReport time.Time
+}
+
+// rtpStats follows the sequence number and jitter bookkeeping of RFC 3550
+// appendix A.1 and A.8. It is locked as Client.Stats may be called while
+// reading.
+type rtpStats struct {
+	lock sync.Mutex
+
+	started       bool
+	ssrc          uint32
+	baseseq       uint16
+	maxseq        uint16
+	cycles        uint32
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	fractionLost  uint8
+	epoch         time.Time
+	transit       int32
+	jitter        float64
+
+	gotsr      bool
+	srntp      uint64
+	srrtp      uint32
+	srreceived time.Time
+}
+
+func (self *rtpStats) update(packet []byte, arrival time.Time, clockRate int) {
+	if len(packet) < 12 {
+		return
+	}
+	seq := pio.U16BE(packet[2:4])
+	timestamp := pio.U32BE(packet[4:8])
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.started {
+		self.started = true
+		self.ssrc = pio.U32BE(packet[8:12])
+		self.baseseq = seq
+		self.maxseq = seq
+		self.epoch = arrival
+	} else if delta := seq - self.maxseq; delta != 0 && delta < 0x8000 {
+		if seq < self.maxseq {
+			self.cycles += 1 << 16
+		}
+		self.maxseq = seq
+	}
+	self.received++
+
+	arrivalts := uint32(int64(arrival.Sub(self.epoch)) * int64(clockRate) / int64(time.Second))
+	transit := int32(arrivalts - timestamp)
+	if self.received > 1 {
+		d := transit - self.transit
+		if d < 0 {
+			d = -d
+		}
+		self.jitter += (float64(d) - self.jitter) / 16
+	}
+	self.transit = transit
+}
+
+func (self *rtpStats) expected() uint32 {
+	return self.cycles + uint32(self.maxseq) - uint32(self.baseseq) + 1
+}
+
+func (self *rtpStats) lost() int32 {
+	return int32(self.expected() - self.received)
+}
+
+func (self *rtpStats) handleSenderReport(b []byte, now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.gotsr = true
+	self.srntp = pio.U64BE(b[0:8])
+	self.srrtp = pio.U32BE(b[8:12])
+	self.srreceived = now
+}
+
+// fillReportBlock writes a 24 byte RR report block and starts a new
+// reporting interval, ok is false if no RTP packet was received yet.
+func (self *rtpStats) fillReportBlock(b []byte, now time.Time) (ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.started {
+		return
+	}
+	expected := self.expected()
+	expectedInterval := expected - self.expectedPrior
+	receivedInterval := self.received - self.receivedPrior
+	self.expectedPrior = expected
+	self.receivedPrior = self.received
+	self.fractionLost = 0
+	if expectedInterval > 0 && expectedInterval > receivedInterval {
+		self.fractionLost = uint8((expectedInterval - receivedInterval) << 8 / expectedInterval)
+	}
+
+	lost := self.lost()
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+
+	pio.PutU32BE(b[0:4], self.ssrc)
+	b[4] = self.fractionLost
+	pio.PutU24BE(b[5:8], uint32(lost)&0xffffff)
+	pio.PutU32BE(b[8:12], self.cycles|uint32(self.maxseq))
+	pio.PutU32BE(b[12:16], uint32(self.jitter))
+	if self.gotsr {
+		pio.PutU32BE(b[16:20], uint32(self.srntp>>16))
+		pio.PutU32BE(b[20:24], uint32(now.Sub(self.srreceived)*65536/time.Second))
+	} else {
+		pio.PutU32BE(b[16:20], 0)
+		pio.PutU32BE(b[20:24], 0)
+	}
+	return true
+}
+
+func (self *Stream) handleRtcpPacket(packet []byte) (err error) {
+	now := time.Now()
+	for len(packet) >= 4 {
+		if packet[0]>>6 != 2 {
+			err = fmt.Errorf("rtcp: version invalid")
+			return
+		}
+		length := (int(pio.U16BE(packet[2:4])) + 1) * 4
+		if length > len(packet) {
+			err = fmt.Errorf("rtcp: packet too short")
+			return
+		}
+		if packet[1] == rtcpSR && length >= 28 {
+			self.stats.handleSenderReport(packet[8:28], now)
+			if self.client != nil && self.client.DebugRtp {
+				fmt.Println("rtcp: sender report", ntpToTime(pio.U64BE(packet[8:16])), pio.U32BE(packet[16:20]))
+			}
+		}
+		packet = packet[length:]
+	}
+	return
+}
+
+// makeReceiverReport returns an RTCP RR for the stream, or nil if no RTP
+// packet was received yet.
+func (self *Stream) makeReceiverReport(ssrc uint32, now time.Time) []byte {
+	b := make([]byte, 32)
+	b[0] = 0x81 // V=2, RC=1
+	b[1] = rtcpRR
+	pio.PutU16BE(b[2:4], uint16(len(b)/4-1))
+	pio.PutU32BE(b[4:8], ssrc)
+	if !self.stats.fillReportBlock(b[8:], now) {
+		return nil
+	}
+	return b
+}
+
+func (self *Stream) statsSnapshot() (stats StreamStats) {
+	self.stats.lock.Lock()
+	defer self.stats.lock.Unlock()
+	stats.PacketsReceived = self.stats.received
+	if self.stats.started {
+		stats.PacketsLost = self.stats.lost()
+	}
+	stats.FractionLost = float64(self.stats.fractionLost) / 256
+	stats.Jitter = time.Duration(self.stats.jitter * float64(time.Second) / float64(self.timeScale()))
+	if self.stats.gotsr {
+		stats.LastSenderReport = ntpToTime(self.stats.srntp)
+	}
+	return
+}
+
+// Stats returns the statistics of each stream in the order of Streams(). It
+// may be called from any goroutine.
+func (self *Client) Stats() (stats []StreamStats) {
+	for _, si := range self.setupIdx {
+		stats = append(stats, self.streams[si].statsSnapshot())
+	}
+	return
+}
+
+// WallClock maps a packet read from the Client to the sender's NTP
+// wallclock, using the last RTCP sender report of its stream. Packets of
+// different cameras can be aligned this way.
+func (self *Client) WallClock(pkt av.Packet) (tm time.Time, ok bool) {
+	if int(pkt.Idx) >= len(self.setupIdx) {
+		return
+	}
+	stream := self.streams[self.setupIdx[pkt.Idx]]
+	stream.stats.lock.Lock()
+	defer stream.stats.lock.Unlock()
+	if !stream.stats.gotsr {
+		return
+	}
+	// pkt.Time counts from firsttimestamp
+	diff := int32(stream.stats.srrtp - stream.firsttimestamp)
+	srtime := time.Duration(diff) * time.Second / time.Duration(stream.timeScale())
+	tm = ntpToTime(stream.stats.srntp).Add(pkt.Time - srtime)
+	ok = true
+	return
+}
+
+func (self *Client) sendRtcpReports() (err error) {
+	interval := self.RtcpInterval
+	if interval == 0 {
+		interval = defaultRtcpInterval
+	} else if interval < 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(self.rtcpTimer) < interval {
+		return
+	}
+	self.rtcpTimer = now
+	if self.rtcpSSRC == 0 {
+		self.rtcpSSRC = rand.Uint32()
+	}
+
+	for _, si := range self.setupIdx {
+		stream := self.streams[si]
+		rr := stream.makeReceiverReport(self.rtcpSSRC, now)
+		if rr == nil {
+			continue
+		}
+		if self.DebugRtp {
+			fmt.Println("rtcp: receiver report stream", si)
+		}
+		if self.udp != nil {
+			if err = self.udp.writeRtcp(si, rr); err != nil {
+				return
+			}
+		} else {
+			b := make([]byte, 4+len(rr))
+			b[0] = '$'
+			b[1] = byte(si*2 + 1)
+			pio.PutU16BE(b[2:4], uint16(len(rr)))
+			copy(b[4:], rr)
+			self.conn.Timeout = self.RtspTimeout
+			if _, err = self.conn.Write(b); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
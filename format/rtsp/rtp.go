@@ -0,0 +1,208 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// Maximum RTP payload size. Larger NALUs are sent as FU-A fragments.
+const rtpMaxPayload = 1400
+
+// rtpPacketizer turns the av.Packets of one stream into RTP packets.
+type rtpPacketizer struct {
+	codec       av.CodecData
+	payloadType uint8
+	timeScale   int
+	ssrc        uint32
+	seq         uint16
+	// random offset added to timestamps as recommended by RFC 3550
+	tsbase uint32
+}
+
+func newRtpPacketizer(codec av.CodecData, idx int) (self *rtpPacketizer, err error) {
+	self = &rtpPacketizer{
+		codec:       codec,
+		payloadType: uint8(96 + idx),
+		ssrc:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+		tsbase:      rand.Uint32(),
+	}
+	switch codec.Type() {
+	case av.H264:
+		self.timeScale = 90000
+	case av.AAC:
+		self.timeScale = codec.(aacparser.CodecData).SampleRate()
+	default:
+		err = fmt.Errorf("rtsp: codec type=%v is not supported", codec.Type())
+		return
+	}
+	return
+}
+
+// sdpMedia returns the m= section describing this stream.
+func (self *rtpPacketizer) sdpMedia(control string) string {
+	lines := []string{}
+	pt := self.payloadType
+
+	switch codec := self.codec.(type) {
+	case h264parser.CodecData:
+		sps, pps := codec.SPS(), codec.PPS()
+		lines = append(lines,
+			fmt.Sprintf("m=video 0 RTP/AVP %d", pt),
+			fmt.Sprintf("a=rtpmap:%d H264/90000", pt),
+			fmt.Sprintf("a=fmtp:%d packetization-mode=1;profile-level-id=%02X%02X%02X;sprop-parameter-sets=%s,%s",
+				pt, sps[1], sps[2], sps[3],
+				base64.StdEncoding.EncodeToString(sps),
+				base64.StdEncoding.EncodeToString(pps)),
+		)
+
+	case aacparser.CodecData:
+		lines = append(lines,
+			fmt.Sprintf("m=audio 0 RTP/AVP %d", pt),
+			fmt.Sprintf("a=rtpmap:%d MPEG4-GENERIC/%d/%d", pt, codec.SampleRate(), codec.ChannelLayout().Count()),
+			fmt.Sprintf("a=fmtp:%d profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s",
+				pt, hex.EncodeToString(codec.MPEG4AudioConfigBytes())),
+		)
+	}
+
+	lines = append(lines, "a=control:"+control)
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func makeSdp(uri string, packetizers []*rtpPacketizer) []byte {
+	// RFC 4566 fixes the order of the session lines
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=joy4",
+	}
+	if uri != "" {
+		lines = append(lines, "u="+uri)
+	}
+	lines = append(lines,
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=control:*",
+	)
+	sdp := strings.Join(lines, "\r\n") + "\r\n"
+	for i, packetizer := range packetizers {
+		sdp += packetizer.sdpMedia(fmt.Sprintf("streamid=%d", i))
+	}
+	return []byte(sdp)
+}
+
+func (self *rtpPacketizer) timestamp(tm time.Duration) uint32 {
+	return self.tsbase + uint32(int64(tm)*int64(self.timeScale)/int64(time.Second))
+}
+
+func (self *rtpPacketizer) writeRtp(timestamp uint32, marker bool, payload [][]byte, write func([]byte) error) (err error) {
+	n := 12
+	for _, b := range payload {
+		n += len(b)
+	}
+	b := make([]byte, n)
+	b[0] = 0x80
+	b[1] = self.payloadType
+	if marker {
+		b[1] |= 0x80
+	}
+	pio.PutU16BE(b[2:4], self.seq)
+	pio.PutU32BE(b[4:8], timestamp)
+	pio.PutU32BE(b[8:12], self.ssrc)
+	n = 12
+	for _, p := range payload {
+		n += copy(b[n:], p)
+	}
+	self.seq++
+	return write(b)
+}
+
+// packetize calls write once for each RTP packet built from pkt.
+func (self *rtpPacketizer) packetize(pkt av.Packet, write func([]byte) error) (err error) {
+	switch self.codec.Type() {
+	case av.H264:
+		return self.packetizeH264(pkt, write)
+	case av.AAC:
+		return self.packetizeAAC(pkt, write)
+	}
+	return
+}
+
+func (self *rtpPacketizer) packetizeH264(pkt av.Packet, write func([]byte) error) (err error) {
+	timestamp := self.timestamp(pkt.Time + pkt.CompositionTime)
+
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	hasParams := false
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1f == 7 {
+			hasParams = true
+		}
+	}
+
+	if pkt.IsKeyFrame && !hasParams {
+		// repeat sps and pps in a STAP-A so clients can join at any keyframe
+		codec := self.codec.(h264parser.CodecData)
+		sps, pps := codec.SPS(), codec.PPS()
+		stapa := [][]byte{
+			{sps[0]&0x60 | 24},
+			{byte(len(sps) >> 8), byte(len(sps))}, sps,
+			{byte(len(pps) >> 8), byte(len(pps))}, pps,
+		}
+		if err = self.writeRtp(timestamp, false, stapa, write); err != nil {
+			return
+		}
+	}
+
+	for i, nalu := range nalus {
+		if len(nalu) == 0 || nalu[0]&0x1f == 9 {
+			continue
+		}
+		last := i == len(nalus)-1
+
+		if len(nalu) <= rtpMaxPayload {
+			if err = self.writeRtp(timestamp, last, [][]byte{nalu}, write); err != nil {
+				return
+			}
+			continue
+		}
+
+		fuIndicator := nalu[0]&0xe0 | 28
+		naluType := nalu[0] & 0x1f
+		data := nalu[1:]
+		for start := true; len(data) > 0; start = false {
+			size := len(data)
+			if size > rtpMaxPayload-2 {
+				size = rtpMaxPayload - 2
+			}
+			end := size == len(data)
+			fuHeader := naluType
+			if start {
+				fuHeader |= 0x80
+			}
+			if end {
+				fuHeader |= 0x40
+			}
+			if err = self.writeRtp(timestamp, last && end, [][]byte{{fuIndicator, fuHeader}, data[:size]}, write); err != nil {
+				return
+			}
+			data = data[size:]
+		}
+	}
+	return
+}
+
+func (self *rtpPacketizer) packetizeAAC(pkt av.Packet, write func([]byte) error) (err error) {
+	// RFC 3640 AAC-hbr: one AU per packet, 16 bit AU-headers-length
+	// followed by a 13 bit AU-size and 3 bit AU-Index
+	auHeaders := []byte{0, 16, byte(len(pkt.Data) >> 5), byte(len(pkt.Data) << 3)}
+	return self.writeRtp(self.timestamp(pkt.Time), true, [][]byte{auHeaders, pkt.Data}, write)
+}
@@ -21,6 +21,9 @@ type Media struct {
 	Rtpmap             int
 	Config             []byte
 	SpropParameterSets [][]byte
+	SpropVPS           []byte
+	SpropSPS           []byte
+	SpropPPS           []byte
 	PayloadType        int
 	SizeLength         int
 	IndexLength        int
@@ -74,6 +77,8 @@ func Parse(content string) (sess Session, medias []Media) {
 								media.Type = av.AAC
 							case "H264":
 								media.Type = av.H264
+							case "H265", "HEVC":
+								media.Type = av.H265
 							}
 							if i, err := strconv.Atoi(keyval[1]); err == nil {
 								media.TimeScale = i
@@ -102,6 +107,12 @@ func Parse(content string) (sess Session, medias []Media) {
 											val, _ := base64.StdEncoding.DecodeString(field)
 											media.SpropParameterSets = append(media.SpropParameterSets, val)
 										}
+									case "sprop-vps":
+										media.SpropVPS, _ = base64.StdEncoding.DecodeString(val)
+									case "sprop-sps":
+										media.SpropSPS, _ = base64.StdEncoding.DecodeString(val)
+									case "sprop-pps":
+										media.SpropPPS, _ = base64.StdEncoding.DecodeString(val)
 									}
 								}
 							}
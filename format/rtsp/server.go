@@ -0,0 +1,627 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/rtsp/sdp"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// Server accepts RTSP connections over TCP. Media is carried in interleaved
+// channels on the same connection; UDP transports are refused.
+type Server struct {
+	Addr          string
+	HandlePublish func(*Conn)
+	HandlePlay    func(*Conn)
+	HandleConn    func(*Conn)
+}
+
+func (self *Server) handleConn(conn *Conn) (err error) {
+	defer conn.Close()
+
+	if self.HandleConn != nil {
+		self.HandleConn(conn)
+	} else {
+		if err = conn.Prepare(); err != nil {
+			return
+		}
+
+		if conn.playing {
+			if self.HandlePlay != nil {
+				self.HandlePlay(conn)
+			}
+		} else if conn.publishing {
+			if self.HandlePublish != nil {
+				self.HandlePublish(conn)
+			}
+		}
+	}
+
+	return
+}
+
+func (self *Server) ListenAndServe() (err error) {
+	addr := self.Addr
+	if addr == "" {
+		addr = ":554"
+	}
+	var tcpaddr *net.TCPAddr
+	if tcpaddr, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+		err = fmt.Errorf("rtsp: ListenAndServe: %s", err)
+		return
+	}
+
+	var listener *net.TCPListener
+	if listener, err = net.ListenTCP("tcp", tcpaddr); err != nil {
+		return
+	}
+
+	if DebugRtsp {
+		fmt.Println("rtsp: server: listening on", addr)
+	}
+
+	for {
+		var netconn net.Conn
+		if netconn, err = listener.Accept(); err != nil {
+			return
+		}
+
+		if DebugRtsp {
+			fmt.Println("rtsp: server: accepted")
+		}
+
+		conn := NewConn(netconn)
+		go func() {
+			err := self.handleConn(conn)
+			if DebugRtsp {
+				fmt.Println("rtsp: server: client closed err:", err)
+			}
+		}()
+	}
+}
+
+const (
+	stageRequestDone = iota + 1
+	stagePlaying
+	stageRecording
+)
+
+type serverRequest struct {
+	Method string
+	Uri    string
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	501: "Not Implemented",
+}
+
+// Conn is the server side of an RTSP connection. A playing Conn is an
+// av.Muxer and a publishing Conn is an av.Demuxer.
+type Conn struct {
+	URL       *url.URL
+	DebugRtsp bool
+
+	netconn   net.Conn
+	bufr      *bufio.Reader
+	bufw      *bufio.Writer
+	writelock sync.Mutex
+
+	stage               int
+	playing, publishing bool
+	session             string
+	describe            *serverRequest
+
+	// playing
+	packetizers []*rtpPacketizer
+	channels    []int
+	readerr     error
+	readerrlock sync.Mutex
+
+	// publishing
+	streams  []*Stream
+	setupIdx []int
+	setupMap map[int]int
+}
+
+func NewConn(netconn net.Conn) *Conn {
+	return &Conn{
+		netconn:   netconn,
+		bufr:      bufio.NewReaderSize(netconn, pio.RecommendBufioSize),
+		bufw:      bufio.NewWriterSize(netconn, pio.RecommendBufioSize),
+		DebugRtsp: DebugRtsp,
+	}
+}
+
+func (self *Conn) NetConn() net.Conn {
+	return self.netconn
+}
+
+func (self *Conn) Close() (err error) {
+	return self.netconn.Close()
+}
+
+// readRequest reads either an RTSP request or an interleaved block
+// ('$' + channel + 16 bit length + data).
+func (self *Conn) readRequest() (req *serverRequest, block []byte, err error) {
+	for {
+		var b []byte
+		if b, err = self.bufr.Peek(1); err != nil {
+			return
+		}
+
+		if b[0] == '$' {
+			var h [4]byte
+			if _, err = io.ReadFull(self.bufr, h[:]); err != nil {
+				return
+			}
+			length := int(pio.U16BE(h[2:4]))
+			block = make([]byte, 4+length)
+			copy(block, h[:])
+			if _, err = io.ReadFull(self.bufr, block[4:]); err != nil {
+				return
+			}
+			return
+		}
+
+		tp := textproto.NewReader(self.bufr)
+		var line string
+		if line, err = tp.ReadLine(); err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+			err = fmt.Errorf("rtsp: invalid request line %q", line)
+			return
+		}
+		req = &serverRequest{Method: fields[0], Uri: fields[1]}
+		if req.Header, err = tp.ReadMIMEHeader(); err != nil {
+			return
+		}
+		if length, _ := strconv.Atoi(req.Header.Get("Content-Length")); length > 0 {
+			req.Body = make([]byte, length)
+			if _, err = io.ReadFull(self.bufr, req.Body); err != nil {
+				return
+			}
+		}
+
+		if self.DebugRtsp {
+			fmt.Println("rtsp: server: <", line)
+		}
+		return
+	}
+}
+
+func (self *Conn) writeResponse(req *serverRequest, code int, headers []string, body []byte) (err error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "RTSP/1.0 %d %s\r\n", code, statusText[code])
+	fmt.Fprintf(buf, "CSeq: %s\r\n", req.Header.Get("CSeq"))
+	if self.session != "" {
+		fmt.Fprintf(buf, "Session: %s;timeout=60\r\n", self.session)
+	}
+	for _, s := range headers {
+		io.WriteString(buf, s)
+		io.WriteString(buf, "\r\n")
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(buf, "Content-Length: %d\r\n", len(body))
+	}
+	io.WriteString(buf, "\r\n")
+	buf.Write(body)
+
+	if self.DebugRtsp {
+		fmt.Print("rtsp: server: > ", buf.String())
+	}
+
+	self.writelock.Lock()
+	defer self.writelock.Unlock()
+	if _, err = self.bufw.Write(buf.Bytes()); err != nil {
+		return
+	}
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+	return
+}
+
+// handleCommonRequest answers requests that are valid in any state. It
+// returns io.EOF after a TEARDOWN.
+func (self *Conn) handleCommonRequest(req *serverRequest) (err error) {
+	switch req.Method {
+	case "OPTIONS":
+		err = self.writeResponse(req, 200, []string{
+			"Public: OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, RECORD, TEARDOWN, GET_PARAMETER, SET_PARAMETER",
+		}, nil)
+
+	case "GET_PARAMETER", "SET_PARAMETER":
+		err = self.writeResponse(req, 200, nil, nil)
+
+	case "TEARDOWN":
+		self.writeResponse(req, 200, nil, nil)
+		err = io.EOF
+
+	default:
+		err = self.writeResponse(req, 455, nil, nil)
+	}
+	return
+}
+
+func newSessionId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTransport returns the interleaved channel of RTP requested in the
+// SETUP Transport header, or ok=false for non TCP transports.
+func parseTransport(transport string, defchan int) (channel int, ok bool) {
+	channel = defchan
+	for _, field := range strings.Split(transport, ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "RTP/AVP") {
+			ok = strings.HasSuffix(field, "/TCP")
+		} else if strings.HasPrefix(field, "interleaved=") {
+			ch := strings.SplitN(strings.TrimPrefix(field, "interleaved="), "-", 2)
+			if i, err := strconv.Atoi(ch[0]); err == nil {
+				channel = i
+			}
+		}
+	}
+	return
+}
+
+// setupIndex finds the stream a SETUP request refers to by its control
+// attribute.
+func setupIndex(uri string, controls []string) int {
+	for i, control := range controls {
+		if uri == control || strings.HasSuffix(uri, "/"+control) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *Conn) handleSetup(req *serverRequest, controls []string) (idx int, channel int, err error) {
+	if idx = setupIndex(req.Uri, controls); idx == -1 {
+		err = self.writeResponse(req, 404, nil, nil)
+		return
+	}
+	var ok bool
+	if channel, ok = parseTransport(req.Header.Get("Transport"), idx*2); !ok {
+		idx = -1
+		err = self.writeResponse(req, 461, nil, nil)
+		return
+	}
+	if self.session == "" {
+		self.session = newSessionId()
+	}
+	err = self.writeResponse(req, 200, []string{
+		fmt.Sprintf("Transport: RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1),
+	}, nil)
+	return
+}
+
+// Prepare reads requests until the client has sent DESCRIBE (playing) or
+// ANNOUNCE, SETUP and RECORD (publishing).
+func (self *Conn) Prepare() (err error) {
+	for self.stage < stageRequestDone {
+		var req *serverRequest
+		if req, _, err = self.readRequest(); err != nil {
+			return
+		}
+		if req == nil {
+			continue
+		}
+
+		switch req.Method {
+		case "DESCRIBE":
+			if self.URL, err = url.Parse(req.Uri); err != nil {
+				self.writeResponse(req, 400, nil, nil)
+				return
+			}
+			self.playing = true
+			self.describe = req
+			self.stage = stageRequestDone
+
+		case "ANNOUNCE":
+			if err = self.handleAnnounce(req); err != nil {
+				return
+			}
+
+		case "SETUP":
+			if !self.publishing {
+				if err = self.writeResponse(req, 455, nil, nil); err != nil {
+					return
+				}
+				break
+			}
+			controls := []string{}
+			for _, stream := range self.streams {
+				controls = append(controls, stream.Sdp.Control)
+			}
+			var idx, channel int
+			if idx, channel, err = self.handleSetup(req, controls); err != nil {
+				return
+			}
+			if idx != -1 {
+				self.setupMap[channel] = len(self.setupIdx)
+				self.setupIdx = append(self.setupIdx, idx)
+			}
+
+		case "RECORD":
+			if !self.publishing || len(self.setupIdx) == 0 {
+				if err = self.writeResponse(req, 455, nil, nil); err != nil {
+					return
+				}
+				break
+			}
+			if err = self.writeResponse(req, 200, nil, nil); err != nil {
+				return
+			}
+			self.stage = stageRequestDone
+
+		default:
+			if err = self.handleCommonRequest(req); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *Conn) handleAnnounce(req *serverRequest) (err error) {
+	if self.URL, err = url.Parse(req.Uri); err != nil {
+		self.writeResponse(req, 400, nil, nil)
+		return
+	}
+	_, medias := sdp.Parse(string(req.Body))
+	if len(medias) == 0 {
+		err = fmt.Errorf("rtsp: ANNOUNCE without media")
+		self.writeResponse(req, 400, nil, nil)
+		return
+	}
+	self.streams = []*Stream{}
+	for _, media := range medias {
+		stream := &Stream{Sdp: media}
+		stream.makeCodecData()
+		self.streams = append(self.streams, stream)
+	}
+	self.setupMap = map[int]int{}
+	self.publishing = true
+	return self.writeResponse(req, 200, nil, nil)
+}
+
+// WriteHeader answers the pending DESCRIBE with an SDP made from streams and
+// then waits for SETUP and PLAY.
+func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
+	if err = self.Prepare(); err != nil {
+		return
+	}
+	if !self.playing {
+		err = fmt.Errorf("rtsp: WriteHeader on a publishing conn")
+		return
+	}
+
+	self.packetizers = []*rtpPacketizer{}
+	self.channels = []int{}
+	controls := []string{}
+	for i, codec := range streams {
+		var packetizer *rtpPacketizer
+		if packetizer, err = newRtpPacketizer(codec, i); err != nil {
+			self.writeResponse(self.describe, 501, nil, nil)
+			return
+		}
+		self.packetizers = append(self.packetizers, packetizer)
+		self.channels = append(self.channels, -1)
+		controls = append(controls, fmt.Sprintf("streamid=%d", i))
+	}
+
+	uri := strings.TrimSuffix(self.describe.Uri, "/")
+	if err = self.writeResponse(self.describe, 200, []string{
+		"Content-Type: application/sdp",
+		"Content-Base: " + uri + "/",
+	}, makeSdp(uri, self.packetizers)); err != nil {
+		return
+	}
+
+	for self.stage < stagePlaying {
+		var req *serverRequest
+		if req, _, err = self.readRequest(); err != nil {
+			return
+		}
+		if req == nil {
+			continue
+		}
+
+		switch req.Method {
+		case "SETUP":
+			var idx, channel int
+			if idx, channel, err = self.handleSetup(req, controls); err != nil {
+				return
+			}
+			if idx != -1 {
+				self.channels[idx] = channel
+			}
+
+		case "PLAY":
+			setup := false
+			for _, channel := range self.channels {
+				if channel != -1 {
+					setup = true
+				}
+			}
+			if !setup {
+				if err = self.writeResponse(req, 455, nil, nil); err != nil {
+					return
+				}
+				break
+			}
+			if err = self.writeResponse(req, 200, []string{"Range: npt=0.000-"}, nil); err != nil {
+				return
+			}
+			self.stage = stagePlaying
+			go self.readLoop()
+
+		default:
+			if err = self.handleCommonRequest(req); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// readLoop answers keepalives and TEARDOWN while playing. RTCP blocks from
+// the client are dropped.
+func (self *Conn) readLoop() {
+	var err error
+	for {
+		var req *serverRequest
+		if req, _, err = self.readRequest(); err != nil {
+			break
+		}
+		if req != nil {
+			if err = self.handleCommonRequest(req); err != nil {
+				break
+			}
+		}
+	}
+	self.readerrlock.Lock()
+	self.readerr = err
+	self.readerrlock.Unlock()
+	self.netconn.Close()
+}
+
+func (self *Conn) WritePacket(pkt av.Packet) (err error) {
+	self.readerrlock.Lock()
+	err = self.readerr
+	self.readerrlock.Unlock()
+	if err != nil {
+		return
+	}
+
+	if pkt.IsScriptData {
+		return
+	}
+	if int(pkt.Idx) >= len(self.packetizers) {
+		err = fmt.Errorf("rtsp: stream#%d not found", pkt.Idx)
+		return
+	}
+	channel := self.channels[pkt.Idx]
+	if channel == -1 {
+		return
+	}
+
+	self.writelock.Lock()
+	defer self.writelock.Unlock()
+	if err = self.packetizers[pkt.Idx].packetize(pkt, func(b []byte) error {
+		h := [4]byte{'$', byte(channel)}
+		pio.PutU16BE(h[2:4], uint16(len(b)))
+		if _, err := self.bufw.Write(h[:]); err != nil {
+			return err
+		}
+		_, err := self.bufw.Write(b)
+		return err
+	}); err != nil {
+		return
+	}
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Conn) WriteTrailer() (err error) {
+	return
+}
+
+func (self *Conn) allCodecDataReady() bool {
+	for _, si := range self.setupIdx {
+		if self.streams[si].CodecData == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Conn) Streams() (streams []av.CodecData, err error) {
+	if err = self.Prepare(); err != nil {
+		return
+	}
+	if !self.publishing {
+		err = fmt.Errorf("rtsp: Streams on a playing conn")
+		return
+	}
+	if self.stage < stageRecording {
+		// wait for in-band parameter sets if the SDP had none
+		for !self.allCodecDataReady() {
+			if _, err = self.readPacket(); err != nil {
+				return
+			}
+		}
+		self.stage = stageRecording
+	}
+	for _, si := range self.setupIdx {
+		streams = append(streams, self.streams[si].CodecData)
+	}
+	return
+}
+
+func (self *Conn) readPacket() (pkt av.Packet, err error) {
+	for {
+		var req *serverRequest
+		var block []byte
+		if req, block, err = self.readRequest(); err != nil {
+			return
+		}
+		if req != nil {
+			if err = self.handleCommonRequest(req); err != nil {
+				return
+			}
+			continue
+		}
+
+		i, ok := self.setupMap[int(block[1])]
+		if !ok {
+			// rtcp or unknown channel
+			continue
+		}
+		stream := self.streams[self.setupIdx[i]]
+		if err = stream.handleRtpPacket(block[4:]); err != nil {
+			return
+		}
+		if stream.gotpkt {
+			return stream.takePacket(int8(i))
+		}
+	}
+}
+
+func (self *Conn) ReadPacket() (pkt av.Packet, err error) {
+	if _, err = self.Streams(); err != nil {
+		return
+	}
+	return self.readPacket()
+}
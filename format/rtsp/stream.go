@@ -1,6 +1,7 @@
 package rtsp
 
 import (
+	"fmt"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/format/rtsp/sdp"
 	"time"
@@ -19,6 +20,15 @@ type Stream struct {
 	spsChanged bool
 	ppsChanged bool
 
+	// h265
+	vps        []byte
+	vpsChanged bool
+
+	// udp
+	jitter *jitterBuffer
+
+	stats *rtpStats
+
 	gotpkt    bool
 	pkt       av.Packet
 	timestamp uint32
@@ -27,3 +37,43 @@ type Stream struct {
 	lasttime time.Duration
 }
 
+
+// takePacket returns the packet completed by handleRtpPacket, timed from the
+// first RTP timestamp of the stream.
+func (self *Stream) takePacket(idx int8) (pkt av.Packet, err error) {
+	/*
+	TODO: sync AV by rtcp NTP timestamp
+	TODO: handle timestamp overflow
+	https://tools.ietf.org/html/rfc3550
+	A receiver can then synchronize presentation of the audio and video packets by relating 
+	their RTP timestamps using the timestamp pairs in RTCP SR packets.
+	*/
+	if self.firsttimestamp == 0 {
+		self.firsttimestamp = self.timestamp
+	}
+	self.timestamp -= self.firsttimestamp
+
+	pkt = self.pkt
+	pkt.Time = time.Duration(self.timestamp)*time.Second / time.Duration(self.timeScale())
+	pkt.Idx = idx
+
+	if pkt.Time < self.lasttime || pkt.Time - self.lasttime > time.Minute*30 {
+		err = fmt.Errorf("rtp: time invalid stream#%d time=%v lasttime=%v", pkt.Idx, pkt.Time, self.lasttime)
+		return
+	}
+	self.lasttime = pkt.Time
+
+	// the parameter sets precede the frame they apply to, a resolution
+	// change may come with a new sps only
+	if self.client != nil && self.client.InBandCodecDataChange && (self.vpsChanged || self.spsChanged || self.ppsChanged) {
+		if err = self.makeCodecDataFromParamSets(); err != nil {
+			return
+		}
+		self.clearCodecDataChange()
+		pkt.NewCodecData = self.CodecData
+	}
+
+	self.pkt = av.Packet{}
+	self.gotpkt = false
+	return
+}
@@ -0,0 +1,349 @@
+package rtsp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	TransportTCP = iota
+	TransportUDP
+	TransportUDPMulticast
+)
+
+var ErrRtpTimeout = fmt.Errorf("rtsp: rtp timeout")
+
+type udpPacket struct {
+	idx  int
+	rtcp bool
+	data []byte
+	time time.Time
+	// packets lost before this one, set after reordering
+	lost   int
+	resync bool
+	err    error
+}
+
+type udpConnPair struct {
+	idx  int
+	rtp  *net.UDPConn
+	rtcp *net.UDPConn
+	// where receiver reports are sent
+	rtcpAddr *net.UDPAddr
+}
+
+// udpReceiver collects the packets of all UDP sockets of a Client into one
+// channel, so readPacket can wait on them together.
+type udpReceiver struct {
+	pairs   []udpConnPair
+	ch      chan udpPacket
+	done    chan struct{}
+	once    sync.Once
+	pending []udpPacket
+	// returned once the pending packets are read
+	err error
+}
+
+func newUdpReceiver() *udpReceiver {
+	return &udpReceiver{
+		ch:   make(chan udpPacket, 256),
+		done: make(chan struct{}),
+	}
+}
+
+func (self *udpReceiver) send(p udpPacket) bool {
+	select {
+	case self.ch <- p:
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
+func (self *udpReceiver) readLoop(conn *net.UDPConn, idx int, rtcp bool) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			self.send(udpPacket{err: err})
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if !self.send(udpPacket{idx: idx, rtcp: rtcp, data: data, time: time.Now()}) {
+			return
+		}
+	}
+}
+
+// start begins reading the UDP sockets. Responses on the RTSP connection
+// are discarded from now on, its closing ends the session.
+func (self *udpReceiver) start(cli *Client) {
+	for _, pair := range self.pairs {
+		go self.readLoop(pair.rtp, pair.idx, false)
+		go self.readLoop(pair.rtcp, pair.idx, true)
+	}
+	conn := cli.conn.Conn
+	go func() {
+		conn.SetReadDeadline(time.Time{})
+		_, err := io.Copy(ioutil.Discard, conn)
+		if err == nil {
+			err = io.EOF
+		}
+		self.send(udpPacket{err: err})
+	}()
+}
+
+func (self *udpReceiver) writeRtcp(idx int, b []byte) (err error) {
+	for _, pair := range self.pairs {
+		if pair.idx == idx && pair.rtcpAddr != nil {
+			_, err = pair.rtcp.WriteToUDP(b, pair.rtcpAddr)
+			return
+		}
+	}
+	return
+}
+
+func (self *udpReceiver) close() {
+	self.once.Do(func() {
+		close(self.done)
+		for _, pair := range self.pairs {
+			pair.rtp.Close()
+			pair.rtcp.Close()
+		}
+	})
+}
+
+// listenUDPPair opens two sockets on an even port and the next odd one as
+// RFC 3550 asks for RTP and RTCP.
+func listenUDPPair() (rtp, rtcp *net.UDPConn, err error) {
+	for i := 0; i < 16; i++ {
+		if rtp, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+			return
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcp, err = net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return
+			}
+		}
+		rtp.Close()
+	}
+	err = fmt.Errorf("rtsp: no free udp port pair")
+	return
+}
+
+// parsePortRange parses "5000-5001" or "5000".
+func parsePortRange(s string) (rtp, rtcp int, err error) {
+	ports := strings.SplitN(s, "-", 2)
+	if rtp, err = strconv.Atoi(ports[0]); err != nil {
+		return
+	}
+	rtcp = rtp + 1
+	if len(ports) == 2 {
+		if rtcp, err = strconv.Atoi(ports[1]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func parseTransportParams(transport string) map[string]string {
+	params := map[string]string{}
+	for _, field := range strings.Split(transport, ";") {
+		keyval := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyval) == 2 {
+			params[keyval[0]] = keyval[1]
+		} else {
+			params[keyval[0]] = ""
+		}
+	}
+	return params
+}
+
+func (self *Client) setupUDP(si int, uri string) (err error) {
+	if self.udp == nil {
+		self.udp = newUdpReceiver()
+	}
+	stream := self.streams[si]
+	stream.jitter = newJitterBuffer(self.JitterBufferSize, self.JitterBufferDelay)
+
+	var rtp, rtcp *net.UDPConn
+	req := Request{Method: "SETUP", Uri: uri}
+	if self.Transport == TransportUDPMulticast {
+		req.Header = append(req.Header, "Transport: RTP/AVP;multicast")
+	} else {
+		if rtp, rtcp, err = listenUDPPair(); err != nil {
+			return
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		req.Header = append(req.Header, fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+	}
+	if self.session != "" {
+		req.Header = append(req.Header, "Session: "+self.session)
+	}
+
+	var res Response
+	if err = self.WriteRequest(req); err == nil {
+		res, err = self.ReadResponse()
+	}
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("rtsp: SETUP udp failed, StatusCode=%d", res.StatusCode)
+	}
+	if err != nil {
+		if rtp != nil {
+			rtp.Close()
+			rtcp.Close()
+		}
+		return
+	}
+
+	params := parseTransportParams(res.Headers.Get("Transport"))
+	var rtcpAddr *net.UDPAddr
+	if self.Transport == TransportUDPMulticast {
+		group := net.ParseIP(params["destination"])
+		if group == nil {
+			err = fmt.Errorf("rtsp: multicast destination missing in %q", res.Headers.Get("Transport"))
+			return
+		}
+		var rtpport, rtcpport int
+		if rtpport, rtcpport, err = parsePortRange(params["port"]); err != nil {
+			err = fmt.Errorf("rtsp: multicast port invalid: %s", err)
+			return
+		}
+		if rtp, err = net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: group, Port: rtpport}); err != nil {
+			return
+		}
+		if rtcp, err = net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: group, Port: rtcpport}); err != nil {
+			rtp.Close()
+			return
+		}
+		rtcpAddr = &net.UDPAddr{IP: group, Port: rtcpport}
+	} else if _, rtcpport, perr := parsePortRange(params["server_port"]); perr == nil {
+		host := self.url.Hostname()
+		if source := params["source"]; source != "" {
+			host = source
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			rtcpAddr = &net.UDPAddr{IP: ip, Port: rtcpport}
+		} else if ipaddr, rerr := net.ResolveIPAddr("ip", host); rerr == nil {
+			rtcpAddr = &net.UDPAddr{IP: ipaddr.IP, Port: rtcpport}
+		}
+	}
+
+	self.udp.pairs = append(self.udp.pairs, udpConnPair{idx: si, rtp: rtp, rtcp: rtcp, rtcpAddr: rtcpAddr})
+	return
+}
+
+func (self *Client) readUDPPacket() (pkt av.Packet, err error) {
+	for {
+		for len(self.udp.pending) > 0 {
+			p := self.udp.pending[0]
+			self.udp.pending = self.udp.pending[1:]
+
+			if p.lost > 0 || p.resync {
+				// a fragmented NALU spanning the gap can't be completed
+				self.streams[p.idx].fuStarted = false
+				if self.DebugRtp {
+					fmt.Println("rtp: stream", p.idx, "lost", p.lost, "packets")
+				}
+			}
+
+			var ok bool
+			if pkt, ok, err = self.handleRtp(p.idx, p.data); err != nil {
+				return
+			}
+			if ok {
+				return
+			}
+		}
+
+		if self.udp.err != nil {
+			err = self.udp.err
+			self.udp.err = nil
+			return
+		}
+
+		var p udpPacket
+		var timer, jittertimer *time.Timer
+		var timeout, jittertimeout <-chan time.Time
+		if self.RtpTimeout > 0 {
+			timer = time.NewTimer(self.RtpTimeout)
+			timeout = timer.C
+		}
+		if deadline, ok := self.jitterDeadline(); ok {
+			jittertimer = time.NewTimer(deadline.Sub(time.Now()))
+			jittertimeout = jittertimer.C
+		}
+		released := false
+		select {
+		case p = <-self.udp.ch:
+		case <-timeout:
+			p.err = ErrRtpTimeout
+		case now := <-jittertimeout:
+			self.releaseJitter(now, false)
+			released = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if jittertimer != nil {
+			jittertimer.Stop()
+		}
+		if released {
+			continue
+		}
+		if p.err != nil {
+			// packets still held are read before the error
+			self.udp.err = p.err
+			self.releaseJitter(time.Now(), true)
+			continue
+		}
+		stream := self.streams[p.idx]
+		if p.rtcp {
+			if herr := stream.handleRtcpPacket(p.data); herr != nil && !self.SkipErrRtpBlock {
+				err = herr
+				return
+			}
+			continue
+		}
+
+		stream.stats.update(p.data, p.time, stream.timeScale())
+		self.addPending(p.idx, stream.jitter.push(p.data, p.time))
+	}
+}
+
+func (self *Client) addPending(idx int, packets []jitterPacket) {
+	for _, jp := range packets {
+		self.udp.pending = append(self.udp.pending, udpPacket{idx: idx, data: jp.data, lost: jp.lost, resync: jp.resync})
+	}
+}
+
+// releaseJitter moves the packets no longer waited for, or all with flush,
+// from the jitter buffers to pending.
+func (self *Client) releaseJitter(now time.Time, flush bool) {
+	for _, pair := range self.udp.pairs {
+		if jitter := self.streams[pair.idx].jitter; jitter != nil {
+			self.addPending(pair.idx, jitter.release(now, flush))
+		}
+	}
+}
+
+func (self *Client) jitterDeadline() (deadline time.Time, ok bool) {
+	for _, pair := range self.udp.pairs {
+		if jitter := self.streams[pair.idx].jitter; jitter != nil {
+			if t, held := jitter.deadline(); held && (!ok || t.Before(deadline)) {
+				deadline, ok = t, true
+			}
+		}
+	}
+	return
+}
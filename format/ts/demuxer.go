@@ -2,6 +2,7 @@ package ts
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"time"
 	"github.com/nareix/joy4/utils/bits/pio"
@@ -9,6 +10,7 @@ import (
 	"github.com/nareix/joy4/format/ts/tsio"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"io"
 )
 
@@ -17,9 +19,10 @@ type Demuxer struct {
 
 	pkts []av.Packet
 
-	pat     *tsio.PAT
-	pmt     *tsio.PMT
-	streams []*Stream
+	pat        *tsio.PAT
+	pmt        *tsio.PMT
+	pmtversion uint8
+	streams    []*Stream
 	tshdr   []byte
 
 	stage int
@@ -94,34 +97,63 @@ func (self *Demuxer) poll() (err error) {
 	return
 }
 
-func (self *Demuxer) initPMT(payload []byte) (err error) {
+// handlePMT parses the first PMT and later ones with a new version. Streams
+// keep their index, a stream whose pid or type changed starts over and
+// signals its codec data with NewCodecData once known.
+func (self *Demuxer) handlePMT(payload []byte) (err error) {
 	var psihdrlen int
 	var datalen int
-	if _, _, psihdrlen, datalen, err = tsio.ParsePSI(payload); err != nil {
+	var version uint8
+	if _, _, version, psihdrlen, datalen, err = tsio.ParsePSIVersion(payload); err != nil {
 		return
 	}
-	self.pmt = &tsio.PMT{}
-	if _, err = self.pmt.Unmarshal(payload[psihdrlen:psihdrlen+datalen]); err != nil {
+	if self.pmt != nil && version == self.pmtversion {
+		return
+	}
+	pmt := &tsio.PMT{}
+	if _, err = pmt.Unmarshal(payload[psihdrlen:psihdrlen+datalen]); err != nil {
 		return
 	}
 
-	self.streams = []*Stream{}
-	for i, info := range self.pmt.ElementaryStreamInfos {
+	streams := []*Stream{}
+	for _, info := range pmt.ElementaryStreamInfos {
+		switch info.StreamType {
+		case tsio.ElementaryStreamTypeH264, tsio.ElementaryStreamTypeH265, tsio.ElementaryStreamTypeAdtsAAC:
+		default:
+			continue
+		}
+		i := len(streams)
+		if i < len(self.streams) && self.streams[i].pid == info.ElementaryPID && self.streams[i].streamType == info.StreamType {
+			streams = append(streams, self.streams[i])
+			continue
+		}
 		stream := &Stream{}
 		stream.idx = i
 		stream.demuxer = self
 		stream.pid = info.ElementaryPID
 		stream.streamType = info.StreamType
-		switch info.StreamType {
-		case tsio.ElementaryStreamTypeH264:
-			self.streams = append(self.streams, stream)
-		case tsio.ElementaryStreamTypeAdtsAAC:
-			self.streams = append(self.streams, stream)
-		}
+		streams = append(streams, stream)
+	}
+	if self.pmt != nil && len(streams) != len(self.streams) {
+		err = fmt.Errorf("ts: number of streams changed from %d to %d", len(self.streams), len(streams))
+		return
 	}
+
+	self.pmt = pmt
+	self.pmtversion = version
+	self.streams = streams
 	return
 }
 
+func (self *Demuxer) isPMTPID(pid uint16) bool {
+	for _, entry := range self.pat.Entries {
+		if entry.ProgramMapPID == pid {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *Demuxer) payloadEnd() (n int, err error) {
 	for _, stream := range self.streams {
 		var i int
@@ -160,16 +192,13 @@ func (self *Demuxer) readTSPacket() (err error) {
 				return
 			}
 		}
-	} else if self.pmt == nil {
-		for _, entry := range self.pat.Entries {
-			if entry.ProgramMapPID == pid {
-				if err = self.initPMT(payload); err != nil {
-					return
-				}
-				break
+	} else if self.isPMTPID(pid) {
+		if start {
+			if err = self.handlePMT(payload); err != nil {
+				return
 			}
 		}
-	} else {
+	} else if self.pmt != nil {
 		for _, stream := range self.streams {
 			if pid == stream.pid {
 				if err = stream.handleTSPacket(start, iskeyframe, payload); err != nil {
@@ -200,9 +229,29 @@ func (self *Stream) addPacket(payload []byte, timedelta time.Duration) {
 	if pts != dts {
 		pkt.CompositionTime = pts-dts
 	}
+	if self.changed {
+		pkt.NewCodecData = self.CodecData
+		self.changed = false
+	}
 	demuxer.pkts = append(demuxer.pkts, pkt)
 }
 
+// setCodecData replaces the codec data of the stream if it differs.
+// After probing, the first packet of the payload being handled, or the next
+// one, carries the change.
+func (self *Stream) setCodecData(codec av.CodecData, first int) {
+	self.CodecData = codec
+	demuxer := self.demuxer
+	if demuxer.stage == 0 {
+		return
+	}
+	if first < len(demuxer.pkts) {
+		demuxer.pkts[first].NewCodecData = codec
+	} else {
+		self.changed = true
+	}
+}
+
 func (self *Stream) payloadEnd() (n int, err error) {
 	payload := self.data
 	if payload == nil {
@@ -213,6 +262,7 @@ func (self *Stream) payloadEnd() (n int, err error) {
 		return
 	}
 	self.data = nil
+	first := len(self.demuxer.pkts)
 
 	switch self.streamType {
 	case tsio.ElementaryStreamTypeAdtsAAC:
@@ -224,10 +274,15 @@ func (self *Stream) payloadEnd() (n int, err error) {
 			if config, hdrlen, framelen, samples, err = aacparser.ParseADTSHeader(payload); err != nil {
 				return
 			}
-			if self.CodecData == nil {
-				if self.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
+			if codec, ok := self.CodecData.(aacparser.CodecData); !ok ||
+				codec.Config.ObjectType != config.ObjectType ||
+				codec.Config.SampleRateIndex != config.SampleRateIndex ||
+				codec.Config.ChannelConfig != config.ChannelConfig {
+				var codec av.CodecData
+				if codec, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
 					return
 				}
+				self.setCodecData(codec, first)
 			}
 			self.addPacket(payload[hdrlen:framelen], delta)
 			n++
@@ -257,9 +312,56 @@ func (self *Stream) payloadEnd() (n int, err error) {
 			}
 		}
 
-		if self.CodecData == nil && len(sps) > 0 && len(pps) > 0 {
-			if self.CodecData, err = h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err != nil {
-				return
+		if len(sps) > 0 && len(pps) > 0 {
+			if codec, ok := self.CodecData.(h264parser.CodecData); !ok ||
+				!bytes.Equal(codec.SPS(), sps) || !bytes.Equal(codec.PPS(), pps) {
+				var codec av.CodecData
+				if codec, err = h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err != nil {
+					return
+				}
+				self.setCodecData(codec, first)
+			}
+		}
+
+	case tsio.ElementaryStreamTypeH265:
+		nalus, _ := h265parser.SplitNALUs(payload)
+		var vps, sps, pps []byte
+		var b []byte
+		for _, nalu := range nalus {
+			if len(nalu) < 2 {
+				continue
+			}
+			switch h265parser.NALUType(nalu) {
+			case h265parser.NALU_VPS:
+				vps = nalu
+			case h265parser.NALU_SPS:
+				sps = nalu
+			case h265parser.NALU_PPS:
+				pps = nalu
+			case h265parser.NALU_AUD:
+			default:
+				if h265parser.IsKeyFrameNALU(nalu) {
+					self.iskeyframe = true
+				}
+				// one access unit per PES, raw nalus to avcc
+				b = append(b, 0, 0, 0, 0)
+				pio.PutU32BE(b[len(b)-4:], uint32(len(nalu)))
+				b = append(b, nalu...)
+			}
+		}
+		if len(b) > 0 {
+			self.addPacket(b, time.Duration(0))
+			n++
+		}
+
+		if len(vps) > 0 && len(sps) > 0 && len(pps) > 0 {
+			if codec, ok := self.CodecData.(h265parser.CodecData); !ok ||
+				!bytes.Equal(codec.VPS(), vps) || !bytes.Equal(codec.SPS(), sps) || !bytes.Equal(codec.PPS(), pps) {
+				var codec av.CodecData
+				if codec, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps); err != nil {
+					return
+				}
+				self.setCodecData(codec, first)
 			}
 		}
 	}
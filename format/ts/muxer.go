@@ -5,12 +5,13 @@ import (
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"github.com/nareix/joy4/format/ts/tsio"
 	"io"
 	"time"
 )
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC}
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC}
 
 type Muxer struct {
 	w                        io.Writer
@@ -25,6 +26,7 @@ type Muxer struct {
 	nalus   [][]byte
 
 	tswpat, tswpmt *tsio.TSWriter
+	pmtversion     uint8
 }
 
 func NewMuxer(w io.Writer) *Muxer {
@@ -41,16 +43,18 @@ func NewMuxer(w io.Writer) *Muxer {
 	}
 }
 
-func (self *Muxer) newStream(codec av.CodecData) (err error) {
-	ok := false
+func checkCodecType(codec av.CodecData) (err error) {
 	for _, c := range CodecTypes {
 		if codec.Type() == c {
-			ok = true
-			break
+			return
 		}
 	}
-	if !ok {
-		err = fmt.Errorf("ts: codec type=%s is not supported", codec.Type())
+	err = fmt.Errorf("ts: codec type=%s is not supported", codec.Type())
+	return
+}
+
+func (self *Muxer) newStream(codec av.CodecData) (err error) {
+	if err = checkCodecType(codec); err != nil {
 		return
 	}
 
@@ -116,6 +120,11 @@ func (self *Muxer) WritePATPMT() (err error) {
 				StreamType:    tsio.ElementaryStreamTypeH264,
 				ElementaryPID: stream.pid,
 			})
+		case av.H265:
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    tsio.ElementaryStreamTypeH265,
+				ElementaryPID: stream.pid,
+			})
 		}
 	}
 
@@ -129,7 +138,7 @@ func (self *Muxer) WritePATPMT() (err error) {
 		return
 	}
 	pmt.Marshal(self.psidata[tsio.PSIHeaderLength:])
-	n = tsio.FillPSI(self.psidata, tsio.TableIdPMT, tsio.TableExtPMT, pmtlen)
+	n = tsio.FillPSIVersion(self.psidata, tsio.TableIdPMT, tsio.TableExtPMT, self.pmtversion, pmtlen)
 	self.datav[0] = self.psidata[:n]
 	if err = self.tswpmt.WritePackets(self.w, self.datav[:1], 0, false, true); err != nil {
 		return
@@ -152,8 +161,33 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	return
 }
 
+// changeCodecData switches a stream to new codec data. Parameter sets are
+// sent in-band with keyframes, so only a codec type change needs a new PMT.
+func (self *Muxer) changeCodecData(stream *Stream, codec av.CodecData) (err error) {
+	if err = checkCodecType(codec); err != nil {
+		return
+	}
+	typechanged := codec.Type() != stream.Type()
+	stream.CodecData = codec
+	if typechanged {
+		self.pmtversion = (self.pmtversion + 1) & 0x1f
+		if err = self.WritePATPMT(); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if pkt.IsScriptData {
+		return
+	}
 	stream := self.streams[pkt.Idx]
+	if pkt.NewCodecData != nil {
+		if err = self.changeCodecData(stream, pkt.NewCodecData); err != nil {
+			return
+		}
+	}
 	pkt.Time += time.Second
 
 	switch stream.Type() {
@@ -196,6 +230,37 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdH264, -1, pkt.Time+pkt.CompositionTime, pkt.Time)
 		datav[0] = self.peshdr[:n]
 
+		if err = stream.tsw.WritePackets(self.w, datav, pkt.Time, pkt.IsKeyFrame, false); err != nil {
+			return
+		}
+
+	case av.H265:
+		codec := stream.CodecData.(h265parser.CodecData)
+
+		nalus := self.nalus[:0]
+		if pkt.IsKeyFrame {
+			nalus = append(nalus, codec.VPS())
+			nalus = append(nalus, codec.SPS())
+			nalus = append(nalus, codec.PPS())
+		}
+		pktnalus, _ := h265parser.SplitNALUs(pkt.Data)
+		for _, nalu := range pktnalus {
+			nalus = append(nalus, nalu)
+		}
+
+		datav := self.datav[:1]
+		for i, nalu := range nalus {
+			if i == 0 {
+				datav = append(datav, h265parser.AUDBytes)
+			} else {
+				datav = append(datav, h265parser.StartCodeBytes)
+			}
+			datav = append(datav, nalu)
+		}
+
+		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdH265, -1, pkt.Time+pkt.CompositionTime, pkt.Time)
+		datav[0] = self.peshdr[:n]
+
 		if err = stream.tsw.WritePackets(self.w, datav, pkt.Time, pkt.IsKeyFrame, false); err != nil {
 			return
 		}
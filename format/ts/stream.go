@@ -23,5 +23,8 @@ type Stream struct {
 	pts, dts time.Duration
 	data []byte
 	datalen int
+
+	// codec data changed after probing, set NewCodecData on the next packet
+	changed bool
 }
 
@@ -10,6 +10,7 @@ import (
 
 const (
 	StreamIdH264 = 0xe0
+	StreamIdH265 = 0xe0
 	StreamIdAAC  = 0xc0
 )
 
@@ -34,6 +35,7 @@ var ErrParsePAT = fmt.Errorf("invalid PAT")
 
 const (
 	ElementaryStreamTypeH264    = 0x1B
+	ElementaryStreamTypeH265    = 0x24
 	ElementaryStreamTypeAdtsAAC = 0x0F
 )
 
@@ -277,6 +279,12 @@ func (self *PMT) Unmarshal(b []byte) (n int, err error) {
 }
 
 func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int, err error) {
+	tableid, tableext, _, hdrlen, datalen, err = ParsePSIVersion(h)
+	return
+}
+
+// ParsePSIVersion is ParsePSI also returning the version number.
+func ParsePSIVersion(h []byte) (tableid uint8, tableext uint16, version uint8, hdrlen int, datalen int, err error) {
 	if len(h) < 8 {
 		err = ErrPSIHeader
 		return
@@ -318,6 +326,7 @@ func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int
 	// resverd(2)=3
 	// version(5)
 	// Current_next_indicator(1)
+	version = h[hdrlen] >> 1 & 0x1f
 	hdrlen++
 
 	// section_number(8)
@@ -336,6 +345,12 @@ func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int
 const PSIHeaderLength = 9
 
 func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
+	return FillPSIVersion(h, tableid, tableext, 0, datalen)
+}
+
+// FillPSIVersion is FillPSI with a version number, which must change
+// whenever the table content does.
+func FillPSIVersion(h []byte, tableid uint8, tableext uint16, version uint8, datalen int) (n int) {
 	// pointer(8)
 	h[n] = 0
 	n++
@@ -352,8 +367,8 @@ func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
 	pio.PutU16BE(h[n:], tableext)
 	n += 2
 
-	// resverd(2)=3,version(5)=0,Current_next_indicator(1)=1
-	h[n] = 0x3<<6 | 1
+	// resverd(2)=3,version(5),Current_next_indicator(1)=1
+	h[n] = 0x3<<6 | (version&0x1f)<<1 | 1
 	n++
 
 	// section_number(8)